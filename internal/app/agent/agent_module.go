@@ -2,6 +2,7 @@ package agent
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/GoPlugin/web3rpcproxy/internal/app/agent/controller"
 	"github.com/GoPlugin/web3rpcproxy/internal/app/agent/repository"
@@ -23,38 +24,55 @@ var NewAgentModule = fx.Options(
 	fx.Provide(service.NewAgentService),
 	fx.Provide(service.NewTenantService),
 	fx.Provide(service.NewEndpointService),
+	fx.Provide(service.NewHeadService),
+	fx.Provide(service.NewSubscriptionService),
+	fx.Provide(service.NewEventService),
 
 	// register controller of agent module
 	fx.Provide(controller.NewAgentController),
 	fx.Provide(controller.NewOtherController),
+	fx.Provide(controller.NewCacheController),
 
 	fx.Provide(core.NewClient),
 
 	fx.Provide(NewJSONRPCSchema),
 
+	fx.Provide(NewErrorNormalizer),
+
 	fx.Provide(NewClientFactory),
 
 	fx.Provide(NewWeb3RPCProvider),
 )
 
-func NewClientFactory(config *config.Conf, t *http.Transport, jrpcSchema *rpc.JSONRPCSchema) *endpoint.ClientFactory {
+func NewClientFactory(config *config.Conf, t *http.Transport, jrpcSchema *rpc.JSONRPCSchema, normalizer *rpc.ErrorNormalizer) *endpoint.ClientFactory {
 	_config := &endpoint.ClientFactoryConfig{
 		ClientsSize:   config.Int("clients.size", 64),
 		JSONRPCSchema: jrpcSchema,
+		Normalizer:    normalizer,
 		Transport:     t,
+		PingInterval:  config.Duration("clients.websocket.ping_interval", 20*time.Second),
+		IdleTimeout:   config.Duration("clients.websocket.idle_timeout", time.Minute),
+		MinBackoff:    config.Duration("clients.websocket.min_backoff", 500*time.Millisecond),
+		MaxBackoff:    config.Duration("clients.websocket.max_backoff", 30*time.Second),
 	}
 	return endpoint.NewClientFactory(_config)
 }
 
+// NewJSONRPCSchema loads the schema for the normalization of the params, the requests and responses are validated by it
+// only if the validation is enabled
 func NewJSONRPCSchema(config *config.Conf) *rpc.JSONRPCSchema {
-	if config.Bool("jsonrpc.enable_validation", false) {
-		b := config.Get("jsonrpc.schema")
-		if v, ok := b.([]byte); ok {
-			return rpc.NewJSONRPCSchema(v)
-		}
-	}
+	b, _ := config.Get("jsonrpc.schema").([]byte)
+	return rpc.NewJSONRPCSchema(b, config.Bool("jsonrpc.enable_validation", false))
+}
+
+// NewErrorNormalizer classifies the errors of the endpoints by the configured rules, then the default ones
+func NewErrorNormalizer(config *config.Conf) (*rpc.ErrorNormalizer, error) {
+	rules := []rpc.ErrorRule{}
+	config.Unmarshal("errors.rules", &rules)
+	chains := map[string][]rpc.ErrorRule{}
+	config.Unmarshal("errors.chains", &chains)
 
-	return rpc.NewJSONRPCSchema([]byte{})
+	return rpc.NewErrorNormalizer(rules, chains)
 }
 
 type Web3RPCProviderConfig struct {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/GoPlugin/web3rpcproxy/internal/app/agent/service"
@@ -13,6 +14,7 @@ import (
 	"github.com/GoPlugin/web3rpcproxy/internal/common"
 	"github.com/GoPlugin/web3rpcproxy/internal/core/endpoint"
 	"github.com/GoPlugin/web3rpcproxy/internal/core/reqctx"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
 	"github.com/GoPlugin/web3rpcproxy/utils"
 	"github.com/GoPlugin/web3rpcproxy/utils/config"
 	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
@@ -25,6 +27,10 @@ type agentControllerConfig struct {
 	AppName             string
 	EnableTenantFeature bool
 	AmqpExchange        string
+	WebSocket           websocketConfig
+	Events              eventsConfig
+	// the failures are answered as JSON-RPC errors with 200, instead of the HTTP errors
+	JSONRPCErrors bool
 }
 
 type agentController struct {
@@ -34,11 +40,17 @@ type agentController struct {
 	agentService    service.AgentService
 	tenantService   service.TenantService
 	endpointService service.EndpointService
-	config          agentControllerConfig
+	// eth_subscribe of the WebSocket connections
+	subscriptionService service.SubscriptionService
+	// Server-Sent Events of the chains
+	eventService service.EventService
+	config       agentControllerConfig
 }
 
 type AgentController interface {
 	HandleCall(ctx *fasthttp.RequestCtx)
+	HandleWebSocket(ctx *fasthttp.RequestCtx)
+	HandleEvents(ctx *fasthttp.RequestCtx)
 }
 
 func NewAgentController(
@@ -48,18 +60,35 @@ func NewAgentController(
 	agentService service.AgentService,
 	tenantService service.TenantService,
 	endpointService service.EndpointService,
+	subscriptionService service.SubscriptionService,
+	eventService service.EventService,
 ) AgentController {
 	controller := &agentController{
-		conf:            conf,
-		amqp:            amqp,
-		logger:          logger.With().Str("name", "agent_controller").Logger(),
-		agentService:    agentService,
-		tenantService:   tenantService,
-		endpointService: endpointService,
+		conf:                conf,
+		amqp:                amqp,
+		logger:              logger.With().Str("name", "agent_controller").Logger(),
+		agentService:        agentService,
+		tenantService:       tenantService,
+		endpointService:     endpointService,
+		subscriptionService: subscriptionService,
+		eventService:        eventService,
 		config: agentControllerConfig{
 			AppName:             conf.String("app.name", "Web3 RPC Proxy"),
 			EnableTenantFeature: conf.Bool("tenant.enable", false),
 			AmqpExchange:        conf.String("amqp.exchange", "web3rpcproxy.query.topic"),
+			WebSocket: websocketConfig{
+				MaxSubscriptions: conf.Int("websocket.max_subscriptions", 32),
+				Concurrency:      conf.Int("websocket.concurrency", 16),
+				ReadLimit:        int64(conf.Int("websocket.read_limit", 1024*1024)),
+				PingInterval:     conf.Duration("websocket.ping_interval", 30*time.Second),
+				WriteTimeout:     conf.Duration("websocket.write_timeout", 10*time.Second),
+			},
+			Events: eventsConfig{
+				Disable:     conf.Bool("events.disable", false),
+				Keepalive:   max(conf.Duration("events.keepalive", 15*time.Second), time.Second),
+				MaxDuration: max(conf.Duration("events.max_duration", 10*time.Minute), time.Second),
+			},
+			JSONRPCErrors: conf.String("jsonrpc.errors", "jsonrpc") != "http",
 		},
 	}
 
@@ -91,20 +120,27 @@ func (a *agentController) HandleCall(ctx *fasthttp.RequestCtx) {
 		rc.Logger().Warn().Msgf("Unsupport chain: %s", fmt.Sprint(ctx.UserValue("chain")))
 		err := common.NotFoundError("Unsupported")
 
-		status = err.QueryStatus()
-		statusCode = err.StatusCode()
-		body = err.Body()
+		status, statusCode, body = a.fail(rc, err)
 	} else {
 		data, err := a.call(rc, endpoints)
 
 		if err != nil {
-			status = err.QueryStatus()
-			statusCode = err.StatusCode()
-			body = err.Body()
+			status, statusCode, body = a.fail(rc, err)
 		} else {
 			statusCode = http.StatusOK
 			status = common.Success
 			body = data
+
+			// a call of notifications only has no answer
+			if len(data) == 0 {
+				statusCode = http.StatusNoContent
+			}
+
+			if len(rc.Profile().Intercepts) > 0 {
+				status = common.Intercept
+			} else if len(rc.Profile().Errors) > 0 {
+				status = common.Fail
+			}
 		}
 	}
 
@@ -122,6 +158,53 @@ func (a *agentController) HandleCall(ctx *fasthttp.RequestCtx) {
 		}
 	}()
 
+	a.record(rc, status, statusCode)
+}
+
+// fail answers the error of the call, as the JSON-RPC errors of the calls of the body in the JSON-RPC mode
+func (a agentController) fail(rc reqctx.Reqctxs, err common.HTTPErrors) (common.QueryStatus, int, []byte) {
+	if !a.config.JSONRPCErrors {
+		return err.QueryStatus(), err.StatusCode(), err.Body()
+	}
+
+	body := _JSONRPCErrorBody(*rc.Body(), common.JSONRPCErrorOf(err))
+	if len(body) == 0 {
+		return err.QueryStatus(), http.StatusNoContent, body
+	}
+	return err.QueryStatus(), http.StatusOK, body
+}
+
+// _JSONRPCErrorBody answers the error for each call of the body which is answered, the notifications are not,
+// a body which cannot be parsed is answered by the error of the null id
+func _JSONRPCErrorBody(body []byte, err common.JSONRPCError) []byte {
+	jsonrpcs, isBatchCall, _err := rpc.UnmarshalJSONRPCs(body)
+	if _err != nil || len(jsonrpcs) == 0 {
+		b, _ := rpc.MarshalJSONRPCResults(rpc.SealedJSONRPCResult{Version: rpc.JSONRPC_VERSION_2, Error: err})
+		return b
+	}
+
+	results := []rpc.SealedJSONRPCResult{}
+	for _, jsonrpc := range jsonrpcs {
+		if _err := rpc.ValidateJSONRPC(jsonrpc); _err != nil {
+			results = append(results, jsonrpc.MakeResult(nil, common.NewJSONRPCError(common.JSONRPCInvalidRequest, "Invalid Request", _err.Error())))
+		} else if jsonrpc.Type() != rpc.JSONRPC_NOTIFY {
+			results = append(results, jsonrpc.MakeResult(nil, err))
+		}
+	}
+	if len(results) == 0 {
+		return []byte{}
+	}
+	if !isBatchCall {
+		b, _ := rpc.MarshalJSONRPCResults(results[0])
+		return b
+	}
+	b, _ := rpc.MarshalJSONRPCResults(results)
+	return b
+}
+
+// record completes the profile of the request, and accounts it to the tenant and the metrics
+func (a agentController) record(rc reqctx.Reqctxs, status common.QueryStatus, statusCode int) {
+	chainId := rc.ChainID()
 	app, p := rc.App(), rc.Profile()
 	p.Status = status
 	p.Endtime = time.Now().UnixMilli()
@@ -144,23 +227,15 @@ func (a *agentController) HandleCall(ctx *fasthttp.RequestCtx) {
 	}
 	utils.TotalRequests.WithLabelValues(fmt.Sprint(chainId), appName, string(status)).Inc()
 	utils.RequestDurations.WithLabelValues(fmt.Sprint(chainId), appName).Observe(float64(p.Endtime-p.Starttime) / 1000.0)
-	rc.Logger().Info().Any("status", status).TimeDiff("ms", time.UnixMilli(p.Endtime), time.UnixMilli(p.Starttime)).Msgf("%s %s %d", ctx.Method(), ctx.RequestURI(), statusCode)
+	rc.Logger().Info().Any("status", status).TimeDiff("ms", time.UnixMilli(p.Endtime), time.UnixMilli(p.Starttime)).Msgf("%s %s %d", p.Method, p.Href, statusCode)
 }
 
 func (a agentController) call(rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint) ([]byte, common.HTTPErrors) {
 	ctx, cancel := context.WithTimeoutCause(rc, rc.Options().Timeout(), common.TimeoutError("Request timed out"))
 	defer cancel()
 
-	if a.config.EnableTenantFeature && rc.App() == nil {
-		app, err := a.getTenantApp(ctx, rc)
-		if common.IsHTTPErrors(err) {
-			rc.Logger().Error().Str(zerolog.ErrorFieldName, err.(common.HTTPErrors).String()).Send()
-			return nil, err.(common.HTTPErrors)
-		} else if err != nil {
-			rc.Logger().Error().Err(err).Send()
-			return nil, common.InternalServerError("", err)
-		}
-		rc.SetApp(app)
+	if err := a.authorize(ctx, rc); err != nil {
+		return nil, err
 	}
 
 	data, err := a.agentService.Call(ctx, rc, endpoints)
@@ -176,6 +251,27 @@ func (a agentController) call(rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint)
 	return data, nil
 }
 
+// authorize resolves the tenant app of the request, and checks the chain is allowed to it
+func (a agentController) authorize(ctx context.Context, rc reqctx.Reqctxs) common.HTTPErrors {
+	if a.config.EnableTenantFeature && rc.App() == nil {
+		app, err := a.getTenantApp(ctx, rc)
+		if common.IsHTTPErrors(err) {
+			rc.Logger().Error().Str(zerolog.ErrorFieldName, err.(common.HTTPErrors).String()).Send()
+			return err.(common.HTTPErrors)
+		} else if err != nil {
+			rc.Logger().Error().Err(err).Send()
+			return common.InternalServerError("", err)
+		}
+		rc.SetApp(app)
+	}
+
+	if allows := rc.Options().AllowChainIDs(); allows != nil && !rpc.MatchAny(allows, strconv.FormatUint(rc.ChainID(), 10), strings.ToLower(rc.ChainCode())) {
+		rc.Logger().Warn().Msg("Chain is not allowed by the tenant")
+		return common.InterceptError("Chain is not allowed")
+	}
+	return nil
+}
+
 func (a agentController) getTenantApp(ctx context.Context, reqctx reqctx.Reqctxs) (*common.App, error) {
 	token := reqctx.AppKey()
 	if len(token) <= 0 {
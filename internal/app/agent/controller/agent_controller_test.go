@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+)
+
+func TestJSONRPCErrorBody(t *testing.T) {
+	err := common.JSONRPCErrorOf(common.TooManyRequestsError("Token is overage"))
+
+	cases := []struct {
+		name   string
+		body   string
+		expect string
+	}{
+		{
+			"single",
+			`{"jsonrpc":"2.0","id":7,"method":"eth_blockNumber"}`,
+			`{"id":7,"error":{"code":-32005,"message":"Token is overage"},"jsonrpc":"2.0"}`,
+		},
+		{
+			"batch",
+			`[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},{"jsonrpc":"2.0","method":"eth_chainId"},{"jsonrpc":"2.0","id":"a","method":"eth_chainId"}]`,
+			`[{"id":1,"error":{"code":-32005,"message":"Token is overage"},"jsonrpc":"2.0"},{"id":"a","error":{"code":-32005,"message":"Token is overage"},"jsonrpc":"2.0"}]`,
+		},
+		{
+			"notifications only",
+			`[{"jsonrpc":"2.0","method":"eth_blockNumber"},{"jsonrpc":"2.0","method":"eth_chainId"}]`,
+			``,
+		},
+		{
+			"single notification",
+			`{"jsonrpc":"2.0","method":"eth_blockNumber"}`,
+			``,
+		},
+		{
+			"unparseable",
+			`{bad`,
+			`{"id":null,"error":{"code":-32005,"message":"Token is overage"},"jsonrpc":"2.0"}`,
+		},
+		{
+			"empty batch",
+			`[]`,
+			`{"id":null,"error":{"code":-32005,"message":"Token is overage"},"jsonrpc":"2.0"}`,
+		},
+	}
+
+	for _, c := range cases {
+		if got := string(_JSONRPCErrorBody([]byte(c.body), err)); got != c.expect {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expect, got)
+		}
+	}
+
+	// the invalid calls of a batch are answered as such
+	got := string(_JSONRPCErrorBody([]byte(`[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},{"jsonrpc":"2.0","id":2}]`), err))
+	if expect := `"code":-32600`; !strings.Contains(got, expect) || !strings.Contains(got, `"code":-32005`) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
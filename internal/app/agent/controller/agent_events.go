@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/app/agent/service"
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/valyala/fasthttp"
+)
+
+type eventsConfig struct {
+	Disable bool
+	// comments are sent at the interval to keep the idle streams open
+	Keepalive time.Duration
+	// streams are ended after this, the clients reconnect with the last event id
+	MaxDuration time.Duration
+}
+
+// HandleEvents streams the heads, the reorgs and the health changes of the endpoints of the chain as Server-Sent Events,
+// a client reconnecting with the Last-Event-ID receives the buffered events it has missed
+func (a *agentController) HandleEvents(ctx *fasthttp.RequestCtx) {
+	if a.config.Events.Disable {
+		a.reply(ctx, common.NotFoundError("Not Found"))
+		return
+	}
+
+	rc := a.getRequestContext(ctx)
+	chainId := rc.ChainID()
+	if endpoints, ok := a.endpointService.GetAll(chainId); !ok || len(endpoints) <= 0 {
+		rc.Logger().Warn().Msgf("Unsupport chain: %s", fmt.Sprint(ctx.UserValue("chain")))
+		a.reply(ctx, common.NotFoundError("Unsupported"))
+		return
+	}
+
+	_ctx, cancel := context.WithTimeoutCause(rc, rc.Options().Timeout(), common.TimeoutError("Request timed out"))
+	err := a.authorize(_ctx, rc)
+	cancel()
+	if err != nil {
+		a.reply(ctx, err)
+		return
+	}
+
+	// the query arg is for the clients which cannot set the header on a reconnection
+	lastId, _ := strconv.ParseUint(string(ctx.Request.Header.Peek("Last-Event-ID")), 10, 64)
+	if v := ctx.QueryArgs().Peek("last_event_id"); len(v) > 0 {
+		lastId, _ = strconv.ParseUint(string(v), 10, 64)
+	}
+	missed, events, stop := a.eventService.Listen(chainId, lastId)
+
+	ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	ctx.Response.Header.Set("X-Accel-Buffering", "no")
+	ctx.Response.Header.Set("Server", a.config.AppName)
+	ctx.Response.Header.SetContentType("text/event-stream; charset=utf-8")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer stop()
+
+		keepalive := time.NewTicker(a.config.Events.Keepalive)
+		defer keepalive.Stop()
+		deadline := time.NewTimer(a.config.Events.MaxDuration)
+		defer deadline.Stop()
+
+		fmt.Fprintf(w, "retry: %d\n\n", 3000)
+		for _, event := range missed {
+			_WriteEvent(w, event)
+		}
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case event, ok := <-events:
+				// the client has fallen behind, it resumes by the last event id
+				if !ok {
+					return
+				}
+				_WriteEvent(w, event)
+			case <-keepalive.C:
+				w.WriteString(": keepalive\n\n")
+			case <-deadline.C:
+				return
+			}
+		}
+	})
+}
+
+func _WriteEvent(w *bufio.Writer, event service.Event) {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
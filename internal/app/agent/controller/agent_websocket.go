@@ -0,0 +1,359 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/app/agent/service"
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/reqctx"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
+)
+
+type websocketConfig struct {
+	// subscriptions of a connection
+	MaxSubscriptions int
+	// calls of a connection handled at once, the reading waits for them
+	Concurrency  int
+	ReadLimit    int64
+	PingInterval time.Duration
+	// a write to the client not done within this closes the connection
+	WriteTimeout time.Duration
+}
+
+var upgrader = websocket.FastHTTPUpgrader{
+	// the calls are authenticated by the api key, not by the cookies of the origin
+	CheckOrigin: func(ctx *fasthttp.RequestCtx) bool { return true },
+}
+
+// wsSession is a client connection, the calls of its messages are handled like the HTTP calls,
+// the subscriptions are served by the shared feeds of the subscription service
+type wsSession struct {
+	a       *agentController
+	conn    *websocket.Conn
+	chainId common.ChainId
+	// request of the upgrade, each message is handled as a copy of it with the message as the body
+	request *fasthttp.Request
+	remote  net.Addr
+	values  map[string]any
+
+	out  chan []byte
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu   sync.Mutex
+	subs map[string]*service.Subscription
+}
+
+// HandleWebSocket upgrades the calls of the chain to a WebSocket connection, which supports eth_subscribe
+func (a *agentController) HandleWebSocket(ctx *fasthttp.RequestCtx) {
+	if !websocket.FastHTTPIsWebSocketUpgrade(ctx) {
+		a.reply(ctx, common.BadRequestError("WebSocket upgrade is required"))
+		return
+	}
+
+	rc := a.getRequestContext(ctx)
+	chainId := rc.ChainID()
+	if endpoints, ok := a.endpointService.GetAll(chainId); !ok || len(endpoints) <= 0 {
+		rc.Logger().Warn().Msgf("Unsupport chain: %s", fmt.Sprint(ctx.UserValue("chain")))
+		a.reply(ctx, common.NotFoundError("Unsupported"))
+		return
+	}
+
+	// rejected before the upgrade, the calls of the messages are authenticated again one by one
+	_ctx, cancel := context.WithTimeoutCause(rc, rc.Options().Timeout(), common.TimeoutError("Request timed out"))
+	err := a.authorize(_ctx, rc)
+	cancel()
+	if err != nil {
+		a.reply(ctx, err)
+		return
+	}
+
+	session := &wsSession{
+		a:       a,
+		chainId: chainId,
+		request: &fasthttp.Request{},
+		remote:  ctx.RemoteAddr(),
+		values:  map[string]any{},
+		out:     make(chan []byte, 16),
+		done:    make(chan struct{}),
+		subs:    map[string]*service.Subscription{},
+	}
+	ctx.Request.CopyTo(session.request)
+	// each message is a request of its own
+	session.request.Header.Del("x-req-id")
+	session.request.Header.Del("x-request-id")
+	for _, key := range []string{"chain", "apikey"} {
+		if v := ctx.UserValue(key); v != nil {
+			session.values[key] = v
+		}
+	}
+
+	if err := upgrader.Upgrade(ctx, func(conn *websocket.Conn) {
+		session.conn = conn
+		session.serve()
+	}); err != nil {
+		rc.Logger().Warn().Err(err).Msg("Failed to upgrade to WebSocket")
+	}
+}
+
+func (a *agentController) reply(ctx *fasthttp.RequestCtx, err common.HTTPErrors) {
+	ctx.Response.Header.Set("Server", a.config.AppName)
+	ctx.Response.Header.SetContentType("application/json; charset=utf-8")
+	ctx.SetStatusCode(err.StatusCode())
+	ctx.SetBody(err.Body())
+}
+
+func (s *wsSession) serve() {
+	defer s.close()
+
+	s.conn.SetReadLimit(s.a.config.WebSocket.ReadLimit)
+	s.conn.SetReadDeadline(time.Now().Add(2 * s.a.config.WebSocket.PingInterval))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(2 * s.a.config.WebSocket.PingInterval))
+	})
+	go s.write()
+
+	sem := make(chan struct{}, max(s.a.config.WebSocket.Concurrency, 1))
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(2 * s.a.config.WebSocket.PingInterval))
+
+		sem <- struct{}{}
+		s.wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				s.wg.Done()
+				if err := recover(); err != nil {
+					s.a.logger.Error().Interface("error", err).Msg("Failed to handle a WebSocket message")
+				}
+			}()
+			if b := s.handle(data); len(b) > 0 {
+				s.send(b)
+			}
+		}()
+	}
+}
+
+// write sends the responses and the notifications, and pings the client
+func (s *wsSession) write() {
+	ticker := time.NewTicker(s.a.config.WebSocket.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case b := <-s.out:
+			// a stalled client fails the write instead of pinning the writer
+			s.conn.SetWriteDeadline(time.Now().Add(s.a.config.WebSocket.WriteTimeout))
+			if err := s.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				s.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.a.config.WebSocket.WriteTimeout)); err != nil {
+				s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *wsSession) send(b []byte) {
+	select {
+	case s.out <- b:
+	case <-s.done:
+	}
+}
+
+func (s *wsSession) close() {
+	s.mu.Lock()
+	for id := range s.subs {
+		s.a.subscriptionService.Unsubscribe(id)
+	}
+	s.subs = map[string]*service.Subscription{}
+	s.mu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+	s.conn.Close()
+}
+
+// handle answers the message, the subscription methods are answered by the session, the others are called like HTTP calls
+func (s *wsSession) handle(data []byte) []byte {
+	jsonrpcs, isBatchCall, err := rpc.UnmarshalJSONRPCs(data)
+	if err != nil {
+		return s.error(nil, common.NewJSONRPCError(common.JSONRPCParseError, "Parse error"))
+	}
+
+	subscribing := false
+	for i := range jsonrpcs {
+		subscribing = subscribing || _IsSubscriptionMethod(jsonrpcs[i].Method())
+	}
+	if !subscribing {
+		// the notifications are not answered, even by errors
+		if !isBatchCall && jsonrpcs[0].Type() == rpc.JSONRPC_NOTIFY {
+			s.call(data)
+			return nil
+		}
+		return s.call(data)
+	}
+	if !isBatchCall {
+		return s.subscription(jsonrpcs[0])
+	}
+
+	// the items of a batch with subscription methods are answered one by one
+	items := make([][]byte, 0, len(jsonrpcs))
+	for i := range jsonrpcs {
+		var b []byte
+		if _IsSubscriptionMethod(jsonrpcs[i].Method()) {
+			b = s.subscription(jsonrpcs[i])
+		} else if item, err := json.Marshal(jsonrpcs[i].Raw()); err == nil {
+			b = s.call(item)
+		}
+		if len(b) > 0 {
+			items = append(items, b)
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	return append(append([]byte{'['}, bytes.Join(items, []byte{','})...), ']')
+}
+
+// call handles the body like the body of an HTTP call, the errors are answered in the slots of the calls like by HTTP
+func (s *wsSession) call(body []byte) []byte {
+	rc := s.reqctx(body)
+
+	endpoints, ok := s.a.endpointService.GetAll(s.chainId)
+	if !ok || len(endpoints) <= 0 {
+		return _JSONRPCErrorBody(body, common.JSONRPCErrorOf(common.NotFoundError("Unsupported")))
+	}
+
+	data, err := s.a.call(rc, endpoints)
+	if err != nil {
+		s.a.record(rc, err.QueryStatus(), err.StatusCode())
+		return _JSONRPCErrorBody(body, common.JSONRPCErrorOf(err))
+	}
+
+	status := common.Success
+	if len(rc.Profile().Intercepts) > 0 {
+		status = common.Intercept
+	} else if len(rc.Profile().Errors) > 0 {
+		status = common.Fail
+	}
+	s.a.record(rc, status, http.StatusOK)
+	return data
+}
+
+// subscription handles eth_subscribe and eth_unsubscribe
+func (s *wsSession) subscription(jsonrpc rpc.JSONRPCer) []byte {
+	id := jsonrpc.MakeResult(nil, nil).ID
+
+	switch jsonrpc.Method() {
+	case "eth_subscribe":
+		rc := s.reqctx(nil)
+		ctx, cancel := context.WithTimeoutCause(rc, rc.Options().Timeout(), common.TimeoutError("Request timed out"))
+		err := s.a.authorize(ctx, rc)
+		cancel()
+		if err != nil {
+			s.a.record(rc, err.QueryStatus(), err.StatusCode())
+			return s.error(id, common.JSONRPCErrorOf(err))
+		}
+		// the subscriptions follow the same method, firewall and contract address policies as the calls
+		if _err := s.a.agentService.Intercept(rc, jsonrpc); _err != nil {
+			rc.Logger().Warn().Err(_err).Msgf("Intercepted %s", jsonrpc.Method())
+			p := rc.Profile()
+			p.Intercepts = append(p.Intercepts, jsonrpc.Method())
+			s.a.record(rc, common.Intercept, http.StatusOK)
+			var rpcErr common.JSONRPCError
+			if !errors.As(_err, &rpcErr) {
+				rpcErr = common.NewJSONRPCError(common.JSONRPCIntercepted, _err.Error())
+			}
+			return s.error(id, rpcErr)
+		}
+		s.a.record(rc, common.Success, http.StatusOK)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.subs) >= s.a.config.WebSocket.MaxSubscriptions {
+			return s.error(id, common.NewJSONRPCError(common.JSONRPCLimitExceeded, "Too many subscriptions"))
+		}
+		sub, _err := s.a.subscriptionService.Subscribe(s.chainId, jsonrpc.Params())
+		if _err != nil {
+			code := common.JSONRPCServerError
+			if errors.Is(_err, service.ErrSubscriptionParams) || errors.Is(_err, service.ErrSubscriptionUnsupported) {
+				code = common.JSONRPCInvalidParams
+			}
+			return s.error(id, common.NewJSONRPCError(code, _err.Error()))
+		}
+		s.subs[sub.ID] = sub
+		go s.forward(sub)
+		return s.result(id, sub.ID)
+	default:
+		params := jsonrpc.Params()
+		if len(params) != 1 {
+			return s.error(id, common.NewJSONRPCError(common.JSONRPCInvalidParams, "Invalid params"))
+		}
+		subId, _ := params[0].(string)
+		s.mu.Lock()
+		_, ok := s.subs[subId]
+		delete(s.subs, subId)
+		s.mu.Unlock()
+		return s.result(id, ok && s.a.subscriptionService.Unsubscribe(subId))
+	}
+}
+
+// forward sends the notifications of the subscription until it is unsubscribed
+func (s *wsSession) forward(sub *service.Subscription) {
+	for result := range sub.C {
+		b, err := json.Marshal(map[string]any{
+			"jsonrpc": rpc.JSONRPC_VERSION_2,
+			"method":  "eth_subscription",
+			"params":  map[string]any{"subscription": sub.ID, "result": result},
+		})
+		if err != nil {
+			continue
+		}
+		s.send(b)
+	}
+}
+
+// reqctx makes the request context of a message
+func (s *wsSession) reqctx(body []byte) reqctx.Reqctxs {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(s.request, s.remote, nil)
+	ctx.Request.SetBody(body)
+	for key, v := range s.values {
+		ctx.SetUserValue(key, v)
+	}
+	return s.a.getRequestContext(ctx)
+}
+
+func (s *wsSession) result(id any, v any) []byte {
+	b, _ := rpc.MarshalJSONRPCResults(rpc.SealedJSONRPCResult{ID: id, Version: rpc.JSONRPC_VERSION_2, Result: v})
+	return b
+}
+
+func (s *wsSession) error(id any, err common.JSONRPCError) []byte {
+	b, _ := rpc.MarshalJSONRPCResults(rpc.SealedJSONRPCResult{ID: id, Version: rpc.JSONRPC_VERSION_2, Error: err})
+	return b
+}
+
+func _IsSubscriptionMethod(method string) bool {
+	return method == "eth_subscribe" || method == "eth_unsubscribe"
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/core/endpoint"
+	"github.com/GoPlugin/web3rpcproxy/utils/config"
+	"github.com/knadh/koanf/v2"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+// noEndpoints is an endpoint service without the endpoints of any chain
+type noEndpoints struct{}
+
+func (noEndpoints) Init()            {}
+func (noEndpoints) Chains() []uint64 { return nil }
+func (noEndpoints) GetAll(chain uint64) ([]*endpoint.Endpoint, bool) {
+	return nil, false
+}
+func (noEndpoints) Purge() {}
+
+func TestWebSocketCallErrors(t *testing.T) {
+	s := &wsSession{
+		a: &agentController{
+			logger:          zerolog.Nop(),
+			conf:            &config.Conf{Koanf: koanf.New(".")},
+			endpointService: noEndpoints{},
+		},
+		chainId: 1,
+		request: &fasthttp.Request{},
+		values:  map[string]any{"chain": "1"},
+	}
+
+	cases := []struct {
+		name   string
+		body   string
+		expect string
+	}{
+		{
+			"single",
+			`{"jsonrpc":"2.0","id":7,"method":"eth_blockNumber"}`,
+			`{"id":7,"error":{"code":-32015,"message":"Unsupported"},"jsonrpc":"2.0"}`,
+		},
+		{
+			// the same shape as the HTTP answer of the batch
+			"batch",
+			`[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},{"jsonrpc":"2.0","method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`,
+			`[{"id":1,"error":{"code":-32015,"message":"Unsupported"},"jsonrpc":"2.0"},{"id":2,"error":{"code":-32015,"message":"Unsupported"},"jsonrpc":"2.0"}]`,
+		},
+		{
+			"notification",
+			`{"jsonrpc":"2.0","method":"eth_blockNumber"}`,
+			``,
+		},
+	}
+
+	for _, c := range cases {
+		if got := string(s.handle([]byte(c.body))); got != c.expect {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/app/agent/service"
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/utils/config"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+type cacheControllerConfig struct {
+	// bearer token of the admin API, the API is disabled if empty
+	Token string
+}
+
+type cacheController struct {
+	logger       zerolog.Logger
+	conf         *config.Conf
+	agentService service.AgentService
+	config       cacheControllerConfig
+}
+
+type CacheController interface {
+	HandleStats(ctx *fasthttp.RequestCtx)
+	HandleEntry(ctx *fasthttp.RequestCtx)
+	HandleKeys(ctx *fasthttp.RequestCtx)
+	HandlePurge(ctx *fasthttp.RequestCtx)
+}
+
+func NewCacheController(
+	logger zerolog.Logger,
+	conf *config.Conf,
+	agentService service.AgentService,
+) CacheController {
+	return &cacheController{
+		logger:       logger.With().Str("name", "cache_controller").Logger(),
+		conf:         conf,
+		agentService: agentService,
+		config: cacheControllerConfig{
+			Token: conf.String("admin.token", ""),
+		},
+	}
+}
+
+// HandleStats answers the statistics of the cache tiers and the lookups by chain and method
+func (c *cacheController) HandleStats(ctx *fasthttp.RequestCtx) {
+	if !c.authorize(ctx) {
+		return
+	}
+	c.success(ctx, c.agentService.CacheStats())
+}
+
+// HandleEntry answers the cached result of the key, or deletes it
+func (c *cacheController) HandleEntry(ctx *fasthttp.RequestCtx) {
+	if !c.authorize(ctx) {
+		return
+	}
+
+	key := fmt.Sprint(ctx.UserValue("key"))
+	if ctx.IsDelete() {
+		purged, err := c.agentService.PurgeCache(ctx, service.CachePurge{Key: key})
+		if err != nil {
+			c.error(ctx, common.InternalServerError(err.Error(), err))
+			return
+		}
+		c.success(ctx, purged)
+		return
+	}
+
+	entry, ok := c.agentService.LookupCache(ctx, key)
+	if !ok {
+		c.error(ctx, common.NotFoundError("Not cached"))
+		return
+	}
+	c.success(ctx, entry)
+}
+
+// HandleKeys answers the cache keys and the cached results of the JSON-RPC calls of the body
+func (c *cacheController) HandleKeys(ctx *fasthttp.RequestCtx) {
+	if !c.authorize(ctx) {
+		return
+	}
+
+	chainId, ok := c.chainID(fmt.Sprint(ctx.UserValue("chain")))
+	if !ok {
+		c.error(ctx, common.NotFoundError("Unsupported"))
+		return
+	}
+	keys, err := c.agentService.CacheKeys(chainId, ctx.PostBody())
+	if err != nil {
+		c.error(ctx, err)
+		return
+	}
+
+	entries := make([]any, len(keys))
+	for i, key := range keys {
+		if entry, ok := c.agentService.LookupCache(ctx, key); ok {
+			entries[i] = entry
+		} else {
+			entries[i] = service.CacheEntry{Key: key}
+		}
+	}
+	c.success(ctx, entries)
+}
+
+// HandlePurge deletes the cached results of a chain, a method or a block range
+func (c *cacheController) HandlePurge(ctx *fasthttp.RequestCtx) {
+	if !c.authorize(ctx) {
+		return
+	}
+
+	var body struct {
+		service.CachePurge
+		Chain string `json:"chain"`
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &body); err != nil {
+		c.error(ctx, common.BadRequestError(err.Error(), err))
+		return
+	}
+	purge := body.CachePurge
+	if body.Chain != "" {
+		chainId, ok := c.chainID(body.Chain)
+		if !ok {
+			c.error(ctx, common.NotFoundError("Unsupported"))
+			return
+		}
+		purge.ChainID = chainId
+	}
+
+	purged, err := c.agentService.PurgeCache(ctx, purge)
+	if err != nil {
+		c.error(ctx, err)
+		return
+	}
+	c.logger.Info().Msgf("Purged %d cached results by %s, broadcast %v", purged.Purged, ctx.RemoteIP(), purged.Broadcast)
+	c.success(ctx, purged)
+}
+
+// authorize checks the bearer token of the admin API, the response is written if not authorized
+func (c *cacheController) authorize(ctx *fasthttp.RequestCtx) bool {
+	if c.config.Token == "" {
+		c.error(ctx, common.NotFoundError("Not found"))
+		return false
+	}
+	token, _ := strings.CutPrefix(string(ctx.Request.Header.Peek("Authorization")), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.config.Token)) != 1 {
+		c.error(ctx, common.ForbiddenError("Token is invalid"))
+		return false
+	}
+	return true
+}
+
+// chainID resolves the chain by its code or id
+func (c *cacheController) chainID(chain string) (common.ChainId, bool) {
+	if v, ok := c.conf.Get("chains." + chain).(common.EndpointChain); ok {
+		return v.ChainID, true
+	}
+	if v, err := strconv.ParseUint(chain, 10, 64); err == nil {
+		return v, true
+	}
+	return 0, false
+}
+
+func (c *cacheController) success(ctx *fasthttp.RequestCtx, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		c.error(ctx, common.InternalServerError(err.Error(), err))
+		return
+	}
+	ctx.Response.Header.SetContentType("application/json; charset=utf-8")
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBody(body)
+}
+
+func (c *cacheController) error(ctx *fasthttp.RequestCtx, err error) {
+	e, ok := err.(common.HTTPErrors)
+	if !ok {
+		e = common.InternalServerError(err.Error(), err)
+	}
+	ctx.Response.Header.SetContentType("application/json; charset=utf-8")
+	ctx.SetStatusCode(e.StatusCode())
+	ctx.SetBody(e.Body())
+}
@@ -5,42 +5,76 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/GoPlugin/web3rpcproxy/internal/app/shared"
 	"github.com/GoPlugin/web3rpcproxy/internal/common"
 	"github.com/GoPlugin/web3rpcproxy/internal/core"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/cache"
 	"github.com/GoPlugin/web3rpcproxy/internal/core/endpoint"
 	"github.com/GoPlugin/web3rpcproxy/internal/core/reqctx"
 	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/tx"
 	"github.com/GoPlugin/web3rpcproxy/utils"
 	"github.com/GoPlugin/web3rpcproxy/utils/config"
 	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
 	"github.com/allegro/bigcache"
-	"github.com/duke-git/lancet/v2/slice"
 	"github.com/rs/zerolog"
 )
 
-type CacheEntry struct {
-	V          any
-	T          int64
-	compressed bool
-}
 type agentServiceConfig struct {
-	CacheMethods      map[string]string
-	MaxEntryCacheSize int
-	DisableCache      bool
+	CacheMethods       map[string]string
+	NegativeMethods    map[string]string // expiry of the null results, until the head passes the block
+	MaxEntryCacheSize  int
+	DisableCache       bool
+	DisableSubmissions bool
+	DisableFirewall    bool
+	DisableCoalescing  bool
+	CoalescingMethods  []string
+	EnableRedisCache   bool
+	CacheBackend       string
+	DisableFinality    bool
+	// latest is rewritten to the known tip number, lagged by the blocks
+	EnablePinning bool
+	PinningLag    uint64
+	// expiry of the results of finalized blocks, they never change
+	FinalizedExpiry time.Duration
+	// the upper limit of the expiry of the results of unfinalized blocks
+	UnfinalizedExpiry time.Duration
+	// the failures of the calls are answered as JSON-RPC errors in their slots, instead of failing the whole request
+	JSONRPCErrors bool
+	// the errors of the endpoints are answered in the shape of their canonical types
+	RewriteErrors bool
 }
 
 // AgentService
 type agentService struct {
-	logger     zerolog.Logger
-	client     core.Client
-	es         endpoint.Selector
-	jrpcSchema *rpc.JSONRPCSchema
-	cache      *bigcache.BigCache
-	config     *agentServiceConfig
+	logger      zerolog.Logger
+	client      core.Client
+	es          endpoint.Selector
+	jrpcSchema  *rpc.JSONRPCSchema
+	cache       cache.ResultCache
+	l2          cache.ResultCache // the second cache tier, nil if disabled
+	index       *cache.Index
+	negatives   *cache.Index // null results by the block the head has to pass
+	ranges      *cache.Index // all cached results by the blocks they depend on, for the purges
+	stats       *cacheStats
+	heads       HeadService
+	submissions *submissions
+	purges      *purges
+	flights     *cache.Flights
+	logs        logsConfig
+	snapshot    snapshotConfig
+	prefetcher  *prefetcher
+	endpoints   EndpointService
+	ecf         *endpoint.ClientFactory
+	firewall    *rpc.Firewall
+	normalizer  *rpc.ErrorNormalizer
+	config      *agentServiceConfig
 }
 
 // define interface of IAgentService
@@ -48,6 +82,16 @@ type agentService struct {
 //go:generate mockgen -destination=agent_service_mock.go -package=service . AgentService
 type AgentService interface {
 	Call(ctx context.Context, reqctx reqctx.Reqctxs, endpoints []*endpoint.Endpoint) ([]byte, error)
+	CacheStats() CacheStats
+	CacheKeys(chainId common.ChainId, body []byte) ([]string, error)
+	LookupCache(ctx context.Context, key string) (CacheEntry, bool)
+	PurgeCache(ctx context.Context, purge CachePurge) (CachePurged, error)
+	// FollowPurges applies the purges of the other nodes until the context is done
+	FollowPurges(ctx context.Context)
+	SaveCacheSnapshot() (int, error)
+	LoadCacheSnapshot() (int, error)
+	// Intercept checks a call which is not made by Call against the tenant preferences and the firewall, e.g. eth_subscribe
+	Intercept(rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer) error
 }
 
 func nearestPowerOfTwo(n uint) uint {
@@ -73,13 +117,29 @@ func NewAgentService(
 	jrpcSchema *rpc.JSONRPCSchema,
 	client core.Client,
 	endpointService EndpointService,
+	ecf *endpoint.ClientFactory,
+	redis *shared.RedisClient,
+	heads HeadService,
+	normalizer *rpc.ErrorNormalizer,
 ) AgentService {
 	logger = logger.With().Str("name", "agent_service").Logger()
 
 	existExpiryConfig := config.Exists("cache.results.expiry_durations")
 	_config := &agentServiceConfig{
-		DisableCache:      config.Bool("cache.results.disable", false) || !existExpiryConfig,
-		MaxEntryCacheSize: 512 * 1024, // 512KB
+		DisableCache:       config.Bool("cache.results.disable", false) || !existExpiryConfig,
+		DisableSubmissions: config.Bool("cache.transactions.disable", false),
+		DisableFirewall:    config.Bool("firewall.disable", false),
+		DisableCoalescing:  config.Bool("cache.coalescing.disable", false),
+		CoalescingMethods:  config.Strings("cache.coalescing.methods", _CoalescingMethods),
+		EnableRedisCache:   config.Bool("cache.results.redis.enable", false),
+		DisableFinality:    config.Bool("cache.results.finality.disable", false),
+		EnablePinning:      config.Bool("cache.results.pinning.enable", false),
+		PinningLag:         uint64(config.Int("cache.results.pinning.lag", 0)),
+		FinalizedExpiry:    config.Duration("cache.results.finality.finalized_expiry_duration", 24*time.Hour),
+		UnfinalizedExpiry:  config.Duration("cache.results.finality.unfinalized_expiry_duration", 5*time.Second),
+		MaxEntryCacheSize:  512 * 1024, // 512KB
+		JSONRPCErrors:      config.String("jsonrpc.errors", "jsonrpc") != "http",
+		RewriteErrors:      config.Bool("errors.rewrite", false),
 	}
 
 	if existExpiryConfig {
@@ -87,209 +147,523 @@ func NewAgentService(
 		config.Unmarshal("cache.results.expiry_durations", &expiryConfig)
 		_config.CacheMethods = expiryConfig
 	}
+	if !config.Bool("cache.results.negative.disable", false) {
+		negativeConfig := map[string]string{}
+		config.Unmarshal("cache.results.negative.expiry_durations", &negativeConfig)
+		_config.NegativeMethods = negativeConfig
+	}
+
+	policies := map[string]rpc.Policy{}
+	config.Unmarshal("firewall.chains", &policies)
+	firewall := rpc.NewFirewall(rpc.Policy{
+		Deny:  config.Strings("firewall.deny", rpc.DefaultDenyMethods),
+		Allow: config.Strings("firewall.allow", []string{}),
+	}, policies)
+
+	redisConfig := cache.RedisConfig{
+		Prefix:          config.String("cache.results.redis.prefix", "web3rpcproxy:"),
+		Expiry:          config.Duration("cache.results.redis.expiry_duration", time.Hour),
+		Compression:     config.Bool("cache.results.redis.compression", true),
+		CompressionSize: config.Int("cache.results.redis.compression_size", 1024),
+		Timeout:         config.Duration("cache.results.redis.timeout", 100*time.Millisecond),
+		Cooldown:        config.Duration("cache.results.redis.cooldown", 30*time.Second),
+	}
+
+	logs := logsConfig{
+		Disable:     config.Bool("logs.disable", false),
+		ChunkSize:   uint64(max(config.Int("logs.chunk_size", 2000), 1)),
+		Concurrency: max(config.Int("logs.concurrency", 4), 1),
+		MaxChunks:   uint64(config.Int("logs.max_chunks", 100)),
+	}
+
+	snapshot := snapshotConfig{
+		Enable: config.Bool("cache.results.snapshot.enable", false),
+		Path:   config.String("cache.results.snapshot.path", "data/cache.snapshot"),
+		MinTTL: config.Duration("cache.results.snapshot.min_ttl", 10*time.Minute),
+	}
+
+	prefetch := prefetchConfig{
+		Enable:      config.Bool("prefetch.enable", false),
+		Methods:     config.Strings("prefetch.methods", _PrefetchMethods),
+		Chains:      map[string][]string{},
+		Concurrency: config.Int("prefetch.concurrency", 2),
+		MaxLoad:     int64(config.Int("prefetch.max_load", 32)),
+		Timeout:     config.Duration("prefetch.timeout", 5*time.Second),
+	}
+	config.Unmarshal("prefetch.chains", &prefetch.Chains)
+
+	backend := config.String("cache.results.backend", "memory")
+	_config.CacheBackend = backend
+	service := agentService{
+		config:      _config,
+		client:      client,
+		logger:      logger,
+		jrpcSchema:  jrpcSchema,
+		cache:       newResultCache(logger, config, backend, _config, len(endpointService.Chains()), redis, redisConfig),
+		es:          endpoint.NewSelector(),
+		firewall:    firewall,
+		normalizer:  normalizer,
+		flights:     cache.NewFlights(),
+		logs:        logs,
+		snapshot:    snapshot,
+		prefetcher:  newPrefetcher(prefetch),
+		endpoints:   endpointService,
+		ecf:         ecf,
+		index:       cache.NewIndex(),
+		negatives:   cache.NewIndex(),
+		ranges:      cache.NewIndex(),
+		stats:       &cacheStats{},
+		heads:       heads,
+		submissions: newSubmissions(logger, redis, config.Duration("cache.transactions.expiry_duration", 10*time.Minute)),
+		purges:      newPurges(logger, redis, redisConfig.Prefix),
+	}
+	if _config.EnableRedisCache && backend != "redis" {
+		service.l2 = cache.NewRedis(logger, redis, redisConfig)
+	}
 
+	// results of recent blocks are invalidated when the blocks are reorganized
+	depth := uint64(config.Int("heads.depth", 64))
+	heads.OnReorg(service.invalidate)
+	heads.OnHead(func(head Head) {
+		if head.Number > depth {
+			service.index.Prune(head.ChainID, head.Number-depth)
+		}
+		service.ranges.Prune(head.ChainID, 0)
+		for _, key := range service.negatives.Take(head.ChainID, 0, head.Number) {
+			service.cache.Delete(context.Background(), key)
+		}
+	})
+	if prefetch.Enable {
+		heads.OnHead(service.prefetch)
+	}
+
+	return service
+}
+
+// newResultCache creates the result cache of the backend, memory, bigcache or redis
+func newResultCache(
+	logger zerolog.Logger,
+	config *config.Conf,
+	backend string,
+	_config *agentServiceConfig,
+	chains int,
+	redis *shared.RedisClient,
+	redisConfig cache.RedisConfig,
+) cache.ResultCache {
 	// default cache size is 512MB
 	totalCacheSize := config.Int("cache.results.size", 512*1024*1024)
 
-	shards := int(nearestPowerOfTwo(uint(len(endpointService.Chains()))))
+	shards := int(nearestPowerOfTwo(uint(chains)))
 	// must have 8MB size pre shard
 	if totalCacheSize/shards < 8 {
 		shards = int(nearestPowerOfTwo(uint(totalCacheSize / 8)))
 	}
 
-	_cacheConfig := bigcache.Config{
-		// number of shards (must be a power of 2)
-		Shards: shards,
+	switch backend {
+	case "redis":
+		logger.Info().Msg("Cache backend: redis")
+		return cache.NewRedis(logger, redis, redisConfig)
+	case "bigcache":
+		// entries live as long as the longest expiry of methods
+		lifeWindow := max(15*time.Minute, _config.FinalizedExpiry)
+		for _, v := range _config.CacheMethods {
+			if d, err := time.ParseDuration(v); err == nil && d > lifeWindow {
+				lifeWindow = d
+			}
+		}
 
-		// time after which entry can be evicted
-		LifeWindow: 15 * time.Minute,
+		_cacheConfig := bigcache.Config{
+			// number of shards (must be a power of 2)
+			Shards: shards,
 
-		// Interval between removing expired entries (clean up).
-		// If set to <= 0 then no action is p4erformed.
-		// Setting to < 1 second is counterproductive — bigcache has a one second resolution.
-		CleanWindow: 15 * time.Minute,
+			// time after which entry can be evicted
+			LifeWindow: lifeWindow,
 
-		// rps * lifeWindow, used only in initial memory allocation
-		// MaxEntriesInWindow: 1000 * 10 * 60,
+			// Interval between removing expired entries (clean up).
+			// If set to <= 0 then no action is p4erformed.
+			// Setting to < 1 second is counterproductive — bigcache has a one second resolution.
+			CleanWindow: 15 * time.Minute,
 
-		// max entry size in bytes, used only in initial memory allocation
-		MaxEntrySize: _config.MaxEntryCacheSize,
+			// rps * lifeWindow, used only in initial memory allocation
+			// MaxEntriesInWindow: 1000 * 10 * 60,
 
-		// prints information about additional memory allocation
-		// Verbose: true,
+			// max entry size in bytes, used only in initial memory allocation
+			MaxEntrySize: _config.MaxEntryCacheSize,
 
-		// cache will not allocate more memory than this limit, value in MB
-		// if value is reached then the oldest entries can be overridden for the new ones
-		// 0 value means no size limit
-		HardMaxCacheSize: totalCacheSize / 1024 / 1024,
-	}
-	config.Unmarshal("agent.bigcache", &_cacheConfig)
+			// prints information about additional memory allocation
+			// Verbose: true,
 
-	cache, initErr := bigcache.NewBigCache(_cacheConfig)
-	if initErr != nil {
-		log.Fatal(initErr)
-	}
+			// cache will not allocate more memory than this limit, value in MB
+			// if value is reached then the oldest entries can be overridden for the new ones
+			// 0 value means no size limit
+			HardMaxCacheSize: totalCacheSize / 1024 / 1024,
+		}
+		config.Unmarshal("agent.bigcache", &_cacheConfig)
 
-	logger.Info().Msgf("Cache size: %d MB", _cacheConfig.HardMaxCacheSize)
+		_cache, initErr := bigcache.NewBigCache(_cacheConfig)
+		if initErr != nil {
+			log.Fatal(initErr)
+		}
 
-	service := agentService{
-		config:     _config,
-		client:     client,
-		logger:     logger,
-		jrpcSchema: jrpcSchema,
-		cache:      cache,
-		es:         endpoint.NewSelector(),
+		logger.Info().Msgf("Cache backend: bigcache, size: %d MB", _cacheConfig.HardMaxCacheSize)
+		return cache.NewBigcache(_cache)
+	default:
+		logger.Info().Msgf("Cache backend: memory, size: %d MB", totalCacheSize/1024/1024)
+		return cache.NewMemory(int64(totalCacheSize), max(shards, 16), config.Duration("cache.results.clean_window", time.Minute))
 	}
-
-	return service
 }
 
 func (a agentService) Call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint) ([]byte, error) {
 	jsonrpcs, isBatchCall, err := rpc.UnmarshalJSONRPCs(*rc.Body())
 	if err != nil {
-		return nil, common.BadRequestError(err.Error(), err)
+		return rpc.MarshalJSONRPCResults(rpc.SealedJSONRPCResult{
+			Version: rpc.JSONRPC_VERSION_2,
+			Error:   common.NewJSONRPCError(common.JSONRPCParseError, "Parse error"),
+		})
 	}
+	// an empty batch is answered by a single error
 	if len(jsonrpcs) == 0 {
-		if isBatchCall {
-			return rpc.MarshalJSONRPCResults([]rpc.SealedJSONRPCResult{})
-		}
-		return rpc.MarshalJSONRPCResults(rpc.SealedJSONRPCResult{})
+		return rpc.MarshalJSONRPCResults(rpc.SealedJSONRPCResult{
+			Version: rpc.JSONRPC_VERSION_2,
+			Error:   common.NewJSONRPCError(common.JSONRPCInvalidRequest, "Invalid Request", "empty batch"),
+		})
 	}
 
+	// the calls answered by errors without calling upstream
+	invalid := make([]error, len(jsonrpcs))
 	for i := range jsonrpcs {
-		if err := a.jrpcSchema.ValidateRequest(jsonrpcs[i].Method(), jsonrpcs[i].Raw()); err != nil {
-			return nil, common.BadRequestError(err.Error(), err)
+		if err := rpc.ValidateJSONRPC(jsonrpcs[i]); err != nil {
+			invalid[i] = common.NewJSONRPCError(common.JSONRPCInvalidRequest, "Invalid Request", err.Error())
+		} else if err := a.jrpcSchema.ValidateRequest(jsonrpcs[i].Method(), jsonrpcs[i].Raw()); err != nil {
+			if !a.config.JSONRPCErrors {
+				return nil, common.BadRequestError(err.Error(), err)
+			}
+			invalid[i] = common.NewJSONRPCError(common.JSONRPCInvalidParams, "Invalid params", err.Error())
 		}
 	}
 
-	dispatch := func(data []rpc.JSONRPCer) (any, error) {
-		if len(data) == 0 {
-			if isBatchCall {
-				return []rpc.SealedJSONRPCResult{}, nil
+	var (
+		chainId   = rc.ChainID()
+		withCache = !a.config.DisableCache && rc.Options().Caches()
+		submitted = map[int]string{}
+		// indexes of the calls dispatched upstream
+		dispatched = []int{}
+		results    = make([]rpc.SealedJSONRPCResult, len(jsonrpcs))
+		filled     = make([]bool, len(jsonrpcs))
+		// identical calls in flight, the leaders call upstream and the followers wait on them
+		leading   = map[int]*cache.Flight{}
+		following = map[int]*cache.Flight{}
+		keys      = map[int]string{}
+		chunked   = []int{}
+	)
+
+	if a.prefetcher != nil {
+		defer a.prefetcher.track(chainId)()
+	}
+
+	appName := "unknown"
+	if rc.App() != nil {
+		appName = rc.App().Name
+	}
+
+	// latest is pinned to one known height, the results are cacheable and the items of a batch are consistent
+	var pinned uint64
+	if withCache && a.config.EnablePinning {
+		if head, ok := a.heads.Head(chainId); ok && head.Number > a.config.PinningLag {
+			pinned = head.Number - a.config.PinningLag
+		}
+	}
+
+	reject := func(i int, err error) {
+		results[i] = jsonrpcs[i].MakeResult(nil, err)
+		p := rc.Profile()
+		p.Intercepts = append(p.Intercepts, jsonrpcs[i].Method())
+		rc.Logger().Warn().Err(err).Msgf("Intercepted %s", jsonrpcs[i].Method())
+	}
+
+	for i := 0; i < len(jsonrpcs); i++ {
+		if invalid[i] != nil {
+			results[i] = jsonrpcs[i].MakeResult(nil, invalid[i])
+			continue
+		}
+
+		if err := a.allow(rc, jsonrpcs[i]); err != nil {
+			reject(i, err)
+			continue
+		}
+
+		var transaction *tx.Transaction
+		if jsonrpcs[i].Method() == "eth_sendRawTransaction" {
+			var err error
+			if transaction, err = decodeTransaction(rc, jsonrpcs[i]); err != nil {
+				results[i] = jsonrpcs[i].MakeResult(nil, err)
+				rc.Logger().Warn().Err(err).Msg("Rejected transaction")
+				continue
 			}
-			return rpc.SealedJSONRPCResult{}, nil
 		}
 
-		results, err := a.call(ctx, rc, endpoints, data)
+		if err := intercept(rc, jsonrpcs[i], transaction); err != nil {
+			reject(i, err)
+			continue
+		}
 
-		if err != nil {
-			return nil, err
+		if pinned > 0 {
+			_PinBlockTag(jsonrpcs[i], pinned)
+		}
+
+		if withCache {
+			positive, _ := _WithCache(a.config.CacheMethods, jsonrpcs[i])
+			negative, _ := _WithCache(a.config.NegativeMethods, jsonrpcs[i])
+			if positive || negative {
+				if v, status, ok := a.getCache(ctx, rc, endpoints, jsonrpcs[i]); ok {
+					results[i] = jsonrpcs[i].MakeResult(v, nil)
+					utils.TotalCaches.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), status).Inc()
+					a.stats.record(chainId, jsonrpcs[i].Method(), status)
+					continue
+				}
+			}
+			utils.TotalCaches.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), "miss").Inc()
+			a.stats.record(chainId, jsonrpcs[i].Method(), "miss")
 		}
 
-		if !isBatchCall || (len(results) == 1 && results[0].Error != nil) {
-			return results[0], nil
+		// wide ranges of logs are fetched in chunks after the other calls
+		if a.chunkLogs(jsonrpcs[i]) {
+			chunked = append(chunked, i)
+			continue
+		}
+
+		if jsonrpcs[i].Method() == "eth_sendRawTransaction" && !a.config.DisableSubmissions {
+			hash, ok := _TransactionHash(jsonrpcs[i])
+			if transaction != nil {
+				hash, ok = transaction.Hash, true
+			}
+			if ok {
+				if submission, ok := a.submissions.Acquire(ctx, chainId, hash); !ok {
+					results[i] = a.submissions.MakeResult(jsonrpcs[i], submission)
+					utils.TotalDuplicateTransactions.WithLabelValues(fmt.Sprint(chainId), appName).Inc()
+					rc.Logger().Info().Msgf("Duplicate transaction %s is %s", hash, submission.Status)
+					continue
+				}
+				submitted[i] = hash
+			}
 		}
 
-		return results, nil
+		if !a.config.DisableCoalescing && _WithCoalescing(a.config.CoalescingMethods, jsonrpcs[i]) {
+			keys[i] = _CacheKey(a.jrpcSchema, chainId, jsonrpcs[i])
+			flight, leader := a.flights.Join(keys[i])
+			if !leader {
+				following[i] = flight
+				continue
+			}
+			leading[i] = flight
+		}
+
+		dispatched = append(dispatched, i)
 	}
 
-	handle := func(_jsonrpcs []rpc.JSONRPCer) ([]byte, error) {
-		results, err := dispatch(_jsonrpcs)
+	// the followers of a failed leader call upstream by themselves
+	resolve := func() {
+		for i, flight := range leading {
+			a.flights.Done(keys[i], flight, results[i], filled[i])
+		}
+	}
+	defer resolve()
 
+	// dispatch calls upstream, the results are placed by the indexes of the calls
+	dispatch := func(indexes []int) error {
+		data := make([]rpc.JSONRPCer, len(indexes))
+		for k, i := range indexes {
+			data[k] = jsonrpcs[i]
+		}
+		_results, err := a.call(ctx, rc, endpoints, data)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		for k, i := range indexes {
+			results[i], filled[i] = _results[k], true
+		}
+		return nil
+	}
 
-		return rpc.MarshalJSONRPCResults(results)
+	// fail answers the calls by the error in their slots, or else fails the whole request
+	fail := func(indexes []int, err error) error {
+		if !a.config.JSONRPCErrors {
+			return err
+		}
+		_err, ok := err.(common.HTTPErrors)
+		if !ok {
+			_err = common.InternalServerError("", err)
+		}
+		rc.Logger().Error().Str(zerolog.ErrorFieldName, _err.String()).Send()
+		p := rc.Profile()
+		p.Errors = append(p.Errors, _err.Error())
+		for _, i := range indexes {
+			results[i] = jsonrpcs[i].MakeResult(nil, common.JSONRPCErrorOf(_err))
+		}
+		return nil
 	}
 
-	if a.config.DisableCache || !rc.Options().Caches() {
-		return handle(jsonrpcs)
+	if len(dispatched) > 0 {
+		if err := dispatch(dispatched); err != nil {
+			for _, hash := range submitted {
+				go a.submissions.Release(context.Background(), chainId, hash)
+			}
+			if err := fail(dispatched, err); err != nil {
+				return nil, err
+			}
+			submitted = map[int]string{}
+		}
+
+		for index, hash := range submitted {
+			if results[index].Result == nil && results[index].Error == nil {
+				go a.submissions.Release(context.Background(), chainId, hash)
+				continue
+			}
+			if results[index].Error != nil && isKnownTransactionError(results[index].Error) {
+				// accepted by a previous attempt or another client, answer the hash instead of an error
+				results[index] = jsonrpcs[index].MakeResult(hash, nil)
+				utils.TotalDuplicateTransactions.WithLabelValues(fmt.Sprint(chainId), appName).Inc()
+			}
+			go a.submissions.Resolve(context.Background(), chainId, hash, results[index])
+		}
 	}
+	resolve()
 
-	var (
-		chainId   = rc.ChainID()
-		mapping   = map[string][]int{}
-		_jsonrpcs = []rpc.JSONRPCer{}
-		results   = make([]rpc.SealedJSONRPCResult, len(jsonrpcs))
-	)
+	for _, i := range chunked {
+		logs, rpcErr, err := a.getLogs(ctx, rc, endpoints, jsonrpcs[i])
+		if err != nil {
+			if err := fail([]int{i}, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		results[i], filled[i] = jsonrpcs[i].MakeResult(logs, rpcErr), true
+	}
 
-	for i := 0; i < len(jsonrpcs); i++ {
-		var v any
-		if ok, ttl := _WithCache(a.config.CacheMethods, jsonrpcs[i]); ok {
-			key, entry := _CacheKey(chainId, jsonrpcs[i]), &CacheEntry{}
-			err := _GetCache(a.cache, key, entry)
-			if err == nil {
-				if time.UnixMilli(entry.T).Add(ttl).After(time.Now()) {
-					if entry.compressed {
-						if _v, err := helpers.Decompress(entry.V.([]byte)); err != nil {
-							rc.Logger().Warn().Err(err).Msgf("Failed to compress cache %s", jsonrpcs[i].Method())
-						} else if err = json.Unmarshal(_v, &v); err != nil {
-							rc.Logger().Warn().Err(err).Msgf("Failed to unmarshal cache %s", jsonrpcs[i].Method())
-						}
-					} else {
-						v = entry.V
-					}
-
-					if jsonrpcs[i].Method() == "eth_blockNumber" {
-						endpoint := slices.MaxFunc(endpoints, func(a *endpoint.Endpoint, b *endpoint.Endpoint) int {
-							return int(b.BlockNumber() - a.BlockNumber())
-						})
-						if height := endpoint.BlockNumber(); height > 0 {
-							if v == nil {
-								v = height
-							} else if n, err := strconv.ParseUint(v.(string), 16, 64); err == nil {
-								v = slices.Max([]uint64{height, n})
-							}
-						}
-					}
-				} else {
-					go a.cache.Delete(key)
+	if len(following) > 0 {
+		fallback := []int{}
+		for i, flight := range following {
+			if v, ok := flight.Wait(ctx); ok {
+				result := v.(rpc.SealedJSONRPCResult)
+				results[i] = jsonrpcs[i].MakeResult(result.Result, result.Error)
+				filled[i] = true
+				utils.TotalCoalescedRequests.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method()).Inc()
+				continue
+			}
+			fallback = append(fallback, i)
+		}
+
+		if len(fallback) > 0 {
+			if err := dispatch(fallback); err != nil {
+				if err := fail(fallback, err); err != nil {
+					return nil, err
 				}
 			}
 		}
+	}
+
+	// the notifications are called but not answered, a call of notifications only has no answer
+	answers := []rpc.SealedJSONRPCResult{}
+	for i := range jsonrpcs {
+		if jsonrpcs[i].Type() != rpc.JSONRPC_NOTIFY || rpc.ValidateJSONRPC(jsonrpcs[i]) != nil {
+			// only the errors of the endpoints are rewritten, the errors of the proxy are already in shape
+			if a.config.RewriteErrors && results[i].Error != nil {
+				results[i].Error = a.normalizer.Rewrite(results[i].Error, strconv.FormatUint(chainId, 10), rc.ChainCode())
+			}
+			answers = append(answers, results[i])
+		}
+	}
+	if len(answers) == 0 {
+		return []byte{}, nil
+	}
+	if !isBatchCall {
+		return rpc.MarshalJSONRPCResults(answers[0])
+	}
+	return rpc.MarshalJSONRPCResults(answers)
+}
+
+func (a agentService) Intercept(rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer) error {
+	if err := a.allow(rc, jsonrpc); err != nil {
+		return err
+	}
+	return intercept(rc, jsonrpc, nil)
+}
+
+// allow checks the method of the call against the tenant preferences, then the firewall
+func (a agentService) allow(rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer) error {
+	if err := interceptMethod(rc, jsonrpc); err != nil {
+		return err
+	}
 
+	chainId := rc.ChainID()
+	if !a.config.DisableFirewall && !a.firewall.Allowed(jsonrpc.Method(), strconv.FormatUint(chainId, 10), rc.ChainCode()) {
 		appName := "unknown"
 		if rc.App() != nil {
 			appName = rc.App().Name
 		}
+		utils.TotalBlockedMethods.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpc.Method()).Inc()
+		return common.NewJSONRPCError(common.JSONRPCIntercepted, fmt.Sprintf("method %s is blocked by the proxy", jsonrpc.Method()))
+	}
+	return nil
+}
 
-		if v != nil {
-			results[i] = jsonrpcs[i].MakeResult(v, nil)
-			utils.TotalCaches.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), "mem").Inc()
-		} else {
-			_jsonrpcs = append(_jsonrpcs, jsonrpcs[i])
-			utils.TotalCaches.WithLabelValues(fmt.Sprint(chainId), appName, jsonrpcs[i].Method(), "miss").Inc()
-
-			id := fmt.Sprint(jsonrpcs[i].Raw()["id"])
-			if mapping[id] == nil {
-				mapping[id] = []int{}
-			}
-			mapping[id] = append(mapping[id], i)
-		}
+// getCache looks up the result cache, then the second tier, returns the value and the cache status,
+// the status of the null results is negative
+func (a agentService) getCache(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpc rpc.JSONRPCer) (any, string, bool) {
+	var (
+		key    = _CacheKey(a.jrpcSchema, rc.ChainID(), jsonrpc)
+		status = "mem"
+	)
+	if a.config.CacheBackend == "redis" {
+		status = "redis"
 	}
 
-	if len(_jsonrpcs) <= 0 {
-		if isBatchCall {
-			return rpc.MarshalJSONRPCResults(results)
-		} else if len(results) > 0 {
-			return rpc.MarshalJSONRPCResults(results[0])
+	tier, filling := a.cache, false
+	entry, ok := a.cache.Get(ctx, key)
+	if !ok && a.l2 != nil {
+		if entry, ok = a.l2.Get(ctx, key); ok {
+			tier, status, filling = a.l2, "redis", true
 		}
 	}
+	if !ok {
+		return nil, "", false
+	}
 
-	data, err := dispatch(_jsonrpcs)
-
+	v, err := _DecodeResult(entry.Value)
 	if err != nil {
-		return nil, err
+		// the corrupt entry is deleted from the tier it comes from
+		rc.Logger().Warn().Err(err).Msgf("Failed to decode cache %s", jsonrpc.Method())
+		go tier.Delete(context.Background(), key)
+		return nil, "", false
+	}
+	if filling {
+		// fill the first tier with the remaining ttl of the entry
+		go a.cache.Set(context.Background(), key, entry.Value, entry.TTL())
+	}
+	if v == nil {
+		return nil, "negative", true
 	}
 
-	if _results, ok := data.([]rpc.SealedJSONRPCResult); ok {
-		for i := range _results {
-			indexes := mapping[fmt.Sprint(_results[i].ID)]
+	// the entry may be set by another node, track it for the reorgs
+	if status == "redis" {
+		if from, to, ok := _BlockRange(jsonrpc, v); ok {
+			a.index.Add(rc.ChainID(), from, to, key)
+			a.ranges.AddExpiring(rc.ChainID(), from, to, key, entry.TTL())
+		}
+	}
 
-			for _, index := range indexes {
-				// 如果已经有缓存结果，则跳过
-				if results[index].Result != nil {
-					continue
-				}
-				results[index] = _results[i]
+	if jsonrpc.Method() == "eth_blockNumber" {
+		endpoint := slices.MaxFunc(endpoints, func(a *endpoint.Endpoint, b *endpoint.Endpoint) int {
+			return int(b.BlockNumber() - a.BlockNumber())
+		})
+		if height := endpoint.BlockNumber(); height > 0 {
+			if n, err := strconv.ParseUint(v.(string), 16, 64); err == nil {
+				v = slices.Max([]uint64{height, n})
 			}
 		}
-
-		return rpc.MarshalJSONRPCResults(results)
 	}
 
-	return rpc.MarshalJSONRPCResults(data)
+	return v, status, true
 }
 
 func (a agentService) call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpcs []rpc.JSONRPCer) (results []rpc.SealedJSONRPCResult, err error) {
@@ -297,17 +671,21 @@ func (a agentService) call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*
 	_endpoints, ok := a.es.Select(ctx, rc, endpoints, jsonrpcs)
 	if !ok || len(_endpoints) <= 0 {
 		a.logger.Error().Msgf("%d No available endpoints", chainId)
-		return nil, common.InternalServerError("No available endpoints")
+		return nil, common.UnavailableError("No available endpoints")
 	}
 
+	// the ids of the calls are unique upstream, the answers are placed by them in the order of the calls
 	var (
 		prefix    = helpers.Short(rc.ReqID())
-		_jsonrpcs = []rpc.SealedJSONRPC{}
+		_jsonrpcs = make([]rpc.SealedJSONRPC, len(jsonrpcs))
+		answered  = make([]bool, len(jsonrpcs))
+		// an error answered for the whole batch, it is the answer of each call
+		batchError any
 	)
 	for i := range jsonrpcs {
-		_jsonrpc := jsonrpcs[i].Seal()
-		_jsonrpc.ID += prefix + _jsonrpc.ID
-		_jsonrpcs = append(_jsonrpcs, _jsonrpc)
+		_jsonrpcs[i] = jsonrpcs[i].Seal()
+		_jsonrpcs[i].Version = rpc.JSONRPC_VERSION_2
+		_jsonrpcs[i].ID = prefix + ":" + strconv.Itoa(i)
 	}
 
 	_results, err := a.client.Request(ctx, rc, _endpoints, _jsonrpcs)
@@ -316,72 +694,157 @@ func (a agentService) call(ctx context.Context, rc reqctx.Reqctxs, endpoints []*
 		return nil, err
 	}
 
-	results = make([]rpc.SealedJSONRPCResult, len(_results))
-	for i := range _results {
-		if j := slices.IndexFunc(_jsonrpcs, func(_jsonrpc rpc.SealedJSONRPC) bool {
-			return _jsonrpc.ID == _results[i].ID()
-		}); j >= 0 {
-			results[i] = jsonrpcs[j].MakeResult(_results[i].Result(), _results[i].Error())
-		} else {
-			results[i] = rpc.SealedJSONRPCResult{}
-
-			if _results[i].ID() != "" {
-				results[i].ID = _results[i].ID()
-			}
-			if _results[i].Version() != "" {
-				results[i].Version = _results[i].Version()
-			}
-			if _results[i].Result() != nil {
-				results[i].Result = _results[i].Result()
+	results = make([]rpc.SealedJSONRPCResult, len(jsonrpcs))
+	for _, _result := range _results {
+		i := slices.IndexFunc(_jsonrpcs, func(_jsonrpc rpc.SealedJSONRPC) bool {
+			return _jsonrpc.ID == _result.ID()
+		})
+		if i < 0 || answered[i] {
+			if _result.Error() != nil {
+				batchError = _result.Error()
 			}
-			if _results[i].Error() != nil {
-				results[i].Error = _results[i].Error()
+			continue
+		}
+		results[i], answered[i] = jsonrpcs[i].MakeResult(_result.Result(), _result.Error()), true
+		if _result.Type() != rpc.JSONRPC_RESPONSE {
+			continue
+		}
+
+		// blocks of the results are checked against the canonical hashes to detect reorgs early
+		if v, ok := results[i].Result.(map[string]any); ok && strings.HasPrefix(jsonrpcs[i].Method(), "eth_getBlockBy") {
+			if n, ok := helpers.DecodeQuantity(v["number"]); ok {
+				hash, _ := v["hash"].(string)
+				a.heads.Observe(chainId, n, hash)
 			}
 		}
-	}
 
-	if !a.config.DisableCache {
-		for i := range results {
-			if jsonrpc, ok := slice.Find(jsonrpcs, func(_ int, jsonrpc rpc.JSONRPCer) bool {
-				return jsonrpc.Raw()["id"] == results[i].ID
-			}); ok && _results[i].Type() == rpc.JSONRPC_RESPONSE {
-				if ok, _ := _WithCache(a.config.CacheMethods, *jsonrpc); ok {
-					key := _CacheKey(chainId, *jsonrpc)
-					if data, err := json.Marshal(results[i].Result); err == nil {
-						if len(data) > a.config.MaxEntryCacheSize {
-							go func(k string, v []byte) {
-								defer func() {
-									if err := recover(); err != nil {
-										a.logger.Error().Interface("error", err).Msg("Failed to set cache result")
-									}
-								}()
-
-								if compressed, err := helpers.Compress(v); err != nil {
-									a.logger.Error().Err(err).Msg("Failed to compress")
-								} else {
-									// skip set cache, data is bigger than cache size after compression
-									if len(compressed) > a.config.MaxEntryCacheSize {
-										return
-									}
-									v = compressed
-								}
-
-								if err := _SetCache(a.cache, k, &CacheEntry{V: v, T: time.Now().UnixMilli(), compressed: true}); err != nil {
-									a.logger.Error().Err(err).Msg("Cache set error")
-								}
-							}(key, data)
-						} else {
-							if err := _SetCache(a.cache, key, &CacheEntry{V: results[i].Result, T: time.Now().UnixMilli()}); err != nil {
-								a.logger.Error().Err(err).Msg("Cache set error")
-							}
-						}
-
-						a.logger.Debug().Msgf("Cache capacity: %d, len: %d", a.cache.Capacity(), a.cache.Len())
-					}
+		if !a.config.DisableCache {
+			if results[i].Result == nil {
+				if ok, ttl := _WithCache(a.config.NegativeMethods, jsonrpcs[i]); ok {
+					a.setNegative(ctx, chainId, jsonrpcs[i], ttl)
 				}
+			} else if ok, ttl := _WithCache(a.config.CacheMethods, jsonrpcs[i]); ok {
+				a.cacheResult(ctx, chainId, jsonrpcs[i], results[i].Result, ttl)
 			}
 		}
 	}
 
+	for i := range results {
+		if answered[i] {
+			continue
+		}
+		if batchError == nil {
+			batchError = common.NewJSONRPCError(common.JSONRPCInternalError, "No answer from the endpoint")
+		}
+		results[i] = jsonrpcs[i].MakeResult(nil, batchError)
+	}
+
 	return results, nil
 }
+
+// cacheResult caches the result by the finality of its blocks, the results of unfinalized blocks are indexed for the reorgs
+func (a agentService) cacheResult(ctx context.Context, chainId common.ChainId, jsonrpc rpc.JSONRPCer, result any, ttl time.Duration) {
+	key := _CacheKey(a.jrpcSchema, chainId, jsonrpc)
+	from, to, ok := _BlockRange(jsonrpc, result)
+	ttl, finalized := a.expiry(chainId, to, ok, ttl)
+	if ok && !finalized {
+		a.index.Add(chainId, from, to, key)
+	}
+	if ok {
+		a.ranges.AddExpiring(chainId, from, to, key, ttl)
+	}
+	a.setCache(ctx, key, result, ttl)
+}
+
+// expiry adjusts the expiry of the method by the finality of the blocks the result depends on,
+// finalized reports whether all the blocks are finalized
+func (a agentService) expiry(chainId common.ChainId, to uint64, ranged bool, ttl time.Duration) (_ time.Duration, finalized bool) {
+	if a.config.DisableFinality || !ranged {
+		return ttl, false
+	}
+	n, ok := a.heads.Finalized(chainId)
+	if !ok {
+		return ttl, false
+	}
+	if to <= n {
+		return max(ttl, a.config.FinalizedExpiry), true
+	}
+	return min(ttl, a.config.UnfinalizedExpiry), false
+}
+
+// invalidate deletes the cached results of the reorganized blocks
+func (a agentService) invalidate(event ReorgEvent) {
+	keys := a.index.Take(event.ChainID, event.From, math.MaxUint64)
+	for _, key := range keys {
+		a.cache.Delete(context.Background(), key)
+		if a.l2 != nil {
+			a.l2.Delete(context.Background(), key)
+		}
+	}
+	utils.TotalReorgInvalidations.WithLabelValues(fmt.Sprint(event.ChainID)).Add(float64(len(keys)))
+	a.logger.Info().Msgf("Invalidated %d cached results of chain %d from block %d", len(keys), event.ChainID, event.From)
+}
+
+// setNegative caches the null result shortly in the first tier, until the head passes the block of the call,
+// or the next block for the calls of transactions which are not included yet
+func (a agentService) setNegative(ctx context.Context, chainId common.ChainId, jsonrpc rpc.JSONRPCer, ttl time.Duration) {
+	head, known := a.heads.Head(chainId)
+	block := head.Number + 1
+	if from, _, ok := _BlockRange(jsonrpc, nil); ok {
+		block = from
+	}
+	// the block is known by the head already, the null result is of a lagging endpoint
+	if known && block <= head.Number {
+		return
+	}
+
+	key := _CacheKey(a.jrpcSchema, chainId, jsonrpc)
+	value, _ := _EncodeResult([]byte("null"), a.config.MaxEntryCacheSize)
+	if err := a.cache.Set(ctx, key, value, ttl); err != nil {
+		a.logger.Error().Err(err).Msg("Cache set error")
+		return
+	}
+	if known {
+		a.negatives.Add(chainId, block, block, key)
+	}
+}
+
+// setCache writes the result through the cache tiers, big results are compressed in background
+func (a agentService) setCache(ctx context.Context, key string, v any, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	set := func(data []byte) {
+		value, ok := _EncodeResult(data, a.config.MaxEntryCacheSize)
+		// skip set cache, data is bigger than cache size after compression
+		if !ok {
+			return
+		}
+		if err := a.cache.Set(ctx, key, value, ttl); err != nil {
+			a.logger.Error().Err(err).Msg("Cache set error")
+		}
+		if a.l2 != nil {
+			go a.l2.Set(ctx, key, value, ttl)
+		}
+	}
+
+	if len(data) <= a.config.MaxEntryCacheSize {
+		set(data)
+		return
+	}
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				a.logger.Error().Interface("error", err).Msg("Failed to set cache result")
+			}
+		}()
+		set(data)
+	}()
+}
@@ -1,73 +1,100 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
+	"slices"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/cache"
 	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
 	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
 	"github.com/allegro/bigcache"
 	"github.com/duke-git/lancet/v2/slice"
 )
 
-func _CacheKey(chainId common.ChainId, jsonrpc rpc.JSONRPCer) string {
-	params := jsonrpc.Raw()["params"]
-	if params == nil {
-		params = []any{}
-	}
+// _CacheKey returns the key of the call, the params are normalized by the schema and hashed in full width
+func _CacheKey(schema *rpc.JSONRPCSchema, chainId common.ChainId, jsonrpc rpc.JSONRPCer) string {
+	params := schema.NormalizeParams(jsonrpc.Method(), jsonrpc.Params())
 	_params := ""
-	if b, err := json.Marshal(params); err == nil && len(b) > 0 {
-		_params = helpers.Short(string(b))
+	if b, err := json.Marshal(params); err == nil {
+		sum := sha256.Sum256(b)
+		_params = hex.EncodeToString(sum[:])
+	}
+	return _CacheKeyPrefix(chainId, jsonrpc.Method()) + _params
+}
+
+// _CacheKeyPrefix returns the prefix of the cache keys of the chain, or of the method if not empty
+func _CacheKeyPrefix(chainId common.ChainId, method string) string {
+	if method == "" {
+		return strconv.FormatUint(chainId, 36) + ":"
+	}
+	return strconv.FormatUint(chainId, 36) + ":" + method + ":"
+}
+
+// the block tags whose block moves with the chain
+var notCacheTags = []string{"earliest", "latest", "pending", "safe", "finalized"}
+
+// _CacheableBlock returns whether the block param names a fixed block, a number or a hash,
+// the EIP-1898 objects are fixed only by a block number or a block hash
+func _CacheableBlock(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case map[string]any:
+		if v["blockHash"] != nil {
+			return true
+		}
+		_, ok := helpers.DecodeQuantity(v["blockNumber"])
+		return ok
 	}
-	return strings.Join([]string{strconv.FormatUint(chainId, 36), jsonrpc.Method(), _params}, ":")
+	return !slice.Contain(notCacheTags, fmt.Sprint(v))
 }
 
 func _WithCache(config map[string]string, jsonrpc rpc.JSONRPCer) (ok bool, ttl time.Duration) {
-	var (
-		notCacheTags = []string{"earliest", "latest", "pending"}
-		v            = config[jsonrpc.Method()]
-	)
+	v := config[jsonrpc.Method()]
 
 	if v != "" {
 		ok := true
 		switch jsonrpc.Method() {
 		case "eth_getBlockByNumber":
 			if len(jsonrpc.Params()) >= 1 {
-				ok = !slice.Contain(notCacheTags, fmt.Sprint(jsonrpc.Params()[0]))
+				ok = _CacheableBlock(jsonrpc.Params()[0])
 			} else {
 				ok = false
 			}
 		case "eth_getTransactionByBlockNumberAndIndex":
 			if len(jsonrpc.Params()) >= 1 {
-				ok = !slice.Contain(notCacheTags, fmt.Sprint(jsonrpc.Params()[0]))
+				ok = _CacheableBlock(jsonrpc.Params()[0])
 			} else {
 				ok = false
 			}
 		case "eth_getUncleByBlockNumberAndIndex":
 			if len(jsonrpc.Params()) >= 1 {
-				ok = !slice.Contain(notCacheTags, fmt.Sprint(jsonrpc.Params()[0]))
+				ok = _CacheableBlock(jsonrpc.Params()[0])
 			} else {
 				ok = false
 			}
 		case "eth_getUncleCountByBlockNumber":
 			if len(jsonrpc.Params()) >= 1 {
-				ok = !slice.Contain(notCacheTags, fmt.Sprint(jsonrpc.Params()[0]))
+				ok = _CacheableBlock(jsonrpc.Params()[0])
 			} else {
 				ok = false
 			}
 		case "eth_getBlockTransactionCountByNumber":
 			if len(jsonrpc.Params()) >= 1 {
-				ok = !slice.Contain(notCacheTags, fmt.Sprint(jsonrpc.Params()[0]))
+				ok = _CacheableBlock(jsonrpc.Params()[0])
 			} else {
 				ok = false
 			}
 		case "eth_getTransactionCount":
 			if len(jsonrpc.Params()) >= 2 {
-				ok = !slice.Contain(notCacheTags, fmt.Sprint(jsonrpc.Params()[1]))
+				ok = _CacheableBlock(jsonrpc.Params()[1])
 			} else {
 				ok = false
 			}
@@ -75,13 +102,24 @@ func _WithCache(config map[string]string, jsonrpc rpc.JSONRPCer) (ok bool, ttl t
 			params := jsonrpc.Params()
 			for i := range params {
 				param := params[i].(map[string]any)
-				fromBlock := fmt.Sprint(param["fromBlock"])
-				toBlock := fmt.Sprint(param["toBlock"])
-
-				if slice.Contain(notCacheTags, fromBlock) || slice.Contain(notCacheTags, toBlock) {
+				if param["blockHash"] != nil {
+					continue
+				}
+				// the missing blocks default to latest
+				if param["fromBlock"] == nil || param["toBlock"] == nil {
 					ok = false
 					break
 				}
+				if !_CacheableBlock(param["fromBlock"]) || !_CacheableBlock(param["toBlock"]) {
+					ok = false
+					break
+				}
+			}
+		default:
+			// the missing block param defaults to latest
+			if index, exists := _BlockParams[jsonrpc.Method()]; exists {
+				params := jsonrpc.Params()
+				ok = len(params) > index && _CacheableBlock(params[index])
 			}
 		}
 
@@ -94,6 +132,181 @@ func _WithCache(config map[string]string, jsonrpc rpc.JSONRPCer) (ok bool, ttl t
 	return false, 0.0
 }
 
+// the read only methods whose identical calls in flight are coalesced by default
+var _CoalescingMethods = []string{
+	"net_version",
+	"eth_chainId",
+	"eth_blockNumber",
+	"eth_gasPrice",
+	"eth_maxPriorityFeePerGas",
+	"eth_feeHistory",
+	"eth_call",
+	"eth_estimateGas",
+	"eth_getBalance",
+	"eth_getCode",
+	"eth_getStorageAt",
+	"eth_getProof",
+	"eth_getTransactionCount",
+	"eth_getBlock*",
+	"eth_getTransaction*",
+	"eth_getUncle*",
+	"eth_getLogs",
+}
+
+// _WithCoalescing returns whether the identical calls of the method can share one upstream call
+func _WithCoalescing(methods []string, jsonrpc rpc.JSONRPCer) bool {
+	return rpc.MatchAny(methods, jsonrpc.Method())
+}
+
+// the index of the block number param of the methods, whose results depend on the block
+var _BlockParams = map[string]int{
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockReceipts":                    0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_getUncleByBlockNumberAndIndex":       0,
+	"eth_getUncleCountByBlockNumber":          0,
+	"eth_getBalance":                          1,
+	"eth_getCode":                             1,
+	"eth_getTransactionCount":                 1,
+	"eth_call":                                1,
+	"eth_getStorageAt":                        2,
+}
+
+// _PinBlockTag rewrites the latest block tag of the params, explicit or by default, to the block number,
+// returns whether the params are changed
+func _PinBlockTag(jsonrpc rpc.JSONRPCer, number uint64) bool {
+	params, ok := jsonrpc.Raw()["params"].([]any)
+	if !ok && jsonrpc.Raw()["params"] != nil {
+		return false
+	}
+	var (
+		tag    = helpers.EncodeQuantity(number)
+		pinned = false
+	)
+
+	if jsonrpc.Method() == "eth_getLogs" {
+		if len(params) < 1 {
+			return false
+		}
+		filter, ok := params[0].(map[string]any)
+		if !ok || filter["blockHash"] != nil {
+			return false
+		}
+		_filter := make(map[string]any, len(filter))
+		for k, v := range filter {
+			_filter[k] = v
+		}
+		for _, k := range []string{"fromBlock", "toBlock"} {
+			if _filter[k] == nil || _filter[k] == "latest" {
+				_filter[k], pinned = tag, true
+			}
+		}
+		if pinned {
+			jsonrpc.Raw()["params"] = append([]any{_filter}, params[1:]...)
+		}
+		return pinned
+	}
+
+	index, ok := _BlockParams[jsonrpc.Method()]
+	if !ok {
+		return false
+	}
+	_params := slices.Clone(params)
+	switch {
+	case len(_params) == index:
+		_params, pinned = append(_params, tag), true
+	case len(_params) > index && _params[index] == "latest":
+		_params[index], pinned = tag, true
+	}
+	if pinned {
+		jsonrpc.Raw()["params"] = _params
+	}
+	return pinned
+}
+
+// _BlockRange returns the range of the blocks the result depends on, the result is replaced if any of the blocks is reorganized
+func _BlockRange(jsonrpc rpc.JSONRPCer, result any) (from, to uint64, ok bool) {
+	params := jsonrpc.Params()
+
+	if i, found := _BlockParams[jsonrpc.Method()]; found {
+		if len(params) > i {
+			block := params[i]
+			if v, ok := block.(map[string]any); ok {
+				block = v["blockNumber"]
+			}
+			if n, ok := helpers.DecodeQuantity(block); ok {
+				return n, n, true
+			}
+		}
+		return 0, 0, false
+	}
+
+	switch jsonrpc.Method() {
+	case "eth_getLogs":
+		if len(params) < 1 {
+			return 0, 0, false
+		}
+		filter, _ := params[0].(map[string]any)
+		if filter == nil || filter["blockHash"] != nil {
+			return 0, 0, false
+		}
+		if from, ok = helpers.DecodeQuantity(filter["fromBlock"]); !ok {
+			return 0, 0, false
+		}
+		if to, ok = helpers.DecodeQuantity(filter["toBlock"]); !ok {
+			to = math.MaxUint64
+		}
+		return from, to, true
+	case "eth_getTransactionByHash", "eth_getTransactionReceipt":
+		// the transaction may be included in another block after a reorg
+		if v, _ := result.(map[string]any); v != nil {
+			if n, ok := helpers.DecodeQuantity(v["blockNumber"]); ok {
+				return n, n, true
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// encoding flag of the cached results
+const (
+	cachePlain      byte = 'j'
+	cacheCompressed byte = 'z'
+)
+
+// _EncodeResult encodes the marshaled result for the cache, results bigger than max are compressed,
+// ok is false if it is still bigger than max
+func _EncodeResult(data []byte, max int) (_ []byte, ok bool) {
+	if len(data) <= max {
+		return append([]byte{cachePlain}, data...), true
+	}
+	compressed, err := helpers.Compress(data)
+	if err != nil || len(compressed) > max {
+		return nil, false
+	}
+	return append([]byte{cacheCompressed}, compressed...), true
+}
+
+func _DecodeResult(b []byte) (v any, err error) {
+	if len(b) < 1 {
+		return nil, cache.ErrInvalidEntry
+	}
+	data := b[1:]
+	switch b[0] {
+	case cacheCompressed:
+		if data, err = helpers.Decompress(data); err != nil {
+			return nil, err
+		}
+	case cachePlain:
+	default:
+		return nil, cache.ErrInvalidEntry
+	}
+	err = json.Unmarshal(data, &v)
+	return v, err
+}
+
 func _SetCache(cache *bigcache.BigCache, k string, v any) error {
 	if data, err := json.Marshal(v); err == nil {
 		err = cache.Set(k, data)
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/app/shared"
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/cache"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/rs/zerolog"
+)
+
+// MethodCacheStats is the statistics of the cache lookups of a method of a chain
+type MethodCacheStats struct {
+	ChainID   common.ChainId `json:"chainId"`
+	Method    string         `json:"method"`
+	Hits      uint64         `json:"hits"`
+	Negatives uint64         `json:"negatives"`
+	Misses    uint64         `json:"misses"`
+}
+
+type CacheStats struct {
+	Cache   cache.Stats        `json:"cache"`
+	L2      *cache.Stats       `json:"l2,omitempty"`
+	Methods []MethodCacheStats `json:"methods"`
+}
+
+// CacheEntry is a cached result, times are in unix milliseconds
+type CacheEntry struct {
+	Key       string `json:"key"`
+	Tier      string `json:"tier"`
+	Value     any    `json:"value"`
+	CachedAt  int64  `json:"cachedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// CachePurge selects the cached results to purge, by the key, or by the chain, the method and the block range,
+// the results not depending on blocks are kept by the purges of a block range, all the results are purged only by All
+type CachePurge struct {
+	Key     string         `json:"key,omitempty"`
+	ChainID common.ChainId `json:"chainId,omitempty"`
+	Method  string         `json:"method,omitempty"`
+	From    *uint64        `json:"from,omitempty"`
+	To      *uint64        `json:"to,omitempty"`
+	All     bool           `json:"all,omitempty"`
+}
+
+// CachePurged is the outcome of a purge, the other nodes purge their first tier when the purge is broadcast to them
+type CachePurged struct {
+	Purged    int      `json:"purged"`
+	Tiers     []string `json:"tiers"`
+	Broadcast bool     `json:"broadcast"`
+}
+
+// purgeMessage is a purge broadcast to the other nodes of the cluster
+type purgeMessage struct {
+	Node  string     `json:"node"`
+	Purge CachePurge `json:"purge"`
+}
+
+// purges broadcasts the purges to the other nodes through redis, and applies theirs
+type purges struct {
+	logger  zerolog.Logger
+	redis   *shared.RedisClient
+	channel string
+	// the purges of the node are not applied again
+	node string
+}
+
+func newPurges(logger zerolog.Logger, redis *shared.RedisClient, prefix string) *purges {
+	node := make([]byte, 8)
+	rand.Read(node)
+	return &purges{
+		logger:  logger.With().Str("name", "purges").Logger(),
+		redis:   redis,
+		channel: prefix + "purges",
+		node:    hex.EncodeToString(node),
+	}
+}
+
+func (p *purges) available() bool {
+	return p != nil && p.redis != nil && p.redis.Client != nil
+}
+
+// publish broadcasts the purge, returns whether it is sent
+func (p *purges) publish(ctx context.Context, purge CachePurge) bool {
+	if !p.available() {
+		return false
+	}
+	b, _ := json.Marshal(purgeMessage{Node: p.node, Purge: purge})
+	if err := p.redis.Client.Publish(ctx, p.channel, b).Err(); err != nil {
+		p.logger.Error().Err(err).Msg("Failed to broadcast the purge")
+		return false
+	}
+	return true
+}
+
+// cacheStats counts the cache lookups by chain and method
+type cacheStats struct {
+	methods sync.Map
+}
+
+type methodCounters struct {
+	hits      atomic.Uint64
+	negatives atomic.Uint64
+	misses    atomic.Uint64
+}
+
+func (s *cacheStats) record(chainId common.ChainId, method string, status string) {
+	v, _ := s.methods.LoadOrStore(_CacheKeyPrefix(chainId, method), &methodCounters{})
+	c := v.(*methodCounters)
+	switch status {
+	case "miss":
+		c.misses.Add(1)
+	case "negative":
+		c.negatives.Add(1)
+	default:
+		c.hits.Add(1)
+	}
+}
+
+func (s *cacheStats) list() []MethodCacheStats {
+	stats := []MethodCacheStats{}
+	s.methods.Range(func(k, v any) bool {
+		chainId, method := _ParseCacheKey(k.(string))
+		c := v.(*methodCounters)
+		stats = append(stats, MethodCacheStats{
+			ChainID:   chainId,
+			Method:    method,
+			Hits:      c.hits.Load(),
+			Negatives: c.negatives.Load(),
+			Misses:    c.misses.Load(),
+		})
+		return true
+	})
+	slices.SortFunc(stats, func(a, b MethodCacheStats) int {
+		if a.ChainID != b.ChainID {
+			return int(a.ChainID) - int(b.ChainID)
+		}
+		return strings.Compare(a.Method, b.Method)
+	})
+	return stats
+}
+
+// _ParseCacheKey returns the chain and the method of the cache key
+func _ParseCacheKey(key string) (chainId common.ChainId, method string) {
+	parts := strings.SplitN(key, ":", 3)
+	chainId, _ = strconv.ParseUint(parts[0], 36, 64)
+	if len(parts) > 1 {
+		method = parts[1]
+	}
+	return chainId, method
+}
+
+// FollowPurges applies the purges broadcast by the other nodes to the first tier until the context is done,
+// the shared second tier is purged by the node receiving the purge
+func (a agentService) FollowPurges(ctx context.Context) {
+	if !a.purges.available() {
+		return
+	}
+	pubsub := a.purges.redis.Client.Subscribe(ctx, a.purges.channel)
+	defer pubsub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+			a.applyPurge(ctx, []byte(msg.Payload))
+		}
+	}
+}
+
+func (a agentService) applyPurge(ctx context.Context, payload []byte) {
+	var msg purgeMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		a.logger.Warn().Err(err).Msg("Failed to decode the broadcast purge")
+		return
+	}
+	if msg.Node == a.purges.node {
+		return
+	}
+	tiers := []cache.ResultCache{}
+	if a.config.CacheBackend != "redis" {
+		tiers = append(tiers, a.cache)
+	}
+	if n, err := a.purge(ctx, msg.Purge, tiers); err != nil {
+		a.logger.Warn().Err(err).Msgf("Failed to apply the purge of node %s", msg.Node)
+	} else {
+		a.logger.Info().Msgf("Purged %d cached results by node %s", n, msg.Node)
+	}
+}
+
+func (a agentService) CacheStats() CacheStats {
+	stats := CacheStats{
+		Cache:   a.cache.Stats(),
+		Methods: a.stats.list(),
+	}
+	if a.l2 != nil {
+		l2 := a.l2.Stats()
+		stats.L2 = &l2
+	}
+	return stats
+}
+
+// CacheKeys returns the cache keys of the calls of the body
+func (a agentService) CacheKeys(chainId common.ChainId, body []byte) ([]string, error) {
+	jsonrpcs, _, err := rpc.UnmarshalJSONRPCs(body)
+	if err != nil {
+		return nil, common.BadRequestError(err.Error(), err)
+	}
+	keys := make([]string, len(jsonrpcs))
+	for i := range jsonrpcs {
+		keys[i] = _CacheKey(a.jrpcSchema, chainId, jsonrpcs[i])
+	}
+	return keys, nil
+}
+
+// LookupCache returns the cached result of the key, from the first tier or else the second
+func (a agentService) LookupCache(ctx context.Context, key string) (CacheEntry, bool) {
+	tier := a.config.CacheBackend
+	entry, ok := a.cache.Get(ctx, key)
+	if !ok && a.l2 != nil {
+		tier = "redis"
+		entry, ok = a.l2.Get(ctx, key)
+	}
+	if !ok {
+		return CacheEntry{}, false
+	}
+
+	v, err := _DecodeResult(entry.Value)
+	if err != nil {
+		return CacheEntry{}, false
+	}
+	return CacheEntry{Key: key, Tier: tier, Value: v, CachedAt: entry.T, ExpiresAt: entry.E}, true
+}
+
+// PurgeCache deletes the selected results from all the cache tiers of the node, and broadcasts the purge to the other nodes
+func (a agentService) PurgeCache(ctx context.Context, purge CachePurge) (CachePurged, error) {
+	tiers, names := []cache.ResultCache{a.cache}, []string{a.config.CacheBackend}
+	if a.l2 != nil {
+		tiers, names = append(tiers, a.l2), append(names, "redis")
+	}
+
+	n, err := a.purge(ctx, purge, tiers)
+	if common.IsHTTPErrors(err) {
+		return CachePurged{}, err
+	}
+	return CachePurged{Purged: n, Tiers: names, Broadcast: a.purges.publish(ctx, purge)}, err
+}
+
+// purge deletes the selected results from the tiers, returns the number of deleted entries
+func (a agentService) purge(ctx context.Context, purge CachePurge, tiers []cache.ResultCache) (int, error) {
+	if purge.Key != "" {
+		n := 0
+		for _, tier := range tiers {
+			if _, ok := tier.Get(ctx, purge.Key); ok {
+				n++
+			}
+			tier.Delete(ctx, purge.Key)
+		}
+		return n, nil
+	}
+
+	if purge.From != nil || purge.To != nil {
+		if purge.ChainID == 0 {
+			return 0, common.BadRequestError("chain is required to purge a block range")
+		}
+		var from, to uint64 = 0, math.MaxUint64
+		if purge.From != nil {
+			from = *purge.From
+		}
+		if purge.To != nil {
+			to = *purge.To
+		}
+		match := func(key string) bool {
+			_, method := _ParseCacheKey(key)
+			return purge.Method == "" || purge.Method == method
+		}
+
+		keys := append(a.ranges.TakeFunc(purge.ChainID, from, to, match), a.index.TakeFunc(purge.ChainID, from, to, match)...)
+		slices.Sort(keys)
+		keys = slices.Compact(keys)
+		for _, key := range keys {
+			for _, tier := range tiers {
+				tier.Delete(ctx, key)
+			}
+		}
+		a.logger.Info().Msgf("Purged %d cached results of chain %d %s from block %d to %d", len(keys), purge.ChainID, purge.Method, from, to)
+		return len(keys), nil
+	}
+
+	prefix := ""
+	if purge.ChainID != 0 {
+		prefix = _CacheKeyPrefix(purge.ChainID, purge.Method)
+	} else if purge.Method != "" {
+		return 0, common.BadRequestError("chain is required to purge a method")
+	} else if !purge.All {
+		return 0, common.BadRequestError("key, chain or all is required to purge")
+	}
+
+	n, errs := 0, []error{}
+	for _, tier := range tiers {
+		deleted, err := tier.Purge(ctx, prefix)
+		n += deleted
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	a.logger.Info().Msgf("Purged %d cached results with prefix %q", n, prefix)
+	return n, errors.Join(errs...)
+}
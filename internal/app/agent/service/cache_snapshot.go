@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/core/cache"
+)
+
+type snapshotConfig struct {
+	Enable bool
+	Path   string
+	// only the entries living longer than this are written, e.g. the results of finalized blocks
+	MinTTL time.Duration
+}
+
+// SaveCacheSnapshot writes the long-lived entries of the result cache to the snapshot file,
+// returns the number of written entries
+func (a agentService) SaveCacheSnapshot() (int, error) {
+	if !a.snapshot.Enable {
+		return 0, nil
+	}
+	c, ok := a.cache.(cache.Iterable)
+	if !ok {
+		a.logger.Warn().Msgf("Cache backend %s does not support snapshots", a.config.CacheBackend)
+		return 0, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.snapshot.Path), 0o755); err != nil {
+		return 0, err
+	}
+	// the previous snapshot is replaced only when the new one is complete
+	f, err := os.CreateTemp(filepath.Dir(a.snapshot.Path), filepath.Base(a.snapshot.Path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := cache.WriteSnapshot(f, c, func(key string, entry cache.Entry) bool {
+		return entry.TTL() >= a.snapshot.MinTTL
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), a.snapshot.Path); err != nil {
+		return 0, err
+	}
+
+	a.logger.Info().Msgf("Saved %d cached results to %s", n, a.snapshot.Path)
+	return n, nil
+}
+
+// LoadCacheSnapshot restores the entries of the snapshot file to the result cache with their remaining expiry,
+// returns the number of restored entries
+func (a agentService) LoadCacheSnapshot() (int, error) {
+	if !a.snapshot.Enable {
+		return 0, nil
+	}
+	if _, ok := a.cache.(cache.Iterable); !ok {
+		return 0, nil
+	}
+
+	f, err := os.Open(a.snapshot.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	n, err := cache.ReadSnapshot(f, func(key string, entry cache.Entry) {
+		a.cache.Set(ctx, key, entry.Value, entry.TTL())
+	})
+	if err != nil {
+		a.logger.Warn().Err(err).Msgf("Restored %d cached results from %s before the error", n, a.snapshot.Path)
+		return n, err
+	}
+
+	a.logger.Info().Msgf("Restored %d cached results from %s", n, a.snapshot.Path)
+	return n, nil
+}
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/app/shared"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/cache"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/go-redis/redismock/v9"
+	"github.com/rs/zerolog"
+)
+
+func TestPinBlockTag(t *testing.T) {
+	methods := map[string]string{"eth_call": "10m", "eth_getBalance": "10m", "eth_getLogs": "10m"}
+
+	call := rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "method": "eth_call", "params": []any{map[string]any{"to": "0x1"}}})
+	if ok, _ := _WithCache(methods, call); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+	if !_PinBlockTag(call, 100) {
+		t.Fatalf("expected %v, got %v", true, false)
+	}
+	if v := call.Params()[1]; v != "0x64" {
+		t.Errorf("expected %v, got %v", "0x64", v)
+	}
+	if ok, _ := _WithCache(methods, call); !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	}
+
+	balance := rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 2.0, "method": "eth_getBalance", "params": []any{"0x1", "pending"}})
+	if _PinBlockTag(balance, 100) {
+		t.Errorf("expected %v, got %v", false, true)
+	}
+
+	filter := map[string]any{"fromBlock": "0x10"}
+	logs := rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 3.0, "method": "eth_getLogs", "params": []any{filter}})
+	if ok, _ := _WithCache(methods, logs); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+	_PinBlockTag(logs, 100)
+	if v := logs.Params()[0].(map[string]any)["toBlock"]; v != "0x64" {
+		t.Errorf("expected %v, got %v", "0x64", v)
+	}
+	// the params of the client are not changed
+	if filter["toBlock"] != nil {
+		t.Errorf("expected %v, got %v", nil, filter["toBlock"])
+	}
+}
+
+func TestWithCacheBlockTags(t *testing.T) {
+	methods := map[string]string{"eth_call": "10m", "eth_getBalance": "10m", "eth_getBlockByNumber": "10m", "eth_getLogs": "10m"}
+	call := func(method string, params ...any) rpc.JSONRPCer {
+		return rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "method": method, "params": params})
+	}
+
+	cases := []struct {
+		name   string
+		call   rpc.JSONRPCer
+		expect bool
+	}{
+		{"block number", call("eth_getBalance", "0x1", "0x10"), true},
+		{"latest", call("eth_getBalance", "0x1", "latest"), false},
+		{"safe", call("eth_getBalance", "0x1", "safe"), false},
+		{"finalized", call("eth_call", map[string]any{"to": "0x1"}, "finalized"), false},
+		{"finalized block", call("eth_getBlockByNumber", "finalized", false), false},
+		{"block number object", call("eth_call", map[string]any{"to": "0x1"}, map[string]any{"blockNumber": "0x10"}), true},
+		{"block hash object", call("eth_call", map[string]any{"to": "0x1"}, map[string]any{"blockHash": "0xabc", "requireCanonical": true}), true},
+		{"block tag object", call("eth_call", map[string]any{"to": "0x1"}, map[string]any{"blockNumber": "latest"}), false},
+		{"empty object", call("eth_getBalance", "0x1", map[string]any{}), false},
+		{"safe logs", call("eth_getLogs", map[string]any{"fromBlock": "0x1", "toBlock": "safe"}), false},
+	}
+
+	for _, c := range cases {
+		if ok, _ := _WithCache(methods, c.call); ok != c.expect {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expect, ok)
+		}
+	}
+
+	if from, to, ok := _BlockRange(call("eth_call", map[string]any{"to": "0x1"}, map[string]any{"blockNumber": "0x10"}), nil); !ok || from != 16 || to != 16 {
+		t.Errorf("expected %v, got %v %v %v", 16, from, to, ok)
+	}
+}
+
+func TestSetNegative(t *testing.T) {
+	ctx := context.Background()
+	chain := &fakeChain{}
+	heads := newTestHeadService(chain)
+	heads.update(ctx, heads.chain(1), nil, chain.block(100))
+
+	a := agentService{
+		cache:     cache.NewMemory(1024*1024, 1, time.Minute),
+		negatives: cache.NewIndex(),
+		heads:     heads,
+		config:    &agentServiceConfig{MaxEntryCacheSize: 1024},
+	}
+
+	block := func(n string) rpc.JSONRPCer {
+		return rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "method": "eth_getBlockByNumber", "params": []any{n, false}})
+	}
+	receipt := rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 2.0, "method": "eth_getTransactionReceipt", "params": []any{"0x01"}})
+
+	a.setNegative(ctx, 1, block("0x69"), time.Second)
+	a.setNegative(ctx, 1, receipt, time.Second)
+	// the null result of a known block is of a lagging endpoint
+	a.setNegative(ctx, 1, block("0x63"), time.Second)
+
+	if _, ok := a.cache.Get(ctx, _CacheKey(nil, 1, block("0x69"))); !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	}
+	if _, ok := a.cache.Get(ctx, _CacheKey(nil, 1, block("0x63"))); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+
+	// the receipt is retried at the next block, the block when the head reaches it
+	if keys := a.negatives.Take(1, 0, 101); len(keys) != 1 || keys[0] != _CacheKey(nil, 1, receipt) {
+		t.Errorf("expected %v, got %v", []string{_CacheKey(nil, 1, receipt)}, keys)
+	}
+	if n := a.negatives.Len(1); n != 1 {
+		t.Errorf("expected %d, got %d", 1, n)
+	}
+}
+
+func TestPurgeCacheSelector(t *testing.T) {
+	ctx := context.Background()
+	a := agentService{
+		cache:  cache.NewMemory(1024*1024, 1, time.Minute),
+		config: &agentServiceConfig{},
+	}
+	key := _CacheKey(nil, 1, rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "method": "eth_chainId"}))
+	a.cache.Set(ctx, key, []byte(`"0x1"`), time.Minute)
+
+	// nothing is purged without a selector
+	if _, err := a.PurgeCache(ctx, CachePurge{}); err == nil {
+		t.Errorf("expected %v, got %v", "an error", err)
+	}
+	if _, ok := a.cache.Get(ctx, key); !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	}
+
+	if purged, err := a.PurgeCache(ctx, CachePurge{All: true}); err != nil || purged.Purged != 1 || purged.Broadcast {
+		t.Errorf("expected %v, got %v %v", 1, purged, err)
+	}
+	if _, ok := a.cache.Get(ctx, key); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+}
+
+func TestGetCacheSecondTier(t *testing.T) {
+	ctx := context.Background()
+	a := agentService{
+		cache:  cache.NewMemory(1024*1024, 1, time.Minute),
+		l2:     cache.NewMemory(1024*1024, 1, time.Minute),
+		index:  cache.NewIndex(),
+		ranges: cache.NewIndex(),
+		config: &agentServiceConfig{CacheBackend: "memory"},
+	}
+	rc := newTenantReqctx(t, map[string]any{})
+	call := func(id float64, address string) rpc.JSONRPCer {
+		return rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": id, "method": "eth_getCode", "params": []any{address, "0x1"}})
+	}
+	// eventually waits for the tiers updated in the background
+	eventually := func(f func() bool) bool {
+		for i := 0; i < 100 && !f(); i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return f()
+	}
+
+	valid, corrupt := call(1, "0x01"), call(2, "0x02")
+	validKey, corruptKey := _CacheKey(nil, 1, valid), _CacheKey(nil, 1, corrupt)
+	value, _ := _EncodeResult([]byte(`"0x60"`), 1024)
+	a.l2.Set(ctx, validKey, value, time.Minute)
+	a.l2.Set(ctx, corruptKey, []byte{0xff, 'x'}, time.Minute)
+
+	if v, status, ok := a.getCache(ctx, rc, nil, valid); !ok || v != "0x60" || status != "redis" {
+		t.Errorf("expected %v, got %v %v %v", "0x60", v, status, ok)
+	}
+	if !eventually(func() bool { _, ok := a.cache.Get(ctx, validKey); return ok }) {
+		t.Errorf("expected %v, got %v", "the first tier filled", false)
+	}
+
+	if _, _, ok := a.getCache(ctx, rc, nil, corrupt); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+	if !eventually(func() bool { _, ok := a.l2.Get(ctx, corruptKey); return !ok }) {
+		t.Errorf("expected %v, got %v", "the corrupt entry deleted from the second tier", true)
+	}
+	if _, ok := a.cache.Get(ctx, corruptKey); ok {
+		t.Errorf("expected %v, got %v", "the corrupt entry not filled in the first tier", ok)
+	}
+}
+
+func TestPurgeCacheBroadcast(t *testing.T) {
+	ctx := context.Background()
+	rdb, mock := redismock.NewClientMock()
+	a := agentService{
+		logger: zerolog.Nop(),
+		cache:  cache.NewMemory(1024*1024, 1, time.Minute),
+		index:  cache.NewIndex(),
+		ranges: cache.NewIndex(),
+		config: &agentServiceConfig{CacheBackend: "memory"},
+		purges: &purges{logger: zerolog.Nop(), redis: &shared.RedisClient{Client: rdb}, channel: "test:purges", node: "a"},
+	}
+	key := _CacheKey(nil, 1, rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "method": "eth_chainId"}))
+
+	mock.ExpectPublish("test:purges", []byte(`{"node":"a","purge":{"chainId":1}}`)).SetVal(1)
+	purged, err := a.PurgeCache(ctx, CachePurge{ChainID: 1})
+	if err != nil || !purged.Broadcast || len(purged.Tiers) != 1 || purged.Tiers[0] != "memory" {
+		t.Errorf("expected %v, got %v %v", "the broadcast purge of the memory tier", purged, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// the purges of the node itself are not applied again
+	a.cache.Set(ctx, key, []byte(`"0x1"`), time.Minute)
+	a.applyPurge(ctx, []byte(`{"node":"a","purge":{"chainId":1}}`))
+	if _, ok := a.cache.Get(ctx, key); !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	}
+	a.applyPurge(ctx, []byte(`{"node":"b","purge":{"chainId":1}}`))
+	if _, ok := a.cache.Get(ctx, key); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+}
+
+func TestCacheKeyDefaultConfig(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir("../../../.."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	conf := shared.NewConfInstance(nil)
+	b, _ := conf.Get("jsonrpc.schema").([]byte)
+	schema := rpc.NewJSONRPCSchema(b, conf.Bool("jsonrpc.enable_validation", false))
+
+	call := func(params ...any) rpc.JSONRPCer {
+		return rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "method": "eth_getBalance", "params": params})
+	}
+	expected := _CacheKey(schema, 1, call("0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0x1"))
+	for _, c := range []rpc.JSONRPCer{
+		call("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", "0x1"),
+		call("0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0x01"),
+	} {
+		if got := _CacheKey(schema, 1, c); got != expected {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+	}
+
+	// the requests are not validated by default
+	if err := schema.ValidateRequest("eth_getBalance", map[string]any{"jsonrpc": "2.0", "method": "eth_getBalance"}); err != nil {
+		t.Errorf("expected %v, got %v", nil, err)
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/utils/config"
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/rs/zerolog"
+)
+
+const (
+	EventHead   = "head"
+	EventReorg  = "reorg"
+	EventHealth = "health"
+)
+
+// Event is an event of the feed of a chain, the ids of a chain increase one by one from the start time of the feed
+// in milliseconds, the ids of a feed before a restart are lower than them
+type Event struct {
+	ID   uint64
+	Type string
+	Data any
+}
+
+// HealthEvent is emitted when the health of an endpoint changes, the url is not exposed as it may hold credentials
+type HealthEvent struct {
+	ChainID     common.ChainId `json:"chain_id"`
+	Endpoint    string         `json:"endpoint"`
+	Host        string         `json:"host"`
+	Health      bool           `json:"health"`
+	BlockNumber uint64         `json:"block_number"`
+}
+
+type EventService interface {
+	// Listen returns the buffered events of the chain after the last id, and the channel of the next events,
+	// the channel is closed when the listener falls behind or cancel is called
+	Listen(chainId common.ChainId, lastId uint64) (missed []Event, c <-chan Event, cancel func())
+}
+
+type eventServiceConfig struct {
+	// events buffered by chain for the listeners resuming after the last id
+	Buffer int
+	// interval of checking the health of the endpoints
+	HealthInterval time.Duration
+}
+
+type eventService struct {
+	logger          zerolog.Logger
+	endpointService EndpointService
+	config          eventServiceConfig
+
+	mu sync.RWMutex
+	// feeds are started by the first listener of a chain, and kept for the listeners resuming later
+	feeds map[common.ChainId]*eventFeed
+}
+
+func NewEventService(logger zerolog.Logger, config *config.Conf, endpointService EndpointService, heads HeadService) EventService {
+	service := &eventService{
+		logger:          logger.With().Str("name", "event_service").Logger(),
+		endpointService: endpointService,
+		config: eventServiceConfig{
+			Buffer:         max(config.Int("events.buffer", 256), 1),
+			HealthInterval: max(config.Duration("events.health_interval", 5*time.Second), time.Second),
+		},
+		feeds: map[common.ChainId]*eventFeed{},
+	}
+	heads.OnHead(func(head Head) {
+		service.publish(head.ChainID, EventHead, head)
+	})
+	heads.OnReorg(func(reorg ReorgEvent) {
+		service.publish(reorg.ChainID, EventReorg, reorg)
+	})
+
+	return service
+}
+
+func (s *eventService) Listen(chainId common.ChainId, lastId uint64) ([]Event, <-chan Event, func()) {
+	s.mu.Lock()
+	feed, ok := s.feeds[chainId]
+	if !ok {
+		feed = newEventFeed(s.config.Buffer)
+		s.feeds[chainId] = feed
+		go s.watchHealth(chainId, feed)
+	}
+	s.mu.Unlock()
+
+	return feed.subscribe(lastId)
+}
+
+func (s *eventService) publish(chainId common.ChainId, kind string, data any) {
+	s.mu.RLock()
+	feed, ok := s.feeds[chainId]
+	s.mu.RUnlock()
+	if ok {
+		feed.publish(kind, data)
+	}
+}
+
+// watchHealth publishes the changes of the health of the endpoints of the chain
+func (s *eventService) watchHealth(chainId common.ChainId, feed *eventFeed) {
+	ticker := time.NewTicker(s.config.HealthInterval)
+	defer ticker.Stop()
+
+	known := map[string]bool{}
+	for ; ; <-ticker.C {
+		endpoints, _ := s.endpointService.GetAll(chainId)
+		for _, e := range endpoints {
+			u := e.Url()
+			if u == nil {
+				continue
+			}
+			id, health := helpers.Short(u.String()), e.Health()
+			if h, ok := known[id]; ok && h == health {
+				continue
+			}
+			// the first check only records the health
+			if _, ok := known[id]; ok {
+				feed.publish(EventHealth, HealthEvent{
+					ChainID:     chainId,
+					Endpoint:    id,
+					Host:        _EventHost(u),
+					Health:      health,
+					BlockNumber: e.BlockNumber(),
+				})
+			}
+			known[id] = health
+		}
+	}
+}
+
+func _EventHost(u *url.URL) string {
+	return u.Scheme + "://" + u.Hostname()
+}
+
+// eventFeed is a ring buffer of the events of a chain and its listeners
+type eventFeed struct {
+	mu   sync.Mutex
+	ring []Event
+	// ids of the feed are from start to next-1
+	start uint64
+	next  uint64
+
+	listeners map[chan Event]struct{}
+}
+
+func newEventFeed(size int) *eventFeed {
+	start := uint64(time.Now().UnixMilli())
+	return &eventFeed{
+		ring:      make([]Event, size),
+		start:     start,
+		next:      start,
+		listeners: map[chan Event]struct{}{},
+	}
+}
+
+func (f *eventFeed) publish(kind string, data any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	event := Event{ID: f.next, Type: kind, Data: data}
+	f.ring[f.next%uint64(len(f.ring))] = event
+	f.next++
+
+	for c := range f.listeners {
+		select {
+		case c <- event:
+		default:
+			// the listener resumes by the last id it has received
+			delete(f.listeners, c)
+			close(c)
+		}
+	}
+}
+
+// subscribe returns the buffered events after the last id, the events dropped from the buffer are skipped,
+// an unknown last id replays nothing, e.g. an id of the feed before a restart
+func (f *eventFeed) subscribe(lastId uint64) ([]Event, <-chan Event, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	missed := []Event{}
+	if lastId+1 >= f.start && lastId < f.next {
+		first := f.next - min(f.next-f.start, uint64(len(f.ring)))
+		for id := max(lastId+1, first); id < f.next; id++ {
+			missed = append(missed, f.ring[id%uint64(len(f.ring))])
+		}
+	}
+
+	c := make(chan Event, len(f.ring))
+	f.listeners[c] = struct{}{}
+	cancel := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.listeners[c]; ok {
+			delete(f.listeners, c)
+			close(c)
+		}
+	}
+	return missed, c, cancel
+}
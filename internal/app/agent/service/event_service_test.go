@@ -0,0 +1,68 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestEventFeed(t *testing.T) {
+	feed := newEventFeed(4)
+	start := feed.start
+	for i := 0; i < 6; i++ {
+		feed.publish(EventHead, i)
+	}
+
+	// the events after the last id which are still buffered
+	for _, c := range []struct {
+		lastId   uint64
+		expected []any
+	}{
+		{start + 3, []any{4, 5}},
+		{start, []any{2, 3, 4, 5}},
+		{start - 1, []any{2, 3, 4, 5}},
+		{start + 5, []any{}},
+		{start - 2, []any{}},
+		{0, []any{}},
+		{start + 100, []any{}},
+	} {
+		missed, _, cancel := feed.subscribe(c.lastId)
+		cancel()
+		if len(missed) != len(c.expected) {
+			t.Errorf("expected %v, got %v", c.expected, missed)
+			continue
+		}
+		for i := range missed {
+			if missed[i].Data != c.expected[i] {
+				t.Errorf("expected %v, got %v", c.expected[i], missed[i].Data)
+			}
+		}
+	}
+
+	_, events, cancel := feed.subscribe(0)
+	defer cancel()
+	feed.publish(EventReorg, "reorg")
+	if event := <-events; event.Type != EventReorg || event.ID != start+6 {
+		t.Errorf("expected %v %v, got %v %v", EventReorg, start+6, event.Type, event.ID)
+	}
+
+	// a listener falling behind is closed
+	for i := 0; i <= 4; i++ {
+		feed.publish(EventHead, i)
+	}
+	n := 0
+	for range events {
+		n++
+	}
+	if n != 4 {
+		t.Errorf("expected %v, got %v", 4, n)
+	}
+}
+
+func TestEventServiceConfig(t *testing.T) {
+	s := NewEventService(zerolog.Nop(), newConfig(map[string]any{"events": map[string]any{"health_interval": "0s"}}), nil, newTestHeadService(&fakeChain{})).(*eventService)
+	if s.config.HealthInterval < time.Second {
+		t.Errorf("expected at least %v, got %v", time.Second, s.config.HealthInterval)
+	}
+}
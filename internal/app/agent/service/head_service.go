@@ -0,0 +1,462 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/endpoint"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/utils"
+	"github.com/GoPlugin/web3rpcproxy/utils/config"
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/rs/zerolog"
+)
+
+// Head is a block header tracked by the head service
+type Head struct {
+	ChainID    common.ChainId `json:"chain_id"`
+	Number     uint64         `json:"number"`
+	Hash       string         `json:"hash"`
+	ParentHash string         `json:"parent_hash"`
+	Timestamp  uint64         `json:"timestamp"`
+}
+
+// ReorgEvent is emitted when the canonical blocks from From to To are replaced
+type ReorgEvent struct {
+	ChainID common.ChainId `json:"chain_id"`
+	From    uint64         `json:"from"`
+	To      uint64         `json:"to"`
+	Depth   uint64         `json:"depth"`
+	OldHash string         `json:"old_hash"`
+	NewHash string         `json:"new_hash"`
+}
+
+type HeadService interface {
+	Init()
+	// Head returns the latest canonical head of the chain
+	Head(chainId common.ChainId) (Head, bool)
+	// Hash returns the canonical hash of the block, only recent blocks are tracked
+	Hash(chainId common.ChainId, number uint64) (string, bool)
+	// Observe checks a block seen in a result against the canonical hashes, a conflict triggers a poll
+	Observe(chainId common.ChainId, number uint64, hash string)
+	// Finalized returns the highest finalized block number of the chain
+	Finalized(chainId common.ChainId) (uint64, bool)
+	// Safe returns the highest safe block number of the chain
+	Safe(chainId common.ChainId) (uint64, bool)
+	OnHead(fn func(Head))
+	OnReorg(fn func(ReorgEvent))
+}
+
+var errBlockUnavailable = errors.New("unavailable block")
+
+type headServiceConfig struct {
+	Disable  bool
+	Interval time.Duration
+	Timeout  time.Duration
+	// number of recent blocks whose hashes are tracked, reorgs deeper than this are not detected
+	Depth uint64
+	// interval of polling the finalized and safe blocks
+	FinalityInterval time.Duration
+}
+
+type chainHeads struct {
+	mu      sync.RWMutex
+	head    Head
+	hashes  map[uint64]string
+	polling bool
+
+	finalized  uint64
+	safe       uint64
+	finalityAt time.Time
+	// the chain does not support the finalized and safe tags
+	unfinalizable bool
+}
+
+type headService struct {
+	logger          zerolog.Logger
+	conf            *config.Conf
+	endpointService EndpointService
+	ecf             *endpoint.ClientFactory
+	config          headServiceConfig
+	// fetch gets the header of the block by number or tag
+	fetch func(ctx context.Context, e *endpoint.Endpoint, block any) (Head, error)
+
+	mu       sync.RWMutex
+	chains   map[common.ChainId]*chainHeads
+	onHead   []func(Head)
+	onReorg  []func(ReorgEvent)
+	triggers chan common.ChainId
+}
+
+func NewHeadService(logger zerolog.Logger, config *config.Conf, endpointService EndpointService, ecf *endpoint.ClientFactory) HeadService {
+	service := &headService{
+		logger:          logger.With().Str("name", "head_service").Logger(),
+		conf:            config,
+		endpointService: endpointService,
+		ecf:             ecf,
+		config: headServiceConfig{
+			Disable:  config.Bool("heads.disable", false),
+			Interval: config.Duration("heads.interval", 3*time.Second),
+			Timeout:  config.Duration("heads.timeout", 5*time.Second),
+			Depth:    uint64(config.Int("heads.depth", 64)),
+
+			FinalityInterval: config.Duration("heads.finality_interval", 30*time.Second),
+		},
+		chains:   map[common.ChainId]*chainHeads{},
+		triggers: make(chan common.ChainId, 16),
+	}
+	service.fetch = service.getBlock
+
+	return service
+}
+
+func (s *headService) Init() {
+	if s.config.Disable {
+		s.logger.Warn().Msg("Head tracking is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(s.config.Interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				for _, chainId := range s.endpointService.Chains() {
+					go s.poll(chainId)
+				}
+			case chainId := <-s.triggers:
+				go s.poll(chainId)
+			}
+		}
+	}()
+}
+
+func (s *headService) chain(chainId common.ChainId) *chainHeads {
+	s.mu.RLock()
+	c, ok := s.chains[chainId]
+	s.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok = s.chains[chainId]; !ok {
+		c = &chainHeads{hashes: map[uint64]string{}}
+		s.chains[chainId] = c
+	}
+	return c
+}
+
+func (s *headService) Head(chainId common.ChainId) (Head, bool) {
+	s.mu.RLock()
+	c, ok := s.chains[chainId]
+	s.mu.RUnlock()
+	if !ok {
+		return Head{}, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.head, c.head.Number > 0
+}
+
+func (s *headService) Hash(chainId common.ChainId, number uint64) (string, bool) {
+	s.mu.RLock()
+	c, ok := s.chains[chainId]
+	s.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	hash, ok := c.hashes[number]
+	return hash, ok
+}
+
+func (s *headService) Finalized(chainId common.ChainId) (uint64, bool) {
+	return s.finality(chainId, func(c *chainHeads) uint64 { return c.finalized })
+}
+
+func (s *headService) Safe(chainId common.ChainId) (uint64, bool) {
+	return s.finality(chainId, func(c *chainHeads) uint64 { return c.safe })
+}
+
+// finality returns the block number of the tag, or the head minus the confirmations of the chain config
+func (s *headService) finality(chainId common.ChainId, tag func(c *chainHeads) uint64) (uint64, bool) {
+	s.mu.RLock()
+	c, ok := s.chains[chainId]
+	s.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+
+	c.mu.RLock()
+	n, head, unfinalizable := tag(c), c.head.Number, c.unfinalizable
+	c.mu.RUnlock()
+
+	if !unfinalizable && n > 0 {
+		return n, true
+	}
+	if confirmations := s.confirmations(chainId); confirmations > 0 && head > confirmations {
+		return head - confirmations, true
+	}
+	return 0, false
+}
+
+func (s *headService) confirmations(chainId common.ChainId) uint64 {
+	if s.conf == nil {
+		return 0
+	}
+	if v, ok := s.conf.Get(helpers.Concat("chains.", strconv.FormatUint(chainId, 10))).(common.EndpointChain); ok {
+		return v.Confirmations
+	}
+	return 0
+}
+
+func (s *headService) Observe(chainId common.ChainId, number uint64, hash string) {
+	if s.config.Disable || hash == "" {
+		return
+	}
+	if known, ok := s.Hash(chainId, number); ok && known != hash {
+		select {
+		case s.triggers <- chainId:
+		default:
+		}
+	}
+}
+
+func (s *headService) OnHead(fn func(Head)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onHead = append(s.onHead, fn)
+}
+
+func (s *headService) OnReorg(fn func(ReorgEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onReorg = append(s.onReorg, fn)
+}
+
+// source returns the healthy endpoint with the highest block number
+func (s *headService) source(chainId common.ChainId) (*endpoint.Endpoint, bool) {
+	endpoints, ok := s.endpointService.GetAll(chainId)
+	if !ok {
+		return nil, false
+	}
+
+	healthy := []*endpoint.Endpoint{}
+	for i := range endpoints {
+		if endpoints[i].Health() {
+			healthy = append(healthy, endpoints[i])
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = endpoints
+	}
+
+	return slices.MaxFunc(healthy, func(a, b *endpoint.Endpoint) int {
+		return int(a.BlockNumber()) - int(b.BlockNumber())
+	}), true
+}
+
+func (s *headService) getBlock(ctx context.Context, e *endpoint.Endpoint, block any) (Head, error) {
+	client := s.ecf.GetClient(e)
+	if client == nil {
+		return Head{}, errors.New("no available client")
+	}
+
+	results, err := client.Call(ctx, []rpc.SealedJSONRPC{{
+		Version: rpc.JSONRPC_VERSION_2,
+		ID:      "1",
+		Method:  "eth_getBlockByNumber",
+		Params:  []any{block, false},
+	}})
+	if err != nil {
+		return Head{}, err
+	}
+	if len(results) == 0 {
+		return Head{}, fmt.Errorf("failed to get block %v", block)
+	}
+	if results[0].Error() != nil {
+		return Head{}, fmt.Errorf("%w %v: %v", errBlockUnavailable, block, results[0].Error())
+	}
+
+	v, ok := results[0].Result().(map[string]any)
+	if !ok {
+		return Head{}, fmt.Errorf("%w %v: not found", errBlockUnavailable, block)
+	}
+	head := Head{ChainID: e.ChainID()}
+	head.Number, _ = helpers.DecodeQuantity(v["number"])
+	head.Timestamp, _ = helpers.DecodeQuantity(v["timestamp"])
+	head.Hash, _ = v["hash"].(string)
+	head.ParentHash, _ = v["parentHash"].(string)
+	if head.Hash == "" {
+		return Head{}, fmt.Errorf("invalid block %v", block)
+	}
+	return head, nil
+}
+
+func (s *headService) poll(chainId common.ChainId) {
+	c := s.chain(chainId)
+	c.mu.Lock()
+	if c.polling {
+		c.mu.Unlock()
+		return
+	}
+	c.polling = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.polling = false
+		c.mu.Unlock()
+
+		if err := recover(); err != nil {
+			s.logger.Error().Interface("error", err).Msgf("Failed to poll head of %d", chainId)
+		}
+	}()
+
+	e, ok := s.source(chainId)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancel()
+
+	head, err := s.fetch(ctx, e, "latest")
+	if err != nil {
+		s.logger.Debug().Err(err).Msgf("Failed to get head of %d", chainId)
+		return
+	}
+	e.Update(endpoint.WithAttr(endpoint.BlockNumber, head.Number))
+
+	s.update(ctx, c, e, head)
+
+	c.mu.RLock()
+	due := !c.unfinalizable && time.Since(c.finalityAt) >= s.config.FinalityInterval
+	c.mu.RUnlock()
+	if due {
+		s.updateFinality(ctx, c, e)
+	}
+}
+
+// updateFinality polls the finalized and safe blocks, chains without the tags fall back to the confirmations
+func (s *headService) updateFinality(ctx context.Context, c *chainHeads, e *endpoint.Endpoint) {
+	finalized, err := s.fetch(ctx, e, "finalized")
+	if err != nil {
+		c.mu.Lock()
+		c.finalityAt = time.Now()
+		// only an answer of the endpoint means the tag is not supported, a failed request is retried later
+		if errors.Is(err, errBlockUnavailable) {
+			c.unfinalizable = true
+			s.logger.Info().Msgf("Chain %d does not support the finalized tag, fallback to confirmations", e.ChainID())
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	safe, err := s.fetch(ctx, e, "safe")
+	if err != nil {
+		safe = finalized
+	}
+
+	c.mu.Lock()
+	c.finalized = max(c.finalized, finalized.Number)
+	c.safe = max(c.safe, safe.Number, c.finalized)
+	c.finalityAt = time.Now()
+	c.mu.Unlock()
+}
+
+// update applies the new head, the replaced blocks are walked back by the parent hashes
+func (s *headService) update(ctx context.Context, c *chainHeads, e *endpoint.Endpoint, head Head) {
+	c.mu.RLock()
+	prev, known := c.head, c.hashes[head.Number]
+	c.mu.RUnlock()
+
+	// unchanged, or a lagging endpoint on the canonical chain
+	if known == head.Hash || (head.Number < prev.Number && known == "") {
+		return
+	}
+
+	var (
+		replaced = map[uint64]string{head.Number: head.Hash}
+		reorg    *ReorgEvent
+		number   = head.Number
+		parent   = head.ParentHash
+	)
+	if known != "" {
+		reorg = &ReorgEvent{From: head.Number, OldHash: known, NewHash: head.Hash}
+	}
+
+	for number > 0 && head.Number-number < s.config.Depth {
+		c.mu.RLock()
+		old, ok := c.hashes[number-1]
+		c.mu.RUnlock()
+		if ok && old == parent {
+			break
+		}
+		// fill the blocks skipped since the previous head, older blocks are not tracked
+		if !ok && (prev.Number == 0 || number-1 <= prev.Number) {
+			break
+		}
+
+		block, err := s.fetch(ctx, e, helpers.EncodeQuantity(number-1))
+		if err != nil {
+			s.logger.Warn().Err(err).Msgf("Failed to walk back the reorg of %d", head.ChainID)
+			break
+		}
+		number, parent = block.Number, block.ParentHash
+		replaced[number] = block.Hash
+		if ok {
+			reorg = &ReorgEvent{From: number, OldHash: old, NewHash: block.Hash}
+		}
+	}
+
+	c.mu.Lock()
+	for n, hash := range replaced {
+		c.hashes[n] = hash
+	}
+	if reorg != nil || head.Number >= prev.Number {
+		// the blocks above the new head are gone after a reorg to a shorter chain
+		for n := head.Number + 1; n <= prev.Number; n++ {
+			delete(c.hashes, n)
+		}
+		c.head = head
+	}
+	for n := range c.hashes {
+		if n+s.config.Depth < head.Number {
+			delete(c.hashes, n)
+		}
+	}
+	c.mu.Unlock()
+
+	s.mu.RLock()
+	onHead, onReorg := s.onHead, s.onReorg
+	s.mu.RUnlock()
+
+	if reorg != nil {
+		reorg.ChainID = head.ChainID
+		reorg.To = max(head.Number, prev.Number)
+		reorg.Depth = reorg.To - reorg.From + 1
+		utils.TotalReorgs.WithLabelValues(fmt.Sprint(head.ChainID)).Inc()
+		s.logger.Warn().Any("reorg", reorg).Msgf("Chain %d reorganized from block %d", head.ChainID, reorg.From)
+		for _, fn := range onReorg {
+			fn(*reorg)
+		}
+	}
+
+	if head.Number > prev.Number || reorg != nil {
+		for _, fn := range onHead {
+			fn(head)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/endpoint"
+	"github.com/GoPlugin/web3rpcproxy/utils/config"
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/knadh/koanf/v2"
+	"github.com/rs/zerolog"
+)
+
+// fakeChain serves the blocks of a chain by number, the fork suffix changes the hashes above a height
+type fakeChain struct {
+	fork     string
+	forkFrom uint64
+}
+
+func (c *fakeChain) block(n uint64) Head {
+	hash := func(n uint64) string {
+		if c.fork != "" && n >= c.forkFrom {
+			return fmt.Sprintf("0x%d%s", n, c.fork)
+		}
+		return fmt.Sprintf("0x%d", n)
+	}
+	return Head{ChainID: 1, Number: n, Hash: hash(n), ParentHash: hash(n - 1)}
+}
+
+func newTestHeadService(chain *fakeChain) *headService {
+	s := &headService{
+		logger: zerolog.Nop(),
+		config: headServiceConfig{Depth: 8},
+		chains: map[uint64]*chainHeads{},
+	}
+	s.fetch = func(ctx context.Context, e *endpoint.Endpoint, block any) (Head, error) {
+		n, _ := helpers.DecodeQuantity(block)
+		return chain.block(n), nil
+	}
+	return s
+}
+
+func TestHeadServiceReorg(t *testing.T) {
+	chain := &fakeChain{}
+	s := newTestHeadService(chain)
+	c := s.chain(1)
+
+	events := []ReorgEvent{}
+	s.OnReorg(func(e ReorgEvent) { events = append(events, e) })
+
+	s.update(context.Background(), c, nil, chain.block(100))
+	// skipped blocks are filled
+	s.update(context.Background(), c, nil, chain.block(103))
+	if hash, ok := s.Hash(1, 101); !ok || hash != "0x101" {
+		t.Errorf("expected %s, got %s", "0x101", hash)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no reorg, got %v", events)
+	}
+
+	// blocks from 102 are replaced
+	chain.fork, chain.forkFrom = "f", 102
+	s.update(context.Background(), c, nil, chain.block(104))
+
+	if len(events) != 1 {
+		t.Fatalf("expected %d reorg, got %d", 1, len(events))
+	}
+	if events[0].From != 102 || events[0].To != 104 || events[0].OldHash != "0x102" || events[0].NewHash != "0x102f" {
+		t.Errorf("unexpected reorg %+v", events[0])
+	}
+	if head, _ := s.Head(1); head.Hash != "0x104f" {
+		t.Errorf("expected %s, got %s", "0x104f", head.Hash)
+	}
+	if hash, _ := s.Hash(1, 103); hash != "0x103f" {
+		t.Errorf("expected %s, got %s", "0x103f", hash)
+	}
+
+	// a lagging endpoint on the canonical chain is not a reorg
+	s.update(context.Background(), c, nil, chain.block(103))
+	if head, _ := s.Head(1); head.Number != 104 || len(events) != 1 {
+		t.Errorf("expected head %d without reorg, got %d with %d reorgs", 104, head.Number, len(events))
+	}
+}
+
+func TestHeadServiceFinality(t *testing.T) {
+	chain := &fakeChain{}
+	s := newTestHeadService(chain)
+	s.conf = &config.Conf{Koanf: koanf.New(".")}
+	s.conf.Set("chains.1", common.EndpointChain{ChainID: 1, Confirmations: 12})
+	c := s.chain(1)
+
+	if _, ok := s.Finalized(1); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+
+	// the confirmations are used until the finalized block is polled
+	s.update(context.Background(), c, nil, chain.block(100))
+	if n, _ := s.Finalized(1); n != 88 {
+		t.Errorf("expected %d, got %d", 88, n)
+	}
+
+	c.finalized, c.safe = 64, 96
+	if n, _ := s.Finalized(1); n != 64 {
+		t.Errorf("expected %d, got %d", 64, n)
+	}
+	if n, _ := s.Safe(1); n != 96 {
+		t.Errorf("expected %d, got %d", 96, n)
+	}
+
+	// chains without the finalized tag fall back to the confirmations
+	c.unfinalizable = true
+	if n, _ := s.Finalized(1); n != 88 {
+		t.Errorf("expected %d, got %d", 88, n)
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/reqctx"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/tx"
+)
+
+// _ContractAddresses returns the contract addresses targeted by the call, ok is false when the method is not restricted
+func _ContractAddresses(jsonrpc rpc.JSONRPCer, transaction *tx.Transaction) (addresses []string, ok bool) {
+	params := jsonrpc.Params()
+
+	switch jsonrpc.Method() {
+	case "eth_call", "eth_estimateGas":
+		if len(params) > 0 {
+			if param, ok := params[0].(map[string]any); ok {
+				if to, ok := param["to"].(string); ok && to != "" {
+					return []string{to}, true
+				}
+			}
+		}
+		return []string{}, true
+	case "eth_getLogs":
+		if len(params) > 0 {
+			return _FilterAddresses(params[0]), true
+		}
+		return []string{}, true
+	case "eth_subscribe":
+		// only the logs subscriptions target contracts, they are restricted like eth_getLogs
+		if len(params) > 0 && params[0] == "logs" {
+			if len(params) > 1 {
+				return _FilterAddresses(params[1]), true
+			}
+			return []string{}, true
+		}
+		return nil, false
+	case "eth_sendRawTransaction":
+		if transaction != nil && transaction.To != "" {
+			return []string{transaction.To}, true
+		}
+		return []string{}, true
+	}
+
+	return nil, false
+}
+
+// _FilterAddresses returns the addresses of a logs filter, an empty list if the filter has none
+func _FilterAddresses(filter any) []string {
+	addresses := []string{}
+	if param, ok := filter.(map[string]any); ok {
+		switch address := param["address"].(type) {
+		case string:
+			addresses = append(addresses, address)
+		case []any:
+			for i := range address {
+				addresses = append(addresses, fmt.Sprint(address[i]))
+			}
+		}
+	}
+	return addresses
+}
+
+// interceptMethod checks the method against the tenant preferences, before anything else of the call is looked at
+func interceptMethod(rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer) error {
+	if allows := rc.Options().AllowMethods(); allows != nil && !rpc.MatchAny(allows, jsonrpc.Method()) {
+		return common.NewJSONRPCError(common.JSONRPCIntercepted, fmt.Sprintf("method %s is not allowed", jsonrpc.Method()))
+	}
+	return nil
+}
+
+// intercept checks the targets of the call against the tenant preferences
+func intercept(rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer, transaction *tx.Transaction) error {
+	if allows := rc.Options().AllowContractAddresses(); allows != nil {
+		addresses, ok := _ContractAddresses(jsonrpc, transaction)
+		if ok && len(addresses) == 0 {
+			return common.NewJSONRPCError(common.JSONRPCIntercepted, fmt.Sprintf("%s must target an allowed contract address", jsonrpc.Method()))
+		}
+		for i := range addresses {
+			if !slices.Contains(allows, strings.ToLower(addresses[i])) {
+				return common.NewJSONRPCError(common.JSONRPCIntercepted, fmt.Sprintf("contract address %s is not allowed", addresses[i]))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/app/database/schema"
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/reqctx"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/tx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+// newTenantReqctx returns a request context of chain 1 for a tenant of the preferences
+func newTenantReqctx(t *testing.T, preferences map[string]any) reqctx.Reqctxs {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("chain", "1")
+	rc := reqctx.NewReqctx(ctx, newConfig(map[string]any{}), zerolog.Nop())
+
+	jsonb := &pgtype.JSONB{}
+	if err := jsonb.Set(preferences); err != nil {
+		t.Fatal(err)
+	}
+	rc.SetApp(&common.App{TenantInfo: schema.Tenant{Name: "test", Preferences: jsonb}})
+	return rc
+}
+
+func TestInterceptSubscribe(t *testing.T) {
+	a := agentService{
+		config:   &agentServiceConfig{},
+		firewall: rpc.NewFirewall(rpc.Policy{Deny: rpc.DefaultDenyMethods}, nil),
+	}
+	subscribe := func(params ...any) rpc.JSONRPCer {
+		return rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "method": "eth_subscribe", "params": params})
+	}
+	contract := "0x00000000000000000000000000000000000000aa"
+
+	cases := []struct {
+		name        string
+		preferences map[string]any
+		call        rpc.JSONRPCer
+		expect      bool
+	}{
+		{"no preferences", map[string]any{}, subscribe("logs", map[string]any{}), true},
+		{"logs of any contract", map[string]any{"allow_contract_addresses": []any{contract}}, subscribe("logs", map[string]any{}), false},
+		{"logs without filter", map[string]any{"allow_contract_addresses": []any{contract}}, subscribe("logs"), false},
+		{"logs of the allowed contract", map[string]any{"allow_contract_addresses": []any{contract}}, subscribe("logs", map[string]any{"address": contract}), true},
+		{"logs of another contract", map[string]any{"allow_contract_addresses": []any{contract}}, subscribe("logs", map[string]any{"address": []any{contract, "0xbb"}}), false},
+		{"newHeads under a contract allowlist", map[string]any{"allow_contract_addresses": []any{contract}}, subscribe("newHeads"), true},
+		{"method not allowed", map[string]any{"allow_methods": []any{"eth_call"}}, subscribe("newHeads"), false},
+		{"method allowed", map[string]any{"allow_methods": []any{"eth_*"}}, subscribe("newHeads"), true},
+	}
+
+	for _, c := range cases {
+		err := a.Intercept(newTenantReqctx(t, c.preferences), c.call)
+		if got := err == nil; got != c.expect {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expect, err)
+		}
+	}
+
+	firewall := agentService{
+		config:   &agentServiceConfig{},
+		firewall: rpc.NewFirewall(rpc.Policy{Deny: []string{"eth_subscribe"}}, nil),
+	}
+	if err := firewall.Intercept(newTenantReqctx(t, map[string]any{}), subscribe("newHeads")); err == nil {
+		t.Errorf("expected %v, got %v", "an error", err)
+	}
+}
+
+func TestInterceptContractAddresses(t *testing.T) {
+	contract, other := "0x00000000000000000000000000000000000000aa", "0x00000000000000000000000000000000000000bb"
+	call := func(method string, params ...any) rpc.JSONRPCer {
+		return rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "method": method, "params": params})
+	}
+	allowlist := map[string]any{"allow_contract_addresses": []any{contract}}
+
+	cases := []struct {
+		name        string
+		preferences map[string]any
+		call        rpc.JSONRPCer
+		transaction *tx.Transaction
+		expect      bool
+	}{
+		{"eth_call without allowlist", map[string]any{}, call("eth_call", map[string]any{"to": other}, "latest"), nil, true},
+		{"eth_call of the allowed contract", allowlist, call("eth_call", map[string]any{"to": contract}, "latest"), nil, true},
+		{"eth_call of the allowed contract in upper case", allowlist, call("eth_call", map[string]any{"to": strings.ToUpper(contract)}, "latest"), nil, true},
+		{"eth_call of another contract", allowlist, call("eth_call", map[string]any{"to": other}, "latest"), nil, false},
+		{"eth_call without to", allowlist, call("eth_call", map[string]any{"data": "0x00"}, "latest"), nil, false},
+		{"eth_estimateGas of another contract", allowlist, call("eth_estimateGas", map[string]any{"to": other}), nil, false},
+		{"eth_getLogs of the allowed contract", allowlist, call("eth_getLogs", map[string]any{"address": contract}), nil, true},
+		{"eth_getLogs of allowed contracts", allowlist, call("eth_getLogs", map[string]any{"address": []any{contract, contract}}), nil, true},
+		{"eth_getLogs of an array with another contract", allowlist, call("eth_getLogs", map[string]any{"address": []any{contract, other}}), nil, false},
+		{"eth_getLogs without address", allowlist, call("eth_getLogs", map[string]any{"fromBlock": "0x1"}), nil, false},
+		{"eth_getLogs without filter", allowlist, call("eth_getLogs"), nil, false},
+		{"eth_sendRawTransaction to the allowed contract", allowlist, call("eth_sendRawTransaction", "0x00"), &tx.Transaction{To: contract}, true},
+		{"eth_sendRawTransaction creating a contract", allowlist, call("eth_sendRawTransaction", "0x00"), &tx.Transaction{}, false},
+		{"unrestricted method", allowlist, call("eth_getBalance", other, "latest"), nil, true},
+		{"empty allowlist denies eth_call", map[string]any{"allow_contract_addresses": []any{}}, call("eth_call", map[string]any{"to": contract}, "latest"), nil, false},
+		{"empty allowlist denies eth_getLogs", map[string]any{"allow_contract_addresses": []any{}}, call("eth_getLogs", map[string]any{"address": contract}), nil, false},
+		{"empty allowlist keeps unrestricted methods", map[string]any{"allow_contract_addresses": []any{}}, call("eth_blockNumber"), nil, true},
+	}
+
+	for _, c := range cases {
+		err := intercept(newTenantReqctx(t, c.preferences), c.call, c.transaction)
+		if got := err == nil; got != c.expect {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expect, err)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/endpoint"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/reqctx"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/duke-git/lancet/v2/slice"
+)
+
+type logsConfig struct {
+	Disable bool
+	// number of blocks of a chunk, the chunks are aligned to multiples of the size to share the cache
+	ChunkSize   uint64
+	Concurrency int
+	// ranges of more chunks are forwarded as they are
+	MaxChunks uint64
+}
+
+// logsReqctx isolates the profile of the parallel upstream calls of a request
+type logsReqctx struct {
+	reqctx.Reqctxs
+	profile *common.QueryProfile
+}
+
+func (c logsReqctx) Profile() *common.QueryProfile {
+	return c.profile
+}
+
+// _LogsRange returns the block range of the eth_getLogs call, ok is false if the range is not concrete
+func _LogsRange(jsonrpc rpc.JSONRPCer) (filter map[string]any, from, to uint64, ok bool) {
+	if jsonrpc.Method() != "eth_getLogs" || len(jsonrpc.Params()) != 1 {
+		return nil, 0, 0, false
+	}
+	if filter, ok = jsonrpc.Params()[0].(map[string]any); !ok || filter["blockHash"] != nil {
+		return nil, 0, 0, false
+	}
+	if from, ok = helpers.DecodeQuantity(filter["fromBlock"]); !ok {
+		return nil, 0, 0, false
+	}
+	if to, ok = helpers.DecodeQuantity(filter["toBlock"]); !ok || to < from {
+		return nil, 0, 0, false
+	}
+	return filter, from, to, true
+}
+
+// _LogsChunks splits the range into chunks aligned to the multiples of the size
+func _LogsChunks(from, to, size uint64) [][2]uint64 {
+	chunks := [][2]uint64{}
+	for start := from; start <= to; {
+		end := min((start/size+1)*size-1, to)
+		chunks = append(chunks, [2]uint64{start, end})
+		if end == to {
+			break
+		}
+		start = end + 1
+	}
+	return chunks
+}
+
+var (
+	rangeErrorRegexp  = regexp.MustCompile(`(?i)(block range|range (is )?too|blocks? (are|is) not supported|range over|ranges over|requested too many blocks|limited to a|response size|more than \d+ results)`)
+	rangeNumberRegexp = regexp.MustCompile(`(?i)\b(\d[\d,]*)(k)?\b`)
+	// the numbers following these words are the limits, the others may be the blocks of the call
+	rangeLimitRegexp = regexp.MustCompile(`(?i)\b(?:max|maximum|limit|limited|up to)\b[^\d]{0,24}?\b(\d[\d,]*)(k)?\b`)
+)
+
+// minLogsRange is the lower bound of the learned limits, the smaller numbers of the messages are not taken as limits
+const minLogsRange = 10
+
+// _LogsRangeLimit recognizes the errors of the endpoints about a too wide range of eth_getLogs,
+// limit is the largest accepted range mentioned in the message, the numbers following max, limit or up to are preferred,
+// 0 if unknown
+func _LogsRangeLimit(err any) (limit uint64, ok bool) {
+	message := fmt.Sprint(err)
+	if v, _ := err.(map[string]any); v != nil {
+		message = fmt.Sprint(v["message"])
+	}
+	if !rangeErrorRegexp.MatchString(message) {
+		return 0, false
+	}
+	// the result size limits are counted in logs instead of blocks
+	if strings.Contains(strings.ToLower(message), "results") {
+		return 0, true
+	}
+
+	if limit = _SmallestRange(rangeLimitRegexp.FindAllStringSubmatch(message, -1)); limit == 0 {
+		limit = _SmallestRange(rangeNumberRegexp.FindAllStringSubmatch(message, -1))
+	}
+	return limit, true
+}
+
+func _SmallestRange(matches [][]string) (limit uint64) {
+	for _, m := range matches {
+		n, err := strconv.ParseUint(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+		if err != nil {
+			continue
+		}
+		if m[2] != "" {
+			n *= 1000
+		}
+		if n < minLogsRange {
+			continue
+		}
+		if limit == 0 || n < limit {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// chunkLogs returns whether the eth_getLogs call is fetched in chunks
+func (a agentService) chunkLogs(jsonrpc rpc.JSONRPCer) bool {
+	if a.logs.Disable {
+		return false
+	}
+	_, from, to, ok := _LogsRange(jsonrpc)
+	if !ok {
+		return false
+	}
+	n := uint64(len(_LogsChunks(from, to, a.logs.ChunkSize)))
+	return n > 1 && n <= a.logs.MaxChunks
+}
+
+// getLogs fetches the logs of the range in chunks in parallel across the endpoints,
+// the logs are merged in the order of the chunks, rpcErr is the error of the first failed chunk
+func (a agentService) getLogs(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpc rpc.JSONRPCer) (logs []any, rpcErr any, err error) {
+	filter, from, to, _ := _LogsRange(jsonrpc)
+
+	_endpoints, ok := a.es.Select(ctx, rc, endpoints, []rpc.JSONRPCer{jsonrpc})
+	if !ok || len(_endpoints) <= 0 {
+		return nil, nil, common.UnavailableError("No available endpoints")
+	}
+
+	var (
+		chunks   = _LogsChunks(from, to, a.logs.ChunkSize)
+		results  = make([][]any, len(chunks))
+		rpcErrs  = make([]any, len(chunks))
+		errs     = make([]error, len(chunks))
+		profiles = make([]*common.QueryProfile, len(chunks))
+		queue    = make(chan int)
+		wg       sync.WaitGroup
+	)
+
+	for w := 0; w < min(a.logs.Concurrency, len(chunks)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				// the chunks start at different endpoints to spread the load
+				k := i % len(_endpoints)
+				rotated := append(slices.Clone(_endpoints[k:]), _endpoints[:k]...)
+				profiles[i] = &common.QueryProfile{}
+				_rc := logsReqctx{Reqctxs: rc, profile: profiles[i]}
+				results[i], rpcErrs[i], errs[i] = a.fetchLogs(ctx, _rc, rotated, filter, chunks[i][0], chunks[i][1], 0)
+			}
+		}()
+	}
+	for i := range chunks {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	p := rc.Profile()
+	for i := range profiles {
+		p.Requests = append(p.Requests, profiles[i].Requests...)
+		p.Responses = append(p.Responses, profiles[i].Responses...)
+	}
+
+	logs = []any{}
+	for i := range chunks {
+		if errs[i] != nil {
+			return nil, nil, errs[i]
+		}
+		if rpcErrs[i] != nil {
+			return nil, rpcErrs[i], nil
+		}
+		logs = append(logs, results[i]...)
+	}
+
+	rc.Logger().Debug().Msgf("eth_getLogs %d-%d in %d chunks, %d logs", from, to, len(chunks), len(logs))
+	return logs, nil, nil
+}
+
+// fetchLogs fetches the logs of a chunk from the cache or the endpoints, the chunk is split further
+// if the endpoint rejects the range, the limit of the endpoint is learned for the next calls
+func (a agentService) fetchLogs(
+	ctx context.Context,
+	rc logsReqctx,
+	endpoints []*endpoint.Endpoint,
+	filter map[string]any,
+	from, to uint64,
+	depth int,
+) ([]any, any, error) {
+	_filter := make(map[string]any, len(filter))
+	for k, v := range filter {
+		_filter[k] = v
+	}
+	_filter["fromBlock"], _filter["toBlock"] = helpers.EncodeQuantity(from), helpers.EncodeQuantity(to)
+
+	var (
+		chainId = rc.ChainID()
+		id      = fmt.Sprintf("logs-%d-%d", from, to)
+		chunk   = rpc.NewJSONRPC(map[string]any{"jsonrpc": rpc.JSONRPC_VERSION_2, "id": id, "method": "eth_getLogs", "params": []any{_filter}})
+		span    = to - from + 1
+
+		withCache = !a.config.DisableCache && rc.Options().Caches()
+		ttl       time.Duration
+	)
+	if withCache {
+		withCache, ttl = _WithCache(a.config.CacheMethods, chunk)
+	}
+	if withCache {
+		if v, _, ok := a.getCache(ctx, rc, endpoints, chunk); ok {
+			if logs, ok := v.([]any); ok {
+				return logs, nil, nil
+			}
+		}
+	}
+
+	// endpoints known to reject the span are skipped, if all do the chunk is split by the largest known limit
+	candidates := slice.Filter(endpoints, func(_ int, e *endpoint.Endpoint) bool {
+		return e.LogsRange() == 0 || e.LogsRange() >= span
+	})
+	if len(candidates) <= 0 {
+		var limit uint64
+		for _, e := range endpoints {
+			limit = max(limit, e.LogsRange())
+		}
+		return a.splitLogs(ctx, rc, endpoints, filter, from, to, limit, depth)
+	}
+
+	results, err := a.client.Request(ctx, rc, candidates, []rpc.SealedJSONRPC{chunk.Seal()})
+	if err != nil {
+		return nil, nil, err
+	}
+	result := results[0]
+
+	if result.Error() != nil {
+		limit, ok := _LogsRangeLimit(result.Error())
+		if !ok || depth >= 8 || span <= 1 {
+			return nil, result.Error(), nil
+		}
+		if limit >= span {
+			limit = 0
+		}
+		// the last endpoint called is the one which rejected the range
+		if requests := rc.Profile().Requests; limit > 0 && len(requests) > 0 {
+			if e, ok := slice.FindBy(candidates, func(_ int, e *endpoint.Endpoint) bool {
+				return e.Url().String() == requests[len(requests)-1].Url
+			}); ok {
+				e.Update(e.With(endpoint.LogsRange, limit))
+				rc.Logger().Info().Msgf("Learned eth_getLogs range limit %d of %s", limit, e)
+			}
+		}
+		return a.splitLogs(ctx, rc, endpoints, filter, from, to, limit, depth)
+	}
+
+	logs, _ := result.Result().([]any)
+	if logs == nil {
+		logs = []any{}
+	}
+
+	// only the chunks of finalized blocks are cached, the others may still change
+	if withCache {
+		if ttl, finalized := a.expiry(chainId, to, true, ttl); finalized {
+			a.setCache(ctx, _CacheKey(a.jrpcSchema, chainId, chunk), logs, ttl)
+		}
+	}
+
+	return logs, nil, nil
+}
+
+// splitLogs fetches the range in pieces of the limit, in halves if the limit is unknown
+func (a agentService) splitLogs(
+	ctx context.Context,
+	rc logsReqctx,
+	endpoints []*endpoint.Endpoint,
+	filter map[string]any,
+	from, to, limit uint64,
+	depth int,
+) ([]any, any, error) {
+	if limit == 0 {
+		limit = max((to-from+1)/2, 1)
+	}
+
+	logs := []any{}
+	for start := from; start <= to; start += limit {
+		end := min(start+limit-1, to)
+		_logs, rpcErr, err := a.fetchLogs(ctx, rc, endpoints, filter, start, end, depth+1)
+		if err != nil || rpcErr != nil {
+			return nil, rpcErr, err
+		}
+		logs = append(logs, _logs...)
+		if end == to {
+			break
+		}
+	}
+	return logs, nil, nil
+}
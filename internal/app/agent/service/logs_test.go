@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/cache"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/endpoint"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/reqctx"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/rs/zerolog"
+)
+
+func TestLogsChunks(t *testing.T) {
+	chunks := _LogsChunks(1500, 4200, 1000)
+	expected := [][2]uint64{{1500, 1999}, {2000, 2999}, {3000, 3999}, {4000, 4200}}
+	if !slices.Equal(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+
+	if chunks := _LogsChunks(10, 10, 1000); !slices.Equal(chunks, [][2]uint64{{10, 10}}) {
+		t.Errorf("expected %v, got %v", [][2]uint64{{10, 10}}, chunks)
+	}
+}
+
+func TestLogsRangeLimit(t *testing.T) {
+	cases := []struct {
+		message string
+		limit   uint64
+		ok      bool
+	}{
+		{"exceed maximum block range: 5000", 5000, true},
+		{"eth_getLogs is limited to a 10,000 range", 10000, true},
+		{"Log response size exceeded. You can make eth_getLogs requests with up to a 2K block range and no limit on the response size, or you can request any block range with a cap of 10K logs in the response. Based on your parameters, this block range should work: [0x1, 0x7d0]", 2000, true},
+		{"requested too many blocks from 1 to 100000, maximum is set to 2048", 2048, true},
+		{"requested too many blocks from 100 to 105000, maximum is set to 2048", 2048, true},
+		{"Under the Free tier plan, you can make eth_getLogs requests with up to a 10 block range", 10, true},
+		{"block range too large, from 3 to 5", 0, true},
+		{"query returned more than 10000 results", 0, true},
+		{"block range is too wide", 0, true},
+		{"execution reverted", 0, false},
+	}
+
+	for _, c := range cases {
+		limit, ok := _LogsRangeLimit(map[string]any{"code": -32000.0, "message": c.message})
+		if limit != c.limit || ok != c.ok {
+			t.Errorf("expected %d %v, got %d %v for %q", c.limit, c.ok, limit, ok, c.message)
+		}
+	}
+}
+
+// fakeLogsClient answers eth_getLogs by a log at each end of the range, the ranges wider than the limit are rejected
+type fakeLogsClient struct {
+	limit uint64
+
+	mu       sync.Mutex
+	requests [][2]uint64
+}
+
+func (c *fakeLogsClient) Request(ctx context.Context, rc reqctx.Reqctxs, endpoints []*endpoint.Endpoint, jsonrpcs []rpc.SealedJSONRPC) ([]rpc.JSONRPCResulter, error) {
+	filter := jsonrpcs[0].Params[0].(map[string]any)
+	from, _ := helpers.DecodeQuantity(filter["fromBlock"])
+	to, _ := helpers.DecodeQuantity(filter["toBlock"])
+
+	c.mu.Lock()
+	c.requests = append(c.requests, [2]uint64{from, to})
+	c.mu.Unlock()
+	p := rc.Profile()
+	p.Requests = append(p.Requests, common.RequestProfile{Url: endpoints[0].Url().String()})
+
+	raw := map[string]any{"jsonrpc": "2.0", "id": jsonrpcs[0].ID}
+	if to-from+1 > c.limit {
+		raw["error"] = map[string]any{"code": -32005.0, "message": fmt.Sprintf("block range too large, maximum is %d", c.limit)}
+	} else {
+		raw["result"] = []any{map[string]any{"blockNumber": helpers.EncodeQuantity(from)}, map[string]any{"blockNumber": helpers.EncodeQuantity(to)}}
+	}
+	return []rpc.JSONRPCResulter{rpc.NewJSONRPCResult(raw)}, nil
+}
+
+func TestGetLogs(t *testing.T) {
+	ctx := context.Background()
+	chain := &fakeChain{}
+	heads := newTestHeadService(chain)
+	heads.update(ctx, heads.chain(1), nil, chain.block(1000))
+	heads.chain(1).finalized = 299
+
+	client := &fakeLogsClient{limit: 100}
+	a := agentService{
+		logger: zerolog.Nop(),
+		client: client,
+		es:     endpoint.NewSelector(),
+		cache:  cache.NewMemory(1024*1024, 1, time.Minute),
+		index:  cache.NewIndex(),
+		ranges: cache.NewIndex(),
+		stats:  &cacheStats{},
+		heads:  heads,
+		logs:   logsConfig{ChunkSize: 200, Concurrency: 2, MaxChunks: 100},
+		config: &agentServiceConfig{
+			CacheMethods:      map[string]string{"eth_getLogs": "10m"},
+			FinalizedExpiry:   24 * time.Hour,
+			UnfinalizedExpiry: 5 * time.Second,
+			MaxEntryCacheSize: 1024 * 1024,
+		},
+	}
+	u, _ := url.Parse("http://127.0.0.1:8545")
+	e := endpoint.New(u)
+	call := rpc.NewJSONRPC(map[string]any{"jsonrpc": "2.0", "id": 1.0, "method": "eth_getLogs", "params": []any{map[string]any{"fromBlock": "0x0", "toBlock": "0x257"}}})
+
+	logs, rpcErr, err := a.getLogs(ctx, newTenantReqctx(t, map[string]any{}), []*endpoint.Endpoint{e}, call)
+	if err != nil || rpcErr != nil {
+		t.Fatalf("expected %v, got %v %v", nil, rpcErr, err)
+	}
+
+	// the pieces of the chunks split by the limit are merged in the order of the blocks
+	blocks := []string{}
+	for _, log := range logs {
+		blocks = append(blocks, log.(map[string]any)["blockNumber"].(string))
+	}
+	expected := []string{}
+	for n := uint64(0); n < 600; n += 100 {
+		expected = append(expected, helpers.EncodeQuantity(n), helpers.EncodeQuantity(n+99))
+	}
+	if !slices.Equal(blocks, expected) {
+		t.Errorf("expected %v, got %v", expected, blocks)
+	}
+	if limit := e.LogsRange(); limit != 100 {
+		t.Errorf("expected %v, got %v", 100, limit)
+	}
+	// the chunks wider than the limit are rejected before it is learned, then split and retried
+	if !slices.ContainsFunc(client.requests, func(r [2]uint64) bool { return r[1]-r[0]+1 > 100 }) {
+		t.Errorf("expected a rejected range, got %v", client.requests)
+	}
+
+	// only the pieces of the finalized blocks are cached
+	client.requests = nil
+	if _, _, err := a.getLogs(ctx, newTenantReqctx(t, map[string]any{}), []*endpoint.Endpoint{e}, call); err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(client.requests, func(a, b [2]uint64) int { return int(a[0]) - int(b[0]) })
+	if expected := [][2]uint64{{300, 399}, {400, 499}, {500, 599}}; !slices.Equal(client.requests, expected) {
+		t.Errorf("expected %v, got %v", expected, client.requests)
+	}
+}
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/endpoint"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/utils"
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+)
+
+var _PrefetchMethods = []string{"eth_getBlockByNumber", "eth_getBlockReceipts"}
+
+type prefetchConfig struct {
+	Enable bool
+	// eth_getBlockByNumber, eth_getBlockByNumber:full with the transactions, or eth_getBlockReceipts
+	Methods []string
+	// overrides of the methods, keyed by chain id or chain code
+	Chains map[string][]string
+	// prefetch requests in flight over all chains
+	Concurrency int
+	// prefetching of a chain is skipped while the client calls in flight of the chain exceed this
+	MaxLoad int64
+	Timeout time.Duration
+}
+
+// prefetcher caches the blocks and receipts of the new heads, only with the capacity left by the client calls
+type prefetcher struct {
+	config prefetchConfig
+	sem    chan struct{}
+	// chains with a prefetch in flight, the heads coming meanwhile are skipped
+	busy sync.Map
+	// client calls in flight by chain
+	load sync.Map
+}
+
+func newPrefetcher(config prefetchConfig) *prefetcher {
+	return &prefetcher{
+		config: config,
+		sem:    make(chan struct{}, max(config.Concurrency, 1)),
+	}
+}
+
+// track counts a client call of the chain in flight until the returned func is called
+func (p *prefetcher) track(chainId common.ChainId) func() {
+	v, _ := p.load.LoadOrStore(chainId, &atomic.Int64{})
+	n := v.(*atomic.Int64)
+	n.Add(1)
+	return func() { n.Add(-1) }
+}
+
+// acquire takes a prefetch slot of the chain without waiting, the returned func releases it
+func (p *prefetcher) acquire(chainId common.ChainId) (func(), bool) {
+	if v, ok := p.load.Load(chainId); ok && p.config.MaxLoad > 0 && v.(*atomic.Int64).Load() > p.config.MaxLoad {
+		return nil, false
+	}
+
+	v, _ := p.busy.LoadOrStore(chainId, &atomic.Bool{})
+	busy := v.(*atomic.Bool)
+	if !busy.CompareAndSwap(false, true) {
+		return nil, false
+	}
+	select {
+	case p.sem <- struct{}{}:
+		return func() {
+			<-p.sem
+			busy.Store(false)
+		}, true
+	default:
+		busy.Store(false)
+		return nil, false
+	}
+}
+
+// methods returns the methods prefetched for the chain
+func (p *prefetcher) methods(chainId common.ChainId, chainCode string) []string {
+	for _, key := range []string{strconv.FormatUint(chainId, 10), chainCode} {
+		if methods, ok := p.config.Chains[key]; ok {
+			return methods
+		}
+	}
+	return p.config.Methods
+}
+
+// _PrefetchCalls returns the calls of the methods for the block, unknown methods are skipped
+func _PrefetchCalls(methods []string, number uint64) []rpc.JSONRPCer {
+	block := helpers.EncodeQuantity(number)
+	calls := []rpc.JSONRPCer{}
+	for _, method := range methods {
+		var params []any
+		switch method {
+		case "eth_getBlockByNumber":
+			params = []any{block, false}
+		case "eth_getBlockByNumber:full":
+			method, params = "eth_getBlockByNumber", []any{block, true}
+		case "eth_getBlockReceipts":
+			params = []any{block}
+		default:
+			continue
+		}
+		calls = append(calls, rpc.NewJSONRPC(map[string]any{
+			"jsonrpc": rpc.JSONRPC_VERSION_2,
+			"id":      strconv.Itoa(len(calls) + 1),
+			"method":  method,
+			"params":  params,
+		}))
+	}
+	return calls
+}
+
+// _PrefetchSource returns the least used healthy endpoint which has the block already
+func _PrefetchSource(endpoints []*endpoint.Endpoint, number uint64) (*endpoint.Endpoint, bool) {
+	candidates := []*endpoint.Endpoint{}
+	for _, e := range endpoints {
+		if e.Health() && e.BlockNumber() >= number {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	return slices.MinFunc(candidates, func(a, b *endpoint.Endpoint) int {
+		return int(a.Count()) - int(b.Count())
+	}), true
+}
+
+// _ResultBlockHash returns the hash of the block of a block result, or of the receipts of a block
+func _ResultBlockHash(result any) string {
+	switch v := result.(type) {
+	case map[string]any:
+		hash, _ := v["hash"].(string)
+		return hash
+	case []any:
+		if len(v) > 0 {
+			if receipt, ok := v[0].(map[string]any); ok {
+				hash, _ := receipt["blockHash"].(string)
+				return hash
+			}
+		}
+	}
+	return ""
+}
+
+// prefetch caches the results of the configured methods for the new head, it never waits for capacity
+func (a agentService) prefetch(head Head) {
+	if a.config.DisableCache {
+		return
+	}
+	release, ok := a.prefetcher.acquire(head.ChainID)
+	if !ok {
+		utils.TotalPrefetches.WithLabelValues(fmt.Sprint(head.ChainID), "", "skipped").Inc()
+		return
+	}
+
+	go func() {
+		defer release()
+		defer func() {
+			if err := recover(); err != nil {
+				a.logger.Error().Interface("error", err).Msgf("Failed to prefetch block %d of %d", head.Number, head.ChainID)
+			}
+		}()
+
+		endpoints, ok := a.endpoints.GetAll(head.ChainID)
+		if !ok || len(endpoints) == 0 {
+			return
+		}
+		e, ok := _PrefetchSource(endpoints, head.Number)
+		if !ok {
+			return
+		}
+		client := a.ecf.GetClient(e)
+		if client == nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), a.prefetcher.config.Timeout)
+		defer cancel()
+
+		calls, data := []rpc.JSONRPCer{}, []rpc.SealedJSONRPC{}
+		for _, call := range _PrefetchCalls(a.prefetcher.methods(head.ChainID, e.ChainCode()), head.Number) {
+			ok, _ := _WithCache(a.config.CacheMethods, call)
+			// results cached by the client calls already are not fetched again
+			if _, cached := a.cache.Get(ctx, _CacheKey(a.jrpcSchema, head.ChainID, call)); !ok || cached {
+				continue
+			}
+			calls = append(calls, call)
+			data = append(data, call.Seal())
+		}
+		if len(calls) == 0 {
+			return
+		}
+
+		results, err := client.Call(ctx, data)
+		if err != nil {
+			for _, call := range calls {
+				utils.TotalPrefetches.WithLabelValues(fmt.Sprint(head.ChainID), call.Method(), "failed").Inc()
+			}
+			a.logger.Debug().Err(err).Msgf("Failed to prefetch block %d of %d", head.Number, head.ChainID)
+			return
+		}
+
+		for _, result := range results {
+			i := slices.IndexFunc(data, func(d rpc.SealedJSONRPC) bool {
+				return d.ID == result.ID()
+			})
+			if i < 0 {
+				continue
+			}
+			// a null result is a block not known by the endpoint yet
+			if result.Error() != nil || result.Result() == nil {
+				utils.TotalPrefetches.WithLabelValues(fmt.Sprint(head.ChainID), calls[i].Method(), "failed").Inc()
+				continue
+			}
+			// the block of the endpoint is on another fork
+			if hash := _ResultBlockHash(result.Result()); hash != "" && hash != head.Hash {
+				continue
+			}
+			_, ttl := _WithCache(a.config.CacheMethods, calls[i])
+			// the big results are cached in background, after the timeout of the prefetch
+			a.cacheResult(context.Background(), head.ChainID, calls[i], result.Result(), ttl)
+			utils.TotalPrefetches.WithLabelValues(fmt.Sprint(head.ChainID), calls[i].Method(), "cached").Inc()
+		}
+	}()
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestPrefetchCalls(t *testing.T) {
+	calls := _PrefetchCalls([]string{"eth_getBlockByNumber:full", "eth_getBlockReceipts", "eth_unknown"}, 256)
+	if len(calls) != 2 {
+		t.Fatalf("expected %d, got %d", 2, len(calls))
+	}
+	if m, p := calls[0].Method(), calls[0].Params(); m != "eth_getBlockByNumber" || p[0] != "0x100" || p[1] != true {
+		t.Errorf("expected %v, got %v %v", "eth_getBlockByNumber [0x100 true]", m, p)
+	}
+	if m, p := calls[1].Method(), calls[1].Params(); m != "eth_getBlockReceipts" || p[0] != "0x100" {
+		t.Errorf("expected %v, got %v %v", "eth_getBlockReceipts [0x100]", m, p)
+	}
+
+	methods := map[string]string{"eth_getBlockByNumber": "10m", "eth_getBlockReceipts": "10m"}
+	for _, call := range calls {
+		if ok, _ := _WithCache(methods, call); !ok {
+			t.Errorf("expected %v, got %v", true, ok)
+		}
+	}
+}
+
+func TestPrefetchAcquire(t *testing.T) {
+	p := newPrefetcher(prefetchConfig{Concurrency: 1, MaxLoad: 1})
+
+	release, ok := p.acquire(1)
+	if !ok {
+		t.Fatalf("expected %v, got %v", true, ok)
+	}
+	// the chain is busy, and the other chains wait for the slot
+	if _, ok := p.acquire(1); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+	if _, ok := p.acquire(2); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+	release()
+
+	// the client calls take precedence
+	done := []func(){p.track(2), p.track(2)}
+	if _, ok := p.acquire(2); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+	for _, fn := range done {
+		fn()
+	}
+	if release, ok := p.acquire(2); !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	} else {
+		release()
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/app/shared"
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+type SubmissionStatus = string
+
+const (
+	SubmissionPending SubmissionStatus = "pending"
+	SubmissionSuccess SubmissionStatus = "success"
+	SubmissionFailed  SubmissionStatus = "failed"
+)
+
+// Submission is the cluster-wide record of a raw transaction submitted through the proxy
+type Submission struct {
+	Hash   string           `json:"hash"`
+	Status SubmissionStatus `json:"status"`
+	Error  any              `json:"error,omitempty"`
+	T      int64            `json:"t"`
+}
+
+type submissions struct {
+	logger zerolog.Logger
+	redis  *shared.RedisClient
+	expiry time.Duration
+}
+
+func newSubmissions(logger zerolog.Logger, redis *shared.RedisClient, expiry time.Duration) *submissions {
+	return &submissions{
+		logger: logger.With().Str("name", "submissions").Logger(),
+		redis:  redis,
+		expiry: expiry,
+	}
+}
+
+func _SubmissionKey(chainId common.ChainId, hash string) string {
+	return helpers.Concat("tx#", strconv.FormatUint(chainId, 36), ":", hash)
+}
+
+// _TransactionHash computes the transaction hash of eth_sendRawTransaction by keccak of the raw bytes
+func _TransactionHash(jsonrpc rpc.JSONRPCer) (string, bool) {
+	params := jsonrpc.Params()
+	if len(params) < 1 {
+		return "", false
+	}
+	raw, ok := params[0].(string)
+	if !ok {
+		return "", false
+	}
+	b, err := helpers.DecodeHex(raw)
+	if err != nil || len(b) == 0 {
+		return "", false
+	}
+	return helpers.Keccak256Hex(b), true
+}
+
+func _ErrorMessage(err any) string {
+	if v, ok := err.(map[string]any); ok {
+		return strings.ToLower(fmt.Sprint(v["message"]))
+	}
+	return strings.ToLower(fmt.Sprint(err))
+}
+
+// the transaction has been accepted by the node already, e.g. by a previous attempt
+func isKnownTransactionError(err any) bool {
+	msg := _ErrorMessage(err)
+	return strings.Contains(msg, "already known") ||
+		strings.Contains(msg, "known transaction") ||
+		strings.Contains(msg, "already imported") ||
+		strings.Contains(msg, "already in mempool")
+}
+
+// the failure is final for the raw bytes of the transaction, submitting them again fails the same way,
+// the other failures may be caused by the endpoint or recover later, e.g. nonce too high or insufficient funds
+func isFinalTransactionError(err any) bool {
+	msg := _ErrorMessage(err)
+	return strings.Contains(msg, "invalid sender") ||
+		strings.Contains(msg, "invalid signature") ||
+		strings.Contains(msg, "invalid transaction v, r, s") ||
+		strings.Contains(msg, "rlp") ||
+		strings.Contains(msg, "nonce too low") ||
+		strings.Contains(msg, "nonce has already been used") ||
+		strings.Contains(msg, "invalid chain id") ||
+		strings.Contains(msg, "chain id mismatch") ||
+		strings.Contains(msg, "incorrect chain id") ||
+		strings.Contains(msg, "wrong chain id")
+}
+
+func (s *submissions) available() bool {
+	return s != nil && s.redis != nil && s.redis.Client != nil
+}
+
+// Acquire marks the transaction as pending, returns the previous record if it has been submitted
+func (s *submissions) Acquire(ctx context.Context, chainId common.ChainId, hash string) (*Submission, bool) {
+	if !s.available() {
+		return nil, true
+	}
+
+	key := _SubmissionKey(chainId, hash)
+	data, err := json.Marshal(Submission{Hash: hash, Status: SubmissionPending, T: time.Now().UnixMilli()})
+	if err != nil {
+		return nil, true
+	}
+
+	ok, err := s.redis.Client.SetNX(ctx, key, data, s.expiry).Result()
+	if err != nil {
+		s.logger.Warn().Err(err).Msgf("Failed to acquire submission %s", hash)
+		return nil, true
+	}
+	if ok {
+		return nil, true
+	}
+
+	b, err := s.redis.Client.Get(ctx, key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			s.logger.Warn().Err(err).Msgf("Failed to read submission %s", hash)
+		}
+		return nil, true
+	}
+
+	var submission Submission
+	if err := json.Unmarshal(b, &submission); err != nil {
+		return nil, true
+	}
+	return &submission, false
+}
+
+// Resolve records the outcome of the submission, only the final failures are kept, the others are released to allow resubmitting
+func (s *submissions) Resolve(ctx context.Context, chainId common.ChainId, hash string, result rpc.SealedJSONRPCResult) {
+	if !s.available() {
+		return
+	}
+
+	submission := Submission{Hash: hash, Status: SubmissionSuccess, T: time.Now().UnixMilli()}
+	if result.Error != nil && !isKnownTransactionError(result.Error) {
+		if !isFinalTransactionError(result.Error) {
+			s.Release(ctx, chainId, hash)
+			return
+		}
+		submission.Status = SubmissionFailed
+		submission.Error = result.Error
+	}
+
+	data, err := json.Marshal(submission)
+	if err != nil {
+		return
+	}
+	if err := s.redis.Client.Set(ctx, _SubmissionKey(chainId, hash), data, s.expiry).Err(); err != nil {
+		s.logger.Warn().Err(err).Msgf("Failed to save submission %s", hash)
+	}
+}
+
+func (s *submissions) Release(ctx context.Context, chainId common.ChainId, hash string) {
+	if !s.available() {
+		return
+	}
+	if err := s.redis.Client.Del(ctx, _SubmissionKey(chainId, hash)).Err(); err != nil {
+		s.logger.Warn().Err(err).Msgf("Failed to release submission %s", hash)
+	}
+}
+
+func (s *submissions) MakeResult(jsonrpc rpc.JSONRPCer, submission *Submission) rpc.SealedJSONRPCResult {
+	if submission.Status == SubmissionFailed {
+		return jsonrpc.MakeResult(nil, submission.Error)
+	}
+	return jsonrpc.MakeResult(submission.Hash, nil)
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/app/shared"
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/go-redis/redismock/v9"
+	"github.com/rs/zerolog"
+)
+
+func newTestSubmissions() (*submissions, redismock.ClientMock) {
+	rdb, mock := redismock.NewClientMock()
+	return newSubmissions(zerolog.Nop(), &shared.RedisClient{Client: rdb}, 10*time.Minute), mock
+}
+
+// _StatusMatch matches the commands setting a record of the status
+func _StatusMatch(status SubmissionStatus) redismock.CustomMatch {
+	return func(expected, actual []any) error {
+		if v := fmt.Sprintf("%s", actual[2]); !strings.Contains(v, `"status":"`+status+`"`) {
+			return fmt.Errorf("expected %v, got %v", status, v)
+		}
+		return nil
+	}
+}
+
+func TestSubmissionAcquire(t *testing.T) {
+	ctx := context.Background()
+	s, mock := newTestSubmissions()
+	key := _SubmissionKey(1, "0xabc")
+
+	mock.CustomMatch(_StatusMatch(SubmissionPending)).ExpectSetNX(key, "", 10*time.Minute).SetVal(true)
+	if submission, ok := s.Acquire(ctx, 1, "0xabc"); !ok || submission != nil {
+		t.Errorf("expected %v, got %v %v", true, ok, submission)
+	}
+
+	mock.CustomMatch(_StatusMatch(SubmissionPending)).ExpectSetNX(key, "", 10*time.Minute).SetVal(false)
+	mock.ExpectGet(key).SetVal(`{"hash":"0xabc","status":"success","t":1}`)
+	if submission, ok := s.Acquire(ctx, 1, "0xabc"); ok || submission == nil || submission.Status != SubmissionSuccess {
+		t.Errorf("expected %v, got %v %v", SubmissionSuccess, ok, submission)
+	}
+
+	// a record expired meanwhile is submitted again
+	mock.CustomMatch(_StatusMatch(SubmissionPending)).ExpectSetNX(key, "", 10*time.Minute).SetVal(false)
+	mock.ExpectGet(key).RedisNil()
+	if submission, ok := s.Acquire(ctx, 1, "0xabc"); !ok || submission != nil {
+		t.Errorf("expected %v, got %v %v", true, ok, submission)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSubmissionResolve(t *testing.T) {
+	ctx := context.Background()
+	key := _SubmissionKey(1, "0xabc")
+	errorOf := func(code float64, message string) rpc.SealedJSONRPCResult {
+		return rpc.SealedJSONRPCResult{Error: map[string]any{"code": code, "message": message}}
+	}
+
+	cases := []struct {
+		name   string
+		result rpc.SealedJSONRPCResult
+		// the status kept, or released if empty
+		expect SubmissionStatus
+	}{
+		{"accepted", rpc.SealedJSONRPCResult{Result: "0xabc"}, SubmissionSuccess},
+		{"already known", errorOf(-32000, "already known"), SubmissionSuccess},
+		{"nonce too low", errorOf(-32000, "nonce too low: next nonce 5, tx nonce 4"), SubmissionFailed},
+		{"invalid sender", errorOf(-32000, "invalid sender"), SubmissionFailed},
+		{"rlp", errorOf(-32000, "rlp: expected input list for types.LegacyTx"), SubmissionFailed},
+		{"chain id", errorOf(-32000, "invalid chain id for signer"), SubmissionFailed},
+		{"nonce too high", errorOf(-32000, "nonce too high"), ""},
+		{"insufficient funds", errorOf(-32000, "insufficient funds for gas * price + value"), ""},
+		{"internal error", errorOf(-32603, "internal error"), ""},
+		{"rate limited", errorOf(-32005, "rate limit exceeded"), ""},
+		{"no answer", rpc.SealedJSONRPCResult{Error: common.NewJSONRPCError(common.JSONRPCInternalError, "No answer from the endpoint")}, ""},
+	}
+
+	for _, c := range cases {
+		s, mock := newTestSubmissions()
+		if c.expect == "" {
+			mock.ExpectDel(key).SetVal(1)
+		} else {
+			mock.CustomMatch(_StatusMatch(c.expect)).ExpectSet(key, "", 10*time.Minute).SetVal("OK")
+		}
+		s.Resolve(ctx, 1, "0xabc", c.result)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestSubmissionRelease(t *testing.T) {
+	s, mock := newTestSubmissions()
+	mock.ExpectDel(_SubmissionKey(1, "0xabc")).SetVal(1)
+	s.Release(context.Background(), 1, "0xabc")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// without redis the submissions are not tracked
+	var none *submissions
+	if submission, ok := none.Acquire(context.Background(), 1, "0xabc"); !ok || submission != nil {
+		t.Errorf("expected %v, got %v %v", true, ok, submission)
+	}
+}
@@ -0,0 +1,593 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/endpoint"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/utils/config"
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/rs/zerolog"
+)
+
+const (
+	SubscriptionNewHeads               = "newHeads"
+	SubscriptionLogs                   = "logs"
+	SubscriptionNewPendingTransactions = "newPendingTransactions"
+)
+
+var (
+	ErrSubscriptionUnsupported = errors.New("unsupported subscription")
+	ErrSubscriptionParams      = errors.New("invalid subscription params")
+	ErrSubscriptionDisabled    = errors.New("subscriptions require the head tracking")
+)
+
+// Subscription receives the results of the eth_subscription notifications, C is closed when it is unsubscribed
+type Subscription struct {
+	ID      string
+	ChainID common.ChainId
+	Kind    string
+	C       <-chan any
+
+	c      chan any
+	filter *logsFilter
+}
+
+type SubscriptionService interface {
+	// Subscribe starts a subscription of the eth_subscribe params
+	Subscribe(chainId common.ChainId, params []any) (*Subscription, error)
+	Unsubscribe(id string) bool
+}
+
+type subscriptionServiceConfig struct {
+	// notifications buffered by a subscription, the notifications of a slow subscriber are dropped
+	Buffer int
+	// interval of polling the pending transactions filter
+	PendingInterval time.Duration
+	// an upstream subscription of the pending transactions delivering nothing within this is replaced by the polling
+	PendingStall time.Duration
+	Timeout      time.Duration
+	// blocks skipped between two heads are notified up to this number
+	MaxGap uint64
+	// the logs of the blocks within this depth below the last notified block are removed again on a reorg
+	Depth uint64
+}
+
+// chainFeeds shares the upstream calls of a chain among all its subscriptions
+type chainFeeds struct {
+	// the heads and the reorgs of the chain, in their order
+	events chan any
+	// the last notified block
+	last uint64
+	// the logs notified of the recent blocks
+	logs map[uint64][]any
+	// cancels the polling of the pending transactions
+	cancelPending context.CancelFunc
+}
+
+type subscriptionService struct {
+	logger          zerolog.Logger
+	endpointService EndpointService
+	ecf             *endpoint.ClientFactory
+	config          subscriptionServiceConfig
+	disable         bool
+
+	mu     sync.RWMutex
+	subs   map[string]*Subscription
+	chains map[common.ChainId]*chainFeeds
+}
+
+func NewSubscriptionService(
+	logger zerolog.Logger,
+	config *config.Conf,
+	endpointService EndpointService,
+	ecf *endpoint.ClientFactory,
+	heads HeadService,
+) SubscriptionService {
+	service := &subscriptionService{
+		logger:          logger.With().Str("name", "subscription_service").Logger(),
+		endpointService: endpointService,
+		ecf:             ecf,
+		config: subscriptionServiceConfig{
+			Buffer:          max(config.Int("websocket.subscription_buffer", 64), 1),
+			PendingInterval: config.Duration("websocket.pending_interval", time.Second),
+			PendingStall:    config.Duration("websocket.pending_stall", 30*time.Second),
+			Timeout:         config.Duration("heads.timeout", 5*time.Second),
+			MaxGap:          uint64(config.Int("websocket.max_gap", 16)),
+			Depth:           uint64(config.Int("heads.depth", 64)),
+		},
+		disable: config.Bool("heads.disable", false),
+		subs:    map[string]*Subscription{},
+		chains:  map[common.ChainId]*chainFeeds{},
+	}
+	heads.OnHead(service.onHead)
+	heads.OnReorg(service.onReorg)
+
+	return service
+}
+
+func (s *subscriptionService) Subscribe(chainId common.ChainId, params []any) (*Subscription, error) {
+	if len(params) == 0 {
+		return nil, ErrSubscriptionParams
+	}
+	kind, _ := params[0].(string)
+
+	sub := &Subscription{ChainID: chainId, Kind: kind, c: make(chan any, s.config.Buffer)}
+	sub.C = sub.c
+	switch kind {
+	case SubscriptionNewHeads:
+		if len(params) > 1 {
+			return nil, ErrSubscriptionParams
+		}
+	case SubscriptionLogs:
+		var arg any
+		if len(params) > 1 {
+			arg = params[1]
+		}
+		filter, err := newLogsFilter(arg)
+		if err != nil {
+			return nil, err
+		}
+		sub.filter = filter
+	case SubscriptionNewPendingTransactions:
+		// only the hashes are notified
+		if len(params) > 1 && params[1] != false {
+			return nil, fmt.Errorf("%w: full transactions are not supported", ErrSubscriptionParams)
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", ErrSubscriptionUnsupported, kind)
+	}
+	if s.disable && kind != SubscriptionNewPendingTransactions {
+		return nil, ErrSubscriptionDisabled
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	sub.ID = "0x" + hex.EncodeToString(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[sub.ID] = sub
+	feeds := s.feeds(chainId)
+	if kind == SubscriptionNewPendingTransactions && feeds.cancelPending == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		feeds.cancelPending = cancel
+		go s.followPending(ctx, chainId)
+	}
+
+	return sub, nil
+}
+
+func (s *subscriptionService) Unsubscribe(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subs[id]
+	if !ok {
+		return false
+	}
+	delete(s.subs, id)
+	close(sub.c)
+
+	// the pending transactions are polled while they are subscribed
+	if feeds := s.chains[sub.ChainID]; sub.Kind == SubscriptionNewPendingTransactions && feeds.cancelPending != nil && !s.subscribed(sub.ChainID, sub.Kind) {
+		feeds.cancelPending()
+		feeds.cancelPending = nil
+	}
+	return true
+}
+
+// feeds returns the feeds of the chain, the caller must hold the lock
+func (s *subscriptionService) feeds(chainId common.ChainId) *chainFeeds {
+	feeds, ok := s.chains[chainId]
+	if !ok {
+		feeds = &chainFeeds{events: make(chan any, 16), logs: map[uint64][]any{}}
+		s.chains[chainId] = feeds
+		go s.followHeads(chainId, feeds)
+	}
+	return feeds
+}
+
+// subscribed reports whether the chain has subscriptions of the kind, the caller must hold the lock
+func (s *subscriptionService) subscribed(chainId common.ChainId, kind string) bool {
+	for _, sub := range s.subs {
+		if sub.ChainID == chainId && sub.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// notify sends the result to the subscriptions of the kind without waiting
+func (s *subscriptionService) notify(chainId common.ChainId, kind string, result any) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, sub := range s.subs {
+		if sub.ChainID != chainId || sub.Kind != kind {
+			continue
+		}
+		if sub.filter != nil && !sub.filter.match(result) {
+			continue
+		}
+		select {
+		case sub.c <- result:
+		default:
+			s.logger.Debug().Msgf("Dropped a notification of the slow subscription %s", sub.ID)
+		}
+	}
+}
+
+func (s *subscriptionService) onHead(head Head) {
+	s.event(head.ChainID, head)
+}
+
+func (s *subscriptionService) onReorg(reorg ReorgEvent) {
+	s.event(reorg.ChainID, reorg)
+}
+
+func (s *subscriptionService) event(chainId common.ChainId, event any) {
+	s.mu.RLock()
+	feeds, ok := s.chains[chainId]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case feeds.events <- event:
+	default:
+	}
+}
+
+// followHeads notifies the headers and the logs of the new blocks, the blocks skipped between two heads are filled,
+// the logs of the blocks replaced by a reorg are notified again as removed before the logs of their replacements
+func (s *subscriptionService) followHeads(chainId common.ChainId, feeds *chainFeeds) {
+	for event := range feeds.events {
+		if reorg, ok := event.(ReorgEvent); ok {
+			s.removeLogs(chainId, feeds, reorg.From, reorg.To)
+			if feeds.last >= reorg.From {
+				feeds.last = max(reorg.From, 1) - 1
+			}
+			continue
+		}
+		head, ok := event.(Head)
+		if !ok {
+			continue
+		}
+
+		s.mu.RLock()
+		heads, logs := s.subscribed(chainId, SubscriptionNewHeads), s.subscribed(chainId, SubscriptionLogs)
+		s.mu.RUnlock()
+		if !heads && !logs {
+			feeds.last = head.Number
+			clear(feeds.logs)
+			continue
+		}
+
+		from := head.Number
+		if feeds.last > 0 && feeds.last < head.Number {
+			if head.Number-feeds.last <= s.config.MaxGap {
+				from = feeds.last + 1
+			} else {
+				s.logger.Warn().Msgf("Skipped blocks %d to %d of %d, more than %d blocks behind", feeds.last+1, head.Number-1, chainId, s.config.MaxGap)
+			}
+		}
+		for n := from; n <= head.Number; n++ {
+			items, err := s.notifyBlock(chainId, n, heads, logs)
+			if err != nil {
+				s.logger.Warn().Err(err).Msgf("Failed to notify block %d of %d", n, chainId)
+				break
+			}
+			feeds.last = n
+			if len(items) > 0 {
+				feeds.logs[n] = items
+			}
+		}
+		for n := range feeds.logs {
+			if n+s.config.Depth < feeds.last {
+				delete(feeds.logs, n)
+			}
+		}
+	}
+}
+
+// removeLogs notifies the logs of the blocks again with removed set, the blocks are replaced by a reorg
+func (s *subscriptionService) removeLogs(chainId common.ChainId, feeds *chainFeeds, from, to uint64) {
+	for n := from; n <= to; n++ {
+		items, ok := feeds.logs[n]
+		if !ok {
+			continue
+		}
+		delete(feeds.logs, n)
+		for _, item := range items {
+			log, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			removed := make(map[string]any, len(log)+1)
+			for k, v := range log {
+				removed[k] = v
+			}
+			removed["removed"] = true
+			s.notify(chainId, SubscriptionLogs, removed)
+		}
+	}
+}
+
+// notifyBlock notifies the header and the logs of the block, returns the logs notified
+func (s *subscriptionService) notifyBlock(chainId common.ChainId, number uint64, heads, logs bool) ([]any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancel()
+
+	block := helpers.EncodeQuantity(number)
+	v, err := s.request(ctx, chainId, number, "eth_getBlockByNumber", []any{block, false})
+	if err != nil {
+		return nil, err
+	}
+	header, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("block %d not found", number)
+	}
+	delete(header, "transactions")
+	delete(header, "uncles")
+
+	if heads {
+		s.notify(chainId, SubscriptionNewHeads, header)
+	}
+	if logs {
+		v, err := s.request(ctx, chainId, number, "eth_getLogs", []any{map[string]any{"blockHash": header["hash"]}})
+		if err != nil {
+			return nil, err
+		}
+		items, _ := v.([]any)
+		for _, item := range items {
+			s.notify(chainId, SubscriptionLogs, item)
+		}
+		return items, nil
+	}
+	return nil, nil
+}
+
+// followPending notifies the pending transactions until it is canceled, by an upstream subscription of a WebSocket endpoint,
+// or else by polling a pending transactions filter of an endpoint, which is installed again on another endpoint when it fails,
+// the polling takes over when the upstream subscription stops delivering
+func (s *subscriptionService) followPending(ctx context.Context, chainId common.ChainId) {
+	if sub, ok := s.subscribeUpstream(ctx, chainId, SubscriptionNewPendingTransactions); ok {
+		s.followUpstream(ctx, chainId, sub.C)
+		sub.Unsubscribe()
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn().Err(sub.Err()).Msgf("Upstream subscription of the pending transactions of %d stopped, polling instead", chainId)
+	}
+
+	var (
+		e      *endpoint.Endpoint
+		filter any
+		ticker = time.NewTicker(s.config.PendingInterval)
+	)
+	defer ticker.Stop()
+	defer func() {
+		if e != nil && filter != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+			defer cancel()
+			s.call(ctx, e, "eth_uninstallFilter", []any{filter})
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+		if filter == nil {
+			var ok bool
+			if e, ok = s.source(chainId, 0); ok {
+				if filter, _ = s.call(_ctx, e, "eth_newPendingTransactionFilter", []any{}); filter == nil {
+					s.logger.Debug().Msgf("Failed to install the pending transactions filter of %d on %s", chainId, e)
+				}
+			}
+			cancel()
+			continue
+		}
+
+		v, err := s.call(_ctx, e, "eth_getFilterChanges", []any{filter})
+		cancel()
+		if err != nil {
+			filter = nil
+			continue
+		}
+		hashes, _ := v.([]any)
+		for _, hash := range hashes {
+			s.notify(chainId, SubscriptionNewPendingTransactions, hash)
+		}
+	}
+}
+
+// followUpstream notifies the pending transactions of the upstream subscription until it is canceled or stops delivering,
+// i.e. it is closed, or nothing is delivered within the stall timeout, e.g. its endpoint fails to resubscribe
+func (s *subscriptionService) followUpstream(ctx context.Context, chainId common.ChainId, c <-chan any) {
+	stall := time.NewTimer(s.config.PendingStall)
+	defer stall.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stall.C:
+			return
+		case hash, ok := <-c:
+			if !ok {
+				return
+			}
+			stall.Reset(s.config.PendingStall)
+			s.notify(chainId, SubscriptionNewPendingTransactions, hash)
+		}
+	}
+}
+
+// subscribeUpstream subscribes the kind on the first endpoint which supports the subscriptions
+func (s *subscriptionService) subscribeUpstream(ctx context.Context, chainId common.ChainId, kind string) (*endpoint.Subscription, bool) {
+	endpoints, ok := s.endpointService.GetAll(chainId)
+	if !ok {
+		return nil, false
+	}
+	for _, e := range endpoints {
+		if !e.Health() || !strings.HasPrefix(e.Url().Scheme, "ws") {
+			continue
+		}
+		subscriber, ok := s.ecf.GetClient(e).(endpoint.Subscriber)
+		if !ok {
+			continue
+		}
+
+		_ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+		sub, err := subscriber.Subscribe(_ctx, kind)
+		cancel()
+		if err != nil {
+			s.logger.Debug().Err(err).Msgf("Failed to subscribe %s of %d on %s", kind, chainId, e)
+			continue
+		}
+		return sub, true
+	}
+	return nil, false
+}
+
+// source returns the least used healthy endpoint which has the block
+func (s *subscriptionService) source(chainId common.ChainId, number uint64) (*endpoint.Endpoint, bool) {
+	endpoints, ok := s.endpointService.GetAll(chainId)
+	if !ok {
+		return nil, false
+	}
+	return _PrefetchSource(endpoints, number)
+}
+
+func (s *subscriptionService) request(ctx context.Context, chainId common.ChainId, number uint64, method string, params []any) (any, error) {
+	e, ok := s.source(chainId, number)
+	if !ok {
+		return nil, fmt.Errorf("no available endpoint of block %d", number)
+	}
+	return s.call(ctx, e, method, params)
+}
+
+func (s *subscriptionService) call(ctx context.Context, e *endpoint.Endpoint, method string, params []any) (any, error) {
+	client := s.ecf.GetClient(e)
+	if client == nil {
+		return nil, errors.New("no available client")
+	}
+
+	results, err := client.Call(ctx, []rpc.SealedJSONRPC{{
+		Version: rpc.JSONRPC_VERSION_2,
+		ID:      "1",
+		Method:  method,
+		Params:  params,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no result of %s", method)
+	}
+	if results[0].Error() != nil {
+		return nil, fmt.Errorf("%s: %v", method, results[0].Error())
+	}
+	return results[0].Result(), nil
+}
+
+// logsFilter matches the logs by the address and the topics of the logs subscription
+type logsFilter struct {
+	addresses []string
+	// each position matches any of the topics, an empty position matches all
+	topics [][]string
+}
+
+func newLogsFilter(arg any) (*logsFilter, error) {
+	filter := &logsFilter{}
+	if arg == nil {
+		return filter, nil
+	}
+	m, ok := arg.(map[string]any)
+	if !ok {
+		return nil, ErrSubscriptionParams
+	}
+
+	values := func(v any) ([]string, bool) {
+		switch v := v.(type) {
+		case nil:
+			return nil, true
+		case string:
+			return []string{strings.ToLower(v)}, true
+		case []any:
+			values := make([]string, 0, len(v))
+			for i := range v {
+				s, ok := v[i].(string)
+				if !ok {
+					return nil, false
+				}
+				values = append(values, strings.ToLower(s))
+			}
+			return values, true
+		}
+		return nil, false
+	}
+
+	for k, v := range m {
+		switch k {
+		case "address":
+			if filter.addresses, ok = values(v); !ok {
+				return nil, ErrSubscriptionParams
+			}
+		case "topics":
+			topics, ok := v.([]any)
+			if v != nil && !ok {
+				return nil, ErrSubscriptionParams
+			}
+			for i := range topics {
+				position, ok := values(topics[i])
+				if !ok {
+					return nil, ErrSubscriptionParams
+				}
+				filter.topics = append(filter.topics, position)
+			}
+		default:
+			return nil, fmt.Errorf("%w: %s is not supported", ErrSubscriptionParams, k)
+		}
+	}
+	return filter, nil
+}
+
+func (f *logsFilter) match(v any) bool {
+	log, ok := v.(map[string]any)
+	if !ok {
+		return false
+	}
+	if address, _ := log["address"].(string); len(f.addresses) > 0 && !slices.Contains(f.addresses, strings.ToLower(address)) {
+		return false
+	}
+
+	topics, _ := log["topics"].([]any)
+	for i := range f.topics {
+		if len(f.topics[i]) == 0 {
+			continue
+		}
+		if i >= len(topics) {
+			return false
+		}
+		if topic, _ := topics[i].(string); !slices.Contains(f.topics[i], strings.ToLower(topic)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLogsFilter(t *testing.T) {
+	filter, err := newLogsFilter(map[string]any{
+		"address": "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48",
+		"topics":  []any{"0xddf2", nil, []any{"0x01", "0x02"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := func(address string, topics ...any) map[string]any {
+		return map[string]any{"address": address, "topics": topics}
+	}
+	cases := []struct {
+		log    map[string]any
+		expect bool
+	}{
+		{log("0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48", "0xDDF2", "0xff", "0x02"), true},
+		{log("0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48", "0xddf2", "0xff", "0x03"), false},
+		{log("0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48", "0xddf2"), false},
+		{log("0x0000000000000000000000000000000000000000", "0xddf2", "0xff", "0x01"), false},
+	}
+	for _, c := range cases {
+		if got := filter.match(c.log); got != c.expect {
+			t.Errorf("expected %v, got %v for %v", c.expect, got, c.log)
+		}
+	}
+
+	if _, err := newLogsFilter(map[string]any{"fromBlock": "0x1"}); err == nil {
+		t.Errorf("expected an error, got %v", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := &subscriptionService{
+		logger: zerolog.Nop(),
+		config: subscriptionServiceConfig{Buffer: 1},
+		subs:   map[string]*Subscription{},
+		chains: map[uint64]*chainFeeds{},
+	}
+
+	heads, err := s.Subscribe(1, []any{"newHeads"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := s.Subscribe(1, []any{"logs", map[string]any{"address": "0x01"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Subscribe(1, []any{"syncing"}); err == nil {
+		t.Errorf("expected an error, got %v", err)
+	}
+
+	s.notify(1, SubscriptionNewHeads, "0x1")
+	// dropped for the slow subscriber
+	s.notify(1, SubscriptionNewHeads, "0x2")
+	s.notify(1, SubscriptionLogs, map[string]any{"address": "0x02"})
+	s.notify(1, SubscriptionLogs, map[string]any{"address": "0x01"})
+
+	if v := <-heads.C; v != "0x1" {
+		t.Errorf("expected %v, got %v", "0x1", v)
+	}
+	if v := <-logs.C; v.(map[string]any)["address"] != "0x01" {
+		t.Errorf("expected %v, got %v", "0x01", v)
+	}
+
+	if !s.Unsubscribe(heads.ID) || s.Unsubscribe(heads.ID) {
+		t.Errorf("expected the subscription to be removed once")
+	}
+	if _, ok := <-heads.C; ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+}
+
+func TestFollowUpstreamStall(t *testing.T) {
+	c := make(chan any, 4)
+	pending := &Subscription{ID: "0x1", ChainID: 1, Kind: SubscriptionNewPendingTransactions, C: c, c: c}
+	s := &subscriptionService{
+		logger: zerolog.Nop(),
+		config: subscriptionServiceConfig{Buffer: 4, PendingStall: 50 * time.Millisecond},
+		subs:   map[string]*Subscription{pending.ID: pending},
+		chains: map[uint64]*chainFeeds{},
+	}
+
+	upstream := make(chan any, 2)
+	upstream <- "0x01"
+	done := make(chan struct{})
+	go func() {
+		s.followUpstream(context.Background(), 1, upstream)
+		close(done)
+	}()
+
+	if v := <-pending.C; v != "0x01" {
+		t.Errorf("expected %v, got %v", "0x01", v)
+	}
+	// the upstream subscription delivering nothing is given up for the polling
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("expected %v, got %v", "the stall to end the upstream subscription", "none")
+	}
+}
+
+func TestFollowHeadsReorg(t *testing.T) {
+	s := &subscriptionService{
+		logger: zerolog.Nop(),
+		config: subscriptionServiceConfig{Buffer: 4, MaxGap: 16, Depth: 64},
+		subs:   map[string]*Subscription{},
+		chains: map[uint64]*chainFeeds{},
+	}
+	logs, err := s.Subscribe(1, []any{"logs", map[string]any{"address": "0x01"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := map[string]any{"address": "0x01", "blockNumber": "0xb", "removed": false}
+	feeds := &chainFeeds{
+		events: make(chan any, 2),
+		last:   12,
+		logs:   map[uint64][]any{9: {map[string]any{"address": "0x01"}}, 11: {log}},
+	}
+	feeds.events <- ReorgEvent{ChainID: 1, From: 11, To: 12}
+	close(feeds.events)
+	s.followHeads(1, feeds)
+
+	v, _ := (<-logs.C).(map[string]any)
+	if v["removed"] != true || v["blockNumber"] != "0xb" {
+		t.Errorf("expected %v, got %v", "the removed log", v)
+	}
+	if log["removed"] != false {
+		t.Errorf("expected %v, got %v", false, log["removed"])
+	}
+	// the replacements are notified from the first replaced block
+	if feeds.last != 10 {
+		t.Errorf("expected %v, got %v", 10, feeds.last)
+	}
+	if _, ok := feeds.logs[9]; !ok || len(feeds.logs) != 1 {
+		t.Errorf("expected %v, got %v", "the logs of block 9 kept", feeds.logs)
+	}
+	select {
+	case v := <-logs.C:
+		t.Errorf("expected %v, got %v", "no notification", v)
+	default:
+	}
+}
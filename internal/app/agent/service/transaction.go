@@ -0,0 +1,47 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/reqctx"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/tx"
+)
+
+// decodeTransaction decodes the raw transaction of eth_sendRawTransaction and checks it before forwarding,
+// transactions of unknown types are forwarded as is
+func decodeTransaction(rc reqctx.Reqctxs, jsonrpc rpc.JSONRPCer) (*tx.Transaction, error) {
+	params := jsonrpc.Params()
+	if len(params) < 1 {
+		return nil, common.NewJSONRPCError(common.JSONRPCInvalidParams, "missing value for required argument 0")
+	}
+	raw, ok := params[0].(string)
+	if !ok {
+		return nil, common.NewJSONRPCError(common.JSONRPCInvalidParams, "invalid argument 0: raw transaction must be a hex string")
+	}
+
+	transaction, err := tx.DecodeHex(raw)
+	if errors.Is(err, tx.ErrUnsupportedType) {
+		rc.Logger().Debug().Err(err).Msg("Skip pre-flight validation of transaction")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, common.NewJSONRPCError(common.JSONRPCInvalidParams, "invalid argument 0: "+err.Error())
+	}
+
+	if chainId := rc.ChainID(); chainId != 0 && !transaction.MatchChainID(chainId) {
+		return nil, common.NewJSONRPCError(common.JSONRPCServerError, fmt.Sprintf("invalid chain id for signer: have %s want %d", transaction.ChainID, chainId))
+	}
+
+	p := rc.Profile()
+	p.Transactions = append(p.Transactions, common.TransactionProfile{
+		Hash:  transaction.Hash,
+		From:  transaction.From,
+		To:    transaction.To,
+		Nonce: transaction.Nonce,
+	})
+
+	return transaction, nil
+}
@@ -27,6 +27,14 @@ func StartCluster() {
 	prometheus.MustRegister(utils.EndpointDurations)
 	prometheus.MustRegister(utils.TotalCaches)
 	prometheus.MustRegister(utils.TotalAmqpMessages)
+	prometheus.MustRegister(utils.TotalDuplicateTransactions)
+	prometheus.MustRegister(utils.TotalBlockedMethods)
+	prometheus.MustRegister(utils.TotalCoalescedRequests)
+	prometheus.MustRegister(utils.TotalPrefetches)
+	prometheus.MustRegister(utils.TotalReorgs)
+	prometheus.MustRegister(utils.TotalReorgInvalidations)
+	prometheus.MustRegister(utils.WebSocketConnections)
+	prometheus.MustRegister(utils.TotalWebSocketReconnects)
 
 	fx.New(
 		// provide modules
@@ -61,7 +69,11 @@ func InitCluster(
 	router *Router,
 	app *Application,
 	service service.EndpointService,
+	heads service.HeadService,
+	agentService service.AgentService,
 ) {
+	// the purges of the cache broadcast by the other nodes are followed while running
+	purgesCtx, stopPurges := context.WithCancel(context.Background())
 	lifecycle.Append(
 		fx.Hook{
 			OnStart: func(ctx context.Context) error {
@@ -112,6 +124,11 @@ func InitCluster(
 
 				go func() {
 					service.Init()
+					heads.Init()
+					if n, err := agentService.LoadCacheSnapshot(); err != nil {
+						logger.Error().Err(err).Msgf("An unknown error occurred when to restore the cache snapshot, restored %d results!", n)
+					}
+					go agentService.FollowPurges(purgesCtx)
 					router.RegisterRoutes()
 
 					logger.Info().Msg("🚀 " + app.AppName + " is running! listen on http://" + app.Hostname + ":" + app.Port)
@@ -134,6 +151,16 @@ func InitCluster(
 				}
 				i++
 
+				stopPurges()
+
+				// results are only cached by the requests, which are over after the shutdown of the server
+				if n, err := agentService.SaveCacheSnapshot(); err != nil {
+					logger.Error().Err(err).Msgf("%d- An unknown error occurred when to save the cache snapshot!", i)
+				} else {
+					logger.Info().Msgf("%d- Saved %d results to the cache snapshot succesfully!", i, n)
+				}
+				i++
+
 				if err := etcd.Close(); err != nil {
 					logger.Error().Err(err).Msgf("%d- An unknown error occurred when to closed the etcd!", i)
 				} else {
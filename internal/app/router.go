@@ -8,17 +8,20 @@ type Router struct {
 	app   *Application
 	Agent controller.AgentController
 	Other controller.OtherController
+	Cache controller.CacheController
 }
 
 func NewRouter(
 	app *Application,
 	agent controller.AgentController,
 	other controller.OtherController,
+	cache controller.CacheController,
 ) *Router {
 	return &Router{
 		app:   app,
 		Agent: agent,
 		Other: other,
+		Cache: cache,
 	}
 }
 
@@ -28,7 +31,23 @@ func (c *Router) RegisterRoutes() {
 	c.app.Router.GET("/metrics", c.Other.HandleMetrics)
 	c.app.Router.GET("/k8s/healthz", c.Other.HandleK8sHealthz)
 
+	// cache administration, requires the admin token
+	c.app.Router.GET("/admin/cache/stats", c.Cache.HandleStats)
+	c.app.Router.GET("/admin/cache/entries/{key}", c.Cache.HandleEntry)
+	c.app.Router.DELETE("/admin/cache/entries/{key}", c.Cache.HandleEntry)
+	c.app.Router.POST("/admin/cache/keys/{chain}", c.Cache.HandleKeys)
+	c.app.Router.POST("/admin/cache/purge", c.Cache.HandlePurge)
+
 	c.app.Router.POST("/{chain}", c.Agent.HandleCall)
 	c.app.Router.POST("/{apikey}/{chain}", c.Agent.HandleCall)
 	c.app.Router.POST("/rpc/{chain}", c.Agent.HandleCall)
+
+	// WebSocket connections of the same routes, which support eth_subscribe
+	c.app.Router.GET("/{chain}", c.Agent.HandleWebSocket)
+	c.app.Router.GET("/{apikey}/{chain}", c.Agent.HandleWebSocket)
+	c.app.Router.GET("/rpc/{chain}", c.Agent.HandleWebSocket)
+
+	// Server-Sent Events of the chain
+	c.app.Router.GET("/{chain}/events", c.Agent.HandleEvents)
+	c.app.Router.GET("/{apikey}/{chain}/events", c.Agent.HandleEvents)
 }
@@ -27,6 +27,19 @@ func NewConfInstance(etcd *clientv3.Client) *config.Conf {
 	k := koanf.New(".")
 	conf := &config.Conf{Koanf: k}
 
+	// the schema normalizes the params of the cache keys, the validation by it is enabled apart,
+	// it is loaded after the config is printed
+	defer func() {
+		if _, ok := conf.Get("jsonrpc.schema").([]byte); ok {
+			return
+		}
+		if b, err := os.ReadFile("config/ethereum-openrpc.json"); err != nil {
+			logger.Printf("Error read local jsonrpc schema: %v", err)
+		} else {
+			conf.Set("jsonrpc.schema", b)
+		}
+	}()
+
 	var source = "local"
 	defer func() {
 		config.LoadEndpointChains(conf, KoanfEndpointsToken)
@@ -95,20 +108,13 @@ func NewConfInstance(etcd *clientv3.Client) *config.Conf {
 		}
 	}
 
-	if conf.Bool("jsonrpc.enable_validation", false) && conf.Exists(KoanfEtcdJSONRPCSchemaToken) {
+	if conf.Exists(KoanfEtcdJSONRPCSchemaToken) {
 		resp, err := etcd.Get(context.Background(), conf.String(KoanfEtcdJSONRPCSchemaToken))
 		if err != nil {
 			logger.Printf("Error read etcd jsonrpc schema %v", err)
 		} else if len(resp.Kvs) > 0 && len(resp.Kvs[0].Value) > 0 {
 			conf.Set("jsonrpc.schema", resp.Kvs[0].Value)
 		}
-	} else if conf.Bool("jsonrpc.enable_validation", false) {
-		b, err := os.ReadFile("config/ethereum-openrpc.json")
-		if err != nil {
-			log.Printf("Error read local jsonrpc schema: %v", err)
-		} else {
-			conf.Set("jsonrpc.schema", b)
-		}
 	}
 
 	return conf
@@ -18,6 +18,9 @@ type EndpointServices = struct {
 type EndpointChain = struct {
 	ChainID   uint64 `yaml:"id" koanf:"id"`
 	ChainCode string `yaml:"code" koanf:"code"`
+	// Confirmations is the number of blocks after which a block is taken as finalized,
+	// for the chains without the finalized block tag
+	Confirmations uint64 `yaml:"confirmations,omitempty" koanf:"confirmations,omitempty"`
 
 	EndpointList `koanf:",omitempty,squash"`
 
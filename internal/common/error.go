@@ -149,9 +149,98 @@ func TooManyRequestsError(msg string, errs ...error) httpError {
 	return err
 }
 
+func InterceptError(msg string, errs ...error) httpError {
+	err := NewHttpError(403, "Intercept", msg, errs...)
+	_, file, line, _ := runtime.Caller(1)
+	err.file, err.line = file, line
+	return err
+}
+
+func UnavailableError(msg string, errs ...error) httpError {
+	err := NewHttpError(503, "Service Unavailable", msg, errs...)
+	_, file, line, _ := runtime.Caller(1)
+	err.file, err.line = file, line
+	return err
+}
+
 func InternalServerError(msg string, errs ...error) httpError {
 	err := NewHttpError(500, "Internal Server Error", msg, errs...)
 	_, file, line, _ := runtime.Caller(1)
 	err.file, err.line = file, line
 	return err
 }
+
+// JSON-RPC 2.0 error codes
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+	JSONRPCServerError    = -32000
+	// EIP-1474, the rate limit of the tenant is exceeded
+	JSONRPCLimitExceeded = -32005
+
+	// proxy-specific, the call is intercepted by the tenant or proxy policy
+	JSONRPCIntercepted = -32010
+	// proxy-specific, the api key is missing or invalid
+	JSONRPCUnauthorized = -32011
+	// proxy-specific, the call has timed out
+	JSONRPCTimeout = -32012
+	// proxy-specific, no endpoint of the chain is available
+	JSONRPCUnavailable = -32013
+	// proxy-specific, the endpoints have failed to answer the call
+	JSONRPCUpstreamError = -32014
+	// proxy-specific, the chain is not supported by the proxy
+	JSONRPCUnsupportedChain = -32015
+)
+
+// JSONRPCError is the error object of a JSON-RPC response, which is answered in place of the result
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e JSONRPCError) Error() string {
+	return helpers.Concat(strconv.Itoa(e.Code), ": ", e.Message)
+}
+
+func NewJSONRPCError(code int, msg string, data ...any) JSONRPCError {
+	err := JSONRPCError{
+		Code:    code,
+		Message: msg,
+	}
+	if len(data) > 0 {
+		err.Data = data[0]
+	}
+	return err
+}
+
+// JSONRPCErrorOf converts the HTTP error of a call to the JSON-RPC error answered in its place
+func JSONRPCErrorOf(err HTTPErrors) JSONRPCError {
+	code := JSONRPCInternalError
+	switch e, _ := err.(httpError); e.Name {
+	case "Bad Request":
+		code = JSONRPCInvalidRequest
+	case "Forbidden":
+		code = JSONRPCUnauthorized
+	case "Too Many Requests":
+		code = JSONRPCLimitExceeded
+	case "Timeout":
+		code = JSONRPCTimeout
+	case "Intercept":
+		code = JSONRPCIntercepted
+	case "Not Found":
+		code = JSONRPCUnsupportedChain
+	case "Service Unavailable":
+		code = JSONRPCUnavailable
+	case "Upstream Server Error":
+		code = JSONRPCUpstreamError
+	default:
+		if err.QueryStatus() == Timeout {
+			code = JSONRPCTimeout
+		}
+	}
+	return NewJSONRPCError(code, err.Message())
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"context"
+	"testing"
+)
+
+func TestJSONRPCErrorOf(t *testing.T) {
+	cases := []struct {
+		err    HTTPErrors
+		expect int
+	}{
+		{BadRequestError("Invalid JSON-RPC"), JSONRPCInvalidRequest},
+		{ForbiddenError("Invalid token"), JSONRPCUnauthorized},
+		{TooManyRequestsError("Token is overage"), JSONRPCLimitExceeded},
+		{TimeoutError("Request timed out"), JSONRPCTimeout},
+		{InterceptError("Method not allowed"), JSONRPCIntercepted},
+		{NotFoundError("Chain not supported"), JSONRPCUnsupportedChain},
+		{UnavailableError("No endpoint available"), JSONRPCUnavailable},
+		{UpstreamServerError("No answer from the endpoints"), JSONRPCUpstreamError},
+		{InternalServerError("Internal error"), JSONRPCInternalError},
+		{InternalServerError("Internal error", context.DeadlineExceeded), JSONRPCTimeout},
+	}
+
+	for _, c := range cases {
+		got := JSONRPCErrorOf(c.err)
+		if got.Code != c.expect {
+			t.Errorf("%s: expected %v, got %v", c.err, c.expect, got.Code)
+		}
+		if got.Message != c.err.Message() {
+			t.Errorf("expected %v, got %v", c.err.Message(), got.Message)
+		}
+	}
+}
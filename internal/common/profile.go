@@ -46,6 +46,13 @@ type ResponseProfile = struct {
 	Respond  bool               `json:"respond"`
 }
 
+type TransactionProfile = struct {
+	Hash  string `json:"hash"`
+	From  string `json:"from"`
+	To    string `json:"to,omitempty"`
+	Nonce uint64 `json:"nonce"`
+}
+
 type QueryProfile = struct {
 	Options OptionsProfile `json:"options"`
 
@@ -53,6 +60,14 @@ type QueryProfile = struct {
 
 	Responses []ResponseProfile `json:"responses"`
 
+	Transactions []TransactionProfile `json:"transactions,omitempty"`
+
+	// methods of the intercepted calls
+	Intercepts []string `json:"intercepts,omitempty"`
+
+	// failures of the calls answered as JSON-RPC errors
+	Errors []string `json:"errors,omitempty"`
+
 	ID        names.UUIDv4 `json:"id"`
 	Href      names.Url    `json:"href"`
 	Method    string       `json:"method"`
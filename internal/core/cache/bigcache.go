@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/allegro/bigcache"
+)
+
+// Bigcache adapts bigcache to ResultCache, the expiration of each entry is kept in the value,
+// entries are evicted by bigcache after the LifeWindow at the latest
+type Bigcache struct {
+	cache *bigcache.BigCache
+	counters
+}
+
+func NewBigcache(cache *bigcache.BigCache) *Bigcache {
+	return &Bigcache{cache: cache}
+}
+
+func (b *Bigcache) Get(ctx context.Context, key string) (Entry, bool) {
+	data, err := b.cache.Get(key)
+	if err != nil {
+		if !errors.Is(err, bigcache.ErrEntryNotFound) {
+			b.errors.Add(1)
+		}
+		b.misses.Add(1)
+		return Entry{}, false
+	}
+
+	entry, err := decodeEntry(data)
+	if err != nil {
+		b.errors.Add(1)
+		b.misses.Add(1)
+		return Entry{}, false
+	}
+	if entry.Expired() {
+		b.cache.Delete(key)
+		b.expired.Add(1)
+		b.misses.Add(1)
+		return Entry{}, false
+	}
+
+	b.hits.Add(1)
+	return entry, true
+}
+
+func (b *Bigcache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	if err := b.cache.Set(key, encodeEntry(NewEntry(value, ttl))); err != nil {
+		b.errors.Add(1)
+		return err
+	}
+	b.sets.Add(1)
+	return nil
+}
+
+func (b *Bigcache) Delete(ctx context.Context, key string) error {
+	if err := b.cache.Delete(key); err != nil && !errors.Is(err, bigcache.ErrEntryNotFound) {
+		b.errors.Add(1)
+		return err
+	}
+	b.deletes.Add(1)
+	return nil
+}
+
+func (b *Bigcache) Purge(ctx context.Context, prefix string) (int, error) {
+	if prefix == "" {
+		n := b.cache.Len()
+		if err := b.cache.Reset(); err != nil {
+			b.errors.Add(1)
+			return 0, err
+		}
+		b.deletes.Add(uint64(n))
+		return n, nil
+	}
+
+	keys := []string{}
+	for it := b.cache.Iterator(); it.SetNext(); {
+		info, err := it.Value()
+		if err == nil && strings.HasPrefix(info.Key(), prefix) {
+			keys = append(keys, info.Key())
+		}
+	}
+	n := 0
+	for _, key := range keys {
+		if err := b.cache.Delete(key); err == nil {
+			n++
+		}
+	}
+	b.deletes.Add(uint64(n))
+	return n, nil
+}
+
+func (b *Bigcache) Range(fn func(key string, entry Entry) bool) {
+	for it := b.cache.Iterator(); it.SetNext(); {
+		info, err := it.Value()
+		if err != nil {
+			continue
+		}
+		entry, err := decodeEntry(info.Value())
+		if err != nil || entry.Expired() {
+			continue
+		}
+		if !fn(info.Key(), entry) {
+			return
+		}
+	}
+}
+
+func (b *Bigcache) Stats() Stats {
+	stats := b.counters.stats("bigcache")
+	stats.Entries = int64(b.cache.Len())
+	stats.Size = int64(b.cache.Capacity())
+	return stats
+}
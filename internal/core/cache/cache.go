@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidEntry = errors.New("cache: invalid entry")
+
+// ResultCache is the storage of the results of JSON-RPC calls, each entry expires after its own ttl
+type ResultCache interface {
+	// Get returns the entry, expired entries are never returned
+	Get(ctx context.Context, key string) (Entry, bool)
+	// Set stores the value, it is not stored if the ttl is not positive
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	// Purge deletes the entries whose keys start with the prefix, all entries if the prefix is empty,
+	// returns the number of deleted entries
+	Purge(ctx context.Context, prefix string) (int, error)
+	Stats() Stats
+}
+
+// Entry is a cached value, times are in unix milliseconds
+type Entry struct {
+	Value []byte
+	// the time the entry was cached
+	T int64
+	// the time the entry expires
+	E int64
+}
+
+func NewEntry(value []byte, ttl time.Duration) Entry {
+	now := time.Now()
+	return Entry{
+		Value: value,
+		T:     now.UnixMilli(),
+		E:     now.Add(ttl).UnixMilli(),
+	}
+}
+
+func (e Entry) Expired() bool {
+	return e.E <= time.Now().UnixMilli()
+}
+
+// TTL returns the remaining time to live of the entry
+func (e Entry) TTL() time.Duration {
+	return time.Until(time.UnixMilli(e.E))
+}
+
+const entryHeaderSize = 16
+
+// encodeEntry encodes the entry into bytes, for the backends which only store bytes
+func encodeEntry(e Entry) []byte {
+	b := make([]byte, entryHeaderSize+len(e.Value))
+	binary.BigEndian.PutUint64(b[0:8], uint64(e.T))
+	binary.BigEndian.PutUint64(b[8:16], uint64(e.E))
+	copy(b[entryHeaderSize:], e.Value)
+	return b
+}
+
+func decodeEntry(b []byte) (Entry, error) {
+	if len(b) < entryHeaderSize {
+		return Entry{}, ErrInvalidEntry
+	}
+	return Entry{
+		T:     int64(binary.BigEndian.Uint64(b[0:8])),
+		E:     int64(binary.BigEndian.Uint64(b[8:16])),
+		Value: b[entryHeaderSize:],
+	}, nil
+}
+
+// Stats is the statistics of a cache, Entries and Size are -1 when the backend does not know them
+type Stats struct {
+	Backend   string `json:"backend"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Sets      uint64 `json:"sets"`
+	Deletes   uint64 `json:"deletes"`
+	Expired   uint64 `json:"expired"`
+	Evictions uint64 `json:"evictions"`
+	Errors    uint64 `json:"errors"`
+	Entries   int64  `json:"entries"`
+	Size      int64  `json:"size"`
+}
+
+type counters struct {
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	sets      atomic.Uint64
+	deletes   atomic.Uint64
+	expired   atomic.Uint64
+	evictions atomic.Uint64
+	errors    atomic.Uint64
+}
+
+func (c *counters) stats(backend string) Stats {
+	return Stats{
+		Backend:   backend,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Sets:      c.sets.Load(),
+		Deletes:   c.deletes.Load(),
+		Expired:   c.expired.Load(),
+		Evictions: c.evictions.Load(),
+		Errors:    c.errors.Load(),
+		Entries:   -1,
+		Size:      -1,
+	}
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+// Flights coalesces the identical calls in flight, the followers wait on the result of the leader
+type Flights struct {
+	mu    sync.Mutex
+	calls map[string]*Flight
+}
+
+// Flight is a call in flight
+type Flight struct {
+	done  chan struct{}
+	once  sync.Once
+	value any
+	ok    bool
+}
+
+func NewFlights() *Flights {
+	return &Flights{calls: map[string]*Flight{}}
+}
+
+// Join returns the flight of the key, the caller which starts the flight is the leader and must call Done
+func (f *Flights) Join(key string) (flight *Flight, leader bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if c, ok := f.calls[key]; ok {
+		return c, false
+	}
+
+	c := &Flight{done: make(chan struct{})}
+	f.calls[key] = c
+	return c, true
+}
+
+// Done publishes the value of the leader to the followers and ends the flight,
+// ok is false if the leader failed, only the first call takes effect
+func (f *Flights) Done(key string, flight *Flight, value any, ok bool) {
+	flight.once.Do(func() {
+		f.mu.Lock()
+		if f.calls[key] == flight {
+			delete(f.calls, key)
+		}
+		f.mu.Unlock()
+
+		flight.value, flight.ok = value, ok
+		close(flight.done)
+	})
+}
+
+func (f *Flights) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+// Wait blocks until the leader is done or the context ends, ok is false if the leader failed
+func (c *Flight) Wait(ctx context.Context) (any, bool) {
+	select {
+	case <-c.done:
+		return c.value, c.ok
+	case <-ctx.Done():
+		return nil, false
+	}
+}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlights(t *testing.T) {
+	ctx := context.Background()
+	f := NewFlights()
+
+	leader, ok := f.Join("eth_blockNumber")
+	if !ok {
+		t.Fatalf("expected %v, got %v", true, ok)
+	}
+
+	var wg sync.WaitGroup
+	values := make([]any, 3)
+	for i := range values {
+		flight, ok := f.Join("eth_blockNumber")
+		if ok {
+			t.Fatalf("expected %v, got %v", false, ok)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], _ = flight.Wait(ctx)
+		}(i)
+	}
+
+	f.Done("eth_blockNumber", leader, "0x10", true)
+	// later calls do not change the published value
+	f.Done("eth_blockNumber", leader, "0x11", true)
+	wg.Wait()
+
+	for _, v := range values {
+		if v != "0x10" {
+			t.Errorf("expected %v, got %v", "0x10", v)
+		}
+	}
+	if n := f.Len(); n != 0 {
+		t.Errorf("expected %d, got %d", 0, n)
+	}
+
+	// a new flight starts after the previous one is done
+	if _, ok := f.Join("eth_blockNumber"); !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	}
+}
+
+func TestFlightWaitCanceled(t *testing.T) {
+	f := NewFlights()
+	f.Join("eth_chainId")
+	flight, _ := f.Join("eth_chainId")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := flight.Wait(ctx); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+}
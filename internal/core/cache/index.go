@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+)
+
+// Index tracks the cache keys whose results depend on a range of block heights,
+// to find the entries to invalidate when the blocks of the range are replaced
+type Index struct {
+	mu     sync.Mutex
+	chains map[common.ChainId]*chainIndex
+}
+
+type indexRange struct {
+	from uint64
+	to   uint64
+	// unix milliseconds the key expires, 0 if never
+	expire int64
+}
+
+// chainIndex keeps the keys of a chain, ordered by the end of their range and by their expiration for the pruning,
+// the queues are not updated by the removals, their stale items are skipped and compacted
+type chainIndex struct {
+	keys    map[string]indexRange
+	heights indexQueue
+	expires indexQueue
+}
+
+type indexItem struct {
+	at  int64
+	key string
+}
+
+// indexQueue is a min-heap of the items by at
+type indexQueue []indexItem
+
+func (q indexQueue) Len() int           { return len(q) }
+func (q indexQueue) Less(i, j int) bool { return q[i].at < q[j].at }
+func (q indexQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *indexQueue) Push(x any)        { *q = append(*q, x.(indexItem)) }
+func (q *indexQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// the queues are rebuilt when their stale items outnumber the keys
+const minIndexCompaction = 64
+
+func NewIndex() *Index {
+	return &Index{chains: map[common.ChainId]*chainIndex{}}
+}
+
+// Add records that the entry of the key depends on the blocks from..to
+func (i *Index) Add(chainId common.ChainId, from, to uint64, key string) {
+	i.add(chainId, from, to, key, 0)
+}
+
+// AddExpiring records the key like Add, the key is forgotten after the ttl as its entry expires
+func (i *Index) AddExpiring(chainId common.ChainId, from, to uint64, key string, ttl time.Duration) {
+	i.add(chainId, from, to, key, time.Now().Add(ttl).UnixMilli())
+}
+
+func (i *Index) add(chainId common.ChainId, from, to uint64, key string, expire int64) {
+	if from > to {
+		from, to = to, from
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	c, ok := i.chains[chainId]
+	if !ok {
+		c = &chainIndex{keys: map[string]indexRange{}}
+		i.chains[chainId] = c
+	}
+	c.keys[key] = indexRange{from: from, to: to, expire: expire}
+	heap.Push(&c.heights, indexItem{at: _Height(to), key: key})
+	if expire > 0 {
+		heap.Push(&c.expires, indexItem{at: expire, key: key})
+	}
+	c.compact()
+}
+
+// Take removes and returns the keys which depend on any of the blocks from..to
+func (i *Index) Take(chainId common.ChainId, from, to uint64) []string {
+	return i.TakeFunc(chainId, from, to, nil)
+}
+
+// TakeFunc is Take of the keys accepted by the match, all keys if match is nil
+func (i *Index) TakeFunc(chainId common.ChainId, from, to uint64, match func(key string) bool) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	taken := []string{}
+	c, ok := i.chains[chainId]
+	if !ok {
+		return taken
+	}
+	now := time.Now().UnixMilli()
+	for key, r := range c.keys {
+		if r.from <= to && r.to >= from && (match == nil || match(key)) {
+			if r.expire == 0 || r.expire > now {
+				taken = append(taken, key)
+			}
+			delete(c.keys, key)
+		}
+	}
+	return taken
+}
+
+// Prune forgets the keys which only depend on blocks below the height, they are not reorganized anymore,
+// and the expired keys, only the keys pruned and the stale items of the queues are visited
+func (i *Index) Prune(chainId common.ChainId, below uint64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	c, ok := i.chains[chainId]
+	if !ok {
+		return
+	}
+	for len(c.heights) > 0 && c.heights[0].at < _Height(below) {
+		item := heap.Pop(&c.heights).(indexItem)
+		if r, ok := c.keys[item.key]; ok && _Height(r.to) == item.at {
+			delete(c.keys, item.key)
+		}
+	}
+	now := time.Now().UnixMilli()
+	for len(c.expires) > 0 && c.expires[0].at <= now {
+		item := heap.Pop(&c.expires).(indexItem)
+		if r, ok := c.keys[item.key]; ok && r.expire == item.at {
+			delete(c.keys, item.key)
+		}
+	}
+	c.compact()
+}
+
+func (i *Index) Len(chainId common.ChainId) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if c, ok := i.chains[chainId]; ok {
+		return len(c.keys)
+	}
+	return 0
+}
+
+// compact rebuilds the queues from the keys when most of their items are stale, the caller must hold the lock
+func (c *chainIndex) compact() {
+	if len(c.heights)+len(c.expires) <= 2*len(c.keys)+minIndexCompaction {
+		return
+	}
+	c.heights, c.expires = make(indexQueue, 0, len(c.keys)), indexQueue{}
+	for key, r := range c.keys {
+		c.heights = append(c.heights, indexItem{at: _Height(r.to), key: key})
+		if r.expire > 0 {
+			c.expires = append(c.expires, indexItem{at: r.expire, key: key})
+		}
+	}
+	heap.Init(&c.heights)
+	heap.Init(&c.expires)
+}
+
+// _Height orders the block heights as the items of the queues, the unbounded ranges are the highest
+func _Height(n uint64) int64 {
+	if n > uint64(1<<63-1) {
+		return 1<<63 - 1
+	}
+	return int64(n)
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	index := NewIndex()
+	index.Add(1, 100, 100, "block:100")
+	index.Add(1, 101, 101, "block:101")
+	index.Add(1, 120, 90, "logs:90-120")
+	index.Add(1, 10, 20, "logs:10-20")
+	index.Add(56, 101, 101, "bsc:block:101")
+
+	taken := index.Take(1, 101, math.MaxUint64)
+	slices.Sort(taken)
+	if !slices.Equal(taken, []string{"block:101", "logs:90-120"}) {
+		t.Errorf("expected %v, got %v", []string{"block:101", "logs:90-120"}, taken)
+	}
+	if taken := index.Take(1, 101, math.MaxUint64); len(taken) != 0 {
+		t.Errorf("expected %v, got %v", []string{}, taken)
+	}
+
+	index.Prune(1, 50)
+	if n := index.Len(1); n != 1 {
+		t.Errorf("expected %d, got %d", 1, n)
+	}
+	if n := index.Len(56); n != 1 {
+		t.Errorf("expected %d, got %d", 1, n)
+	}
+}
+
+func TestIndexExpiring(t *testing.T) {
+	index := NewIndex()
+	index.AddExpiring(1, 100, 100, "1:eth_call:a", time.Hour)
+	index.AddExpiring(1, 100, 100, "1:eth_getBalance:b", time.Hour)
+	index.AddExpiring(1, 101, 101, "1:eth_call:c", time.Millisecond)
+
+	time.Sleep(5 * time.Millisecond)
+	taken := index.TakeFunc(1, 100, 101, func(key string) bool { return strings.Contains(key, "eth_call") })
+	if !slices.Equal(taken, []string{"1:eth_call:a"}) {
+		t.Errorf("expected %v, got %v", []string{"1:eth_call:a"}, taken)
+	}
+	if n := index.Len(1); n != 1 {
+		t.Errorf("expected %d, got %d", 1, n)
+	}
+}
+
+func TestIndexPrune(t *testing.T) {
+	index := NewIndex()
+	for n := uint64(0); n < 1000; n++ {
+		index.Add(1, n, n, fmt.Sprint("block:", n))
+	}
+	// the key depends on a later block after it is added again
+	index.Add(1, 10, 2000, "block:10")
+	index.AddExpiring(1, 5000, 5000, "block:5000", time.Millisecond)
+	index.Take(1, 3, 3)
+
+	index.Prune(1, 900)
+	if n := index.Len(1); n != 102 {
+		t.Errorf("expected %d, got %d", 102, n)
+	}
+	if taken := index.Take(1, 10, 10); !slices.Equal(taken, []string{"block:10"}) {
+		t.Errorf("expected %v, got %v", []string{"block:10"}, taken)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	index.Prune(1, 0)
+	if n := index.Len(1); n != 100 {
+		t.Errorf("expected %d, got %d", 100, n)
+	}
+
+	// the stale items of the queues are compacted
+	c := index.chains[1]
+	if len(c.heights) > 2*len(c.keys)+minIndexCompaction {
+		t.Errorf("expected at most %d, got %d", 2*len(c.keys)+minIndexCompaction, len(c.heights))
+	}
+	for n := uint64(900); n < 1000; n++ {
+		index.Take(1, n, n)
+	}
+	for n := 0; n < 2*minIndexCompaction; n++ {
+		index.Add(1, 1, 1, "block:1")
+	}
+	if len(c.heights) > 2*len(c.keys)+minIndexCompaction {
+		t.Errorf("expected at most %d, got %d", 2*len(c.keys)+minIndexCompaction, len(c.heights))
+	}
+}
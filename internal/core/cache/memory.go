@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is an in-process cache with per-entry ttl, the least recently used entries
+// are evicted when the total size of the values exceeds the capacity
+type Memory struct {
+	shards []*memoryShard
+	counters
+}
+
+type memoryShard struct {
+	mu       sync.Mutex
+	items    map[string]*list.Element
+	lru      *list.List
+	size     int64
+	capacity int64
+	// expired entries are removed from the shard at most once per interval
+	cleanWindow time.Duration
+	cleanedAt   time.Time
+}
+
+type memoryItem struct {
+	key   string
+	entry Entry
+}
+
+// NewMemory creates a memory cache, capacity is in bytes and shards must be a power of 2
+func NewMemory(capacity int64, shards int, cleanWindow time.Duration) *Memory {
+	if shards < 1 {
+		shards = 1
+	}
+	m := &Memory{shards: make([]*memoryShard, shards)}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{
+			items:       map[string]*list.Element{},
+			lru:         list.New(),
+			capacity:    capacity / int64(shards),
+			cleanWindow: cleanWindow,
+			cleanedAt:   time.Now(),
+		}
+	}
+	return m
+}
+
+func (m *Memory) shard(key string) *memoryShard {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return m.shards[h.Sum64()&uint64(len(m.shards)-1)]
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (Entry, bool) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		m.misses.Add(1)
+		return Entry{}, false
+	}
+
+	item := el.Value.(*memoryItem)
+	if item.entry.Expired() {
+		s.remove(el)
+		m.expired.Add(1)
+		m.misses.Add(1)
+		return Entry{}, false
+	}
+
+	s.lru.MoveToFront(el)
+	m.hits.Add(1)
+	return item.entry, true
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if int64(len(value)) > s.capacity {
+		return nil
+	}
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+
+	s.items[key] = s.lru.PushFront(&memoryItem{key: key, entry: NewEntry(value, ttl)})
+	s.size += int64(len(value))
+	m.sets.Add(1)
+
+	if time.Since(s.cleanedAt) > s.cleanWindow {
+		m.expired.Add(s.clean())
+	}
+	for s.size > s.capacity {
+		s.remove(s.lru.Back())
+		m.evictions.Add(1)
+	}
+
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+		m.deletes.Add(1)
+	}
+	return nil
+}
+
+func (m *Memory) Purge(ctx context.Context, prefix string) (int, error) {
+	n := 0
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for key, el := range s.items {
+			if strings.HasPrefix(key, prefix) {
+				s.remove(el)
+				n++
+			}
+		}
+		s.mu.Unlock()
+	}
+	m.deletes.Add(uint64(n))
+	return n, nil
+}
+
+func (m *Memory) Range(fn func(key string, entry Entry) bool) {
+	for _, s := range m.shards {
+		s.mu.Lock()
+		items := make([]memoryItem, 0, len(s.items))
+		for _, el := range s.items {
+			if item := el.Value.(*memoryItem); !item.entry.Expired() {
+				items = append(items, *item)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, item := range items {
+			if !fn(item.key, item.entry) {
+				return
+			}
+		}
+	}
+}
+
+func (m *Memory) Stats() Stats {
+	stats := m.counters.stats("memory")
+	stats.Entries, stats.Size = 0, 0
+	for _, s := range m.shards {
+		s.mu.Lock()
+		stats.Entries += int64(len(s.items))
+		stats.Size += s.size
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+func (s *memoryShard) remove(el *list.Element) {
+	item := s.lru.Remove(el).(*memoryItem)
+	delete(s.items, item.key)
+	s.size -= int64(len(item.entry.Value))
+}
+
+// clean removes the expired entries, the caller must hold the lock
+func (s *memoryShard) clean() (n uint64) {
+	for el := s.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*memoryItem).entry.Expired() {
+			s.remove(el)
+			n++
+		}
+		el = prev
+	}
+	s.cleanedAt = time.Now()
+	return n
+}
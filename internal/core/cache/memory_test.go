@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryTTL(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(1024, 1, time.Minute)
+
+	m.Set(ctx, "long", []byte("1"), 24*time.Hour)
+	m.Set(ctx, "short", []byte("2"), 10*time.Millisecond)
+	m.Set(ctx, "none", []byte("3"), 0)
+
+	if entry, ok := m.Get(ctx, "long"); !ok || string(entry.Value) != "1" {
+		t.Errorf("expected %s, got %s", "1", entry.Value)
+	}
+	if entry, ok := m.Get(ctx, "long"); !ok || entry.TTL() < 23*time.Hour {
+		t.Errorf("expected ttl about %v, got %v", 24*time.Hour, entry.TTL())
+	}
+	if _, ok := m.Get(ctx, "none"); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := m.Get(ctx, "short"); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+
+	stats := m.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Expired != 1 || stats.Entries != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestMemoryEviction(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(10, 1, time.Minute)
+
+	m.Set(ctx, "a", []byte("aaaa"), time.Hour)
+	m.Set(ctx, "b", []byte("bbbb"), time.Hour)
+	// a is used recently, b is evicted
+	m.Get(ctx, "a")
+	m.Set(ctx, "c", []byte("cccc"), time.Hour)
+
+	if _, ok := m.Get(ctx, "b"); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+	if _, ok := m.Get(ctx, "a"); !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	}
+	if stats := m.Stats(); stats.Size != 8 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	m.Delete(ctx, "a")
+	if _, ok := m.Get(ctx, "a"); ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+}
+
+func TestMemoryPurge(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(1024, 4, time.Minute)
+
+	m.Set(ctx, "1:eth_call:a", []byte("1"), time.Hour)
+	m.Set(ctx, "1:eth_call:b", []byte("2"), time.Hour)
+	m.Set(ctx, "1:eth_getLogs:c", []byte("3"), time.Hour)
+	m.Set(ctx, "2:eth_call:a", []byte("4"), time.Hour)
+
+	if n, _ := m.Purge(ctx, "1:eth_call:"); n != 2 {
+		t.Errorf("expected %d, got %d", 2, n)
+	}
+	if _, ok := m.Get(ctx, "1:eth_getLogs:c"); !ok {
+		t.Errorf("expected %v, got %v", true, ok)
+	}
+	if n, _ := m.Purge(ctx, ""); n != 2 {
+		t.Errorf("expected %d, got %d", 2, n)
+	}
+	if stats := m.Stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/app/shared"
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// encoding flag of the values in redis
+const (
+	redisPlain      byte = 'j'
+	redisCompressed byte = 'z'
+)
+
+type RedisConfig struct {
+	Prefix string
+	// the upper limit of the ttl of entries, the given ttl is used if it is shorter
+	Expiry      time.Duration
+	Compression bool
+	// values smaller than this are never compressed
+	CompressionSize int
+	Timeout         time.Duration
+	// redis is skipped for a while after a failure
+	Cooldown time.Duration
+}
+
+// Redis is a cache shared by the nodes of the cluster,
+// any failure of redis is logged and treated as a miss
+type Redis struct {
+	logger   zerolog.Logger
+	redis    *shared.RedisClient
+	config   RedisConfig
+	failedAt atomic.Int64
+	counters
+}
+
+func NewRedis(logger zerolog.Logger, redis *shared.RedisClient, config RedisConfig) *Redis {
+	return &Redis{
+		logger: logger.With().Str("name", "redis_cache").Logger(),
+		redis:  redis,
+		config: config,
+	}
+}
+
+// Available reports whether redis is connected and not in the cooldown after a failure
+func (c *Redis) Available() bool {
+	if c == nil || c.redis == nil || c.redis.Client == nil {
+		return false
+	}
+	if t := c.failedAt.Load(); t > 0 && time.Since(time.UnixMilli(t)) < c.config.Cooldown {
+		return false
+	}
+	return true
+}
+
+func (c *Redis) fail(err error, msg string) {
+	c.errors.Add(1)
+	// only log the first failure of an outage
+	if c.failedAt.Swap(time.Now().UnixMilli()) == 0 {
+		c.logger.Warn().Err(err).Msgf("%s, fallback to memory cache", msg)
+	}
+}
+
+func (c *Redis) key(k string) string {
+	return c.config.Prefix + k
+}
+
+func (c *Redis) Get(ctx context.Context, key string) (Entry, bool) {
+	if !c.Available() {
+		c.misses.Add(1)
+		return Entry{}, false
+	}
+
+	// a canceled request must not be taken as a failure of redis
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.config.Timeout)
+	defer cancel()
+
+	data, err := c.redis.Client.Get(ctx, c.key(key)).Bytes()
+	if err == redis.Nil {
+		c.misses.Add(1)
+		return Entry{}, false
+	} else if err != nil {
+		c.fail(err, "Failed to get redis cache")
+		c.misses.Add(1)
+		return Entry{}, false
+	}
+	c.failedAt.Store(0)
+
+	entry, err := c.decode(data)
+	if err != nil {
+		c.logger.Warn().Err(err).Msgf("Failed to decode redis cache %s", key)
+		c.errors.Add(1)
+		c.misses.Add(1)
+		return Entry{}, false
+	}
+	if entry.Expired() {
+		c.expired.Add(1)
+		c.misses.Add(1)
+		return Entry{}, false
+	}
+
+	c.hits.Add(1)
+	return entry, true
+}
+
+func (c *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if !c.Available() {
+		return nil
+	}
+
+	if c.config.Expiry > 0 && ttl > c.config.Expiry {
+		ttl = c.config.Expiry
+	}
+	// redis does not support expiration shorter than 1ms
+	if ttl < time.Millisecond {
+		return nil
+	}
+
+	data, flag := encodeEntry(NewEntry(value, ttl)), redisPlain
+	if c.config.Compression && len(data) >= c.config.CompressionSize {
+		if compressed, err := helpers.Compress(data); err != nil {
+			c.logger.Warn().Err(err).Msg("Failed to compress")
+		} else if len(compressed) < len(data) {
+			data, flag = compressed, redisCompressed
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.config.Timeout)
+	defer cancel()
+
+	if err := c.redis.Client.Set(ctx, c.key(key), append([]byte{flag}, data...), ttl).Err(); err != nil {
+		c.fail(err, "Failed to set redis cache")
+		return err
+	}
+	c.failedAt.Store(0)
+	c.sets.Add(1)
+	return nil
+}
+
+func (c *Redis) Delete(ctx context.Context, key string) error {
+	if !c.Available() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.config.Timeout)
+	defer cancel()
+
+	if err := c.redis.Client.Del(ctx, c.key(key)).Err(); err != nil {
+		c.fail(err, "Failed to delete redis cache")
+		return err
+	}
+	c.deletes.Add(1)
+	return nil
+}
+
+// the special characters of the patterns of SCAN
+var redisPatternReplacer = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (c *Redis) Purge(ctx context.Context, prefix string) (int, error) {
+	if !c.Available() {
+		return 0, nil
+	}
+
+	var (
+		n      = 0
+		cursor uint64
+		match  = redisPatternReplacer.Replace(c.key(prefix)) + "*"
+	)
+	for {
+		keys, next, err := c.redis.Client.Scan(ctx, cursor, match, 1000).Result()
+		if err != nil {
+			c.fail(err, "Failed to scan redis cache")
+			return n, err
+		}
+		if len(keys) > 0 {
+			deleted, err := c.redis.Client.Del(ctx, keys...).Result()
+			if err != nil {
+				c.fail(err, "Failed to delete redis cache")
+				return n, err
+			}
+			n += int(deleted)
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	c.deletes.Add(uint64(n))
+	return n, nil
+}
+
+func (c *Redis) Stats() Stats {
+	return c.counters.stats("redis")
+}
+
+func (c *Redis) decode(data []byte) (Entry, error) {
+	if len(data) < 1 {
+		return Entry{}, ErrInvalidEntry
+	}
+	switch data[0] {
+	case redisCompressed:
+		b, err := helpers.Decompress(data[1:])
+		if err != nil {
+			return Entry{}, err
+		}
+		return decodeEntry(b)
+	case redisPlain:
+		return decodeEntry(data[1:])
+	}
+	return Entry{}, ErrInvalidEntry
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Iterable is implemented by the in-process backends, whose entries can be written to a snapshot
+type Iterable interface {
+	// Range calls fn for each entry which is not expired, until fn returns false
+	Range(fn func(key string, entry Entry) bool)
+}
+
+const (
+	snapshotMagic   = "W3RPSNAP"
+	snapshotVersion = uint16(1)
+	// keys and values bigger than this are corrupted
+	snapshotMaxSize = 64 * 1024 * 1024
+)
+
+var (
+	ErrSnapshotHeader  = errors.New("cache: invalid snapshot header")
+	ErrSnapshotVersion = errors.New("cache: unsupported snapshot version")
+	ErrSnapshotEntry   = errors.New("cache: corrupted snapshot entry")
+)
+
+// WriteSnapshot writes the entries accepted by the filter, after a header of the magic, the version and the time,
+// each entry is followed by its crc32 checksum, returns the number of written entries
+func WriteSnapshot(w io.Writer, c Iterable, filter func(key string, entry Entry) bool) (n int, err error) {
+	bw := bufio.NewWriter(w)
+
+	header := make([]byte, len(snapshotMagic)+10)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[len(snapshotMagic):], snapshotVersion)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+2:], uint64(time.Now().UnixMilli()))
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+
+	c.Range(func(key string, entry Entry) bool {
+		if filter != nil && !filter(key, entry) {
+			return true
+		}
+
+		b := make([]byte, 4+len(key)+16+4+len(entry.Value)+4)
+		i := 0
+		binary.BigEndian.PutUint32(b[i:], uint32(len(key)))
+		i += 4
+		i += copy(b[i:], key)
+		binary.BigEndian.PutUint64(b[i:], uint64(entry.T))
+		binary.BigEndian.PutUint64(b[i+8:], uint64(entry.E))
+		i += 16
+		binary.BigEndian.PutUint32(b[i:], uint32(len(entry.Value)))
+		i += 4
+		i += copy(b[i:], entry.Value)
+		binary.BigEndian.PutUint32(b[i:], crc32.ChecksumIEEE(b[:i]))
+
+		if _, err = bw.Write(b); err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, bw.Flush()
+}
+
+// ReadSnapshot reads the entries of the snapshot, the expired entries are skipped,
+// reading stops at the first corrupted entry, the entries before it are kept
+func ReadSnapshot(r io.Reader, fn func(key string, entry Entry)) (n int, err error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(snapshotMagic)+10)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, ErrSnapshotHeader
+	}
+	if binary.BigEndian.Uint16(header[len(snapshotMagic):]) != snapshotVersion {
+		return 0, ErrSnapshotVersion
+	}
+
+	var (
+		now  = time.Now().UnixMilli()
+		size = make([]byte, 4)
+	)
+	for {
+		if _, err := io.ReadFull(br, size); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, ErrSnapshotEntry
+		}
+		keySize := binary.BigEndian.Uint32(size)
+		if keySize > snapshotMaxSize {
+			return n, ErrSnapshotEntry
+		}
+
+		b := make([]byte, 4+int(keySize)+16+4)
+		copy(b, size)
+		if _, err := io.ReadFull(br, b[4:]); err != nil {
+			return n, ErrSnapshotEntry
+		}
+		valueSize := binary.BigEndian.Uint32(b[len(b)-4:])
+		if valueSize > snapshotMaxSize {
+			return n, ErrSnapshotEntry
+		}
+		b = append(b, make([]byte, int(valueSize)+4)...)
+		if _, err := io.ReadFull(br, b[len(b)-int(valueSize)-4:]); err != nil {
+			return n, ErrSnapshotEntry
+		}
+		if crc32.ChecksumIEEE(b[:len(b)-4]) != binary.BigEndian.Uint32(b[len(b)-4:]) {
+			return n, ErrSnapshotEntry
+		}
+
+		i := 4 + int(keySize)
+		entry := Entry{
+			T:     int64(binary.BigEndian.Uint64(b[i:])),
+			E:     int64(binary.BigEndian.Uint64(b[i+8:])),
+			Value: b[i+20 : len(b)-4],
+		}
+		if entry.E <= now {
+			continue
+		}
+		fn(string(b[4:4+keySize]), entry)
+		n++
+	}
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(1024*1024, 4, time.Minute)
+	m.Set(ctx, "1:eth_getBlockByNumber:a", []byte(`{"number":"0x1"}`), 24*time.Hour)
+	m.Set(ctx, "1:eth_getTransactionReceipt:b", []byte(`{"status":"0x1"}`), 24*time.Hour)
+	m.Set(ctx, "1:eth_blockNumber:c", []byte(`"0x1"`), time.Second)
+
+	var buf bytes.Buffer
+	n, err := WriteSnapshot(&buf, m, func(key string, entry Entry) bool {
+		return entry.TTL() > time.Minute
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("expected %d, got %d (%v)", 2, n, err)
+	}
+
+	restored := map[string]Entry{}
+	n, err = ReadSnapshot(bytes.NewReader(buf.Bytes()), func(key string, entry Entry) {
+		restored[key] = entry
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("expected %d, got %d (%v)", 2, n, err)
+	}
+	if v := string(restored["1:eth_getBlockByNumber:a"].Value); v != `{"number":"0x1"}` {
+		t.Errorf("expected %s, got %s", `{"number":"0x1"}`, v)
+	}
+	if ttl := restored["1:eth_getTransactionReceipt:b"].TTL(); ttl < 23*time.Hour {
+		t.Errorf("expected ttl about %v, got %v", 24*time.Hour, ttl)
+	}
+
+	// the entries before a corrupted entry are kept
+	b := bytes.Clone(buf.Bytes())
+	b[len(b)-5] ^= 0xff
+	n, err = ReadSnapshot(bytes.NewReader(b), func(key string, entry Entry) {})
+	if err != ErrSnapshotEntry || n != 1 {
+		t.Errorf("expected %d (%v), got %d (%v)", 1, ErrSnapshotEntry, n, err)
+	}
+
+	if _, err := ReadSnapshot(strings.NewReader("not a snapshot"), func(key string, entry Entry) {}); err != ErrSnapshotHeader {
+		t.Errorf("expected %v, got %v", ErrSnapshotHeader, err)
+	}
+}
@@ -103,7 +103,7 @@ func (c *client) Request(ctx context.Context, rc reqctx.Reqctxs, endpoints []*en
 	}
 
 	if len(results) <= 0 {
-		return nil, common.InternalServerError("All endpoints are unavailable")
+		return nil, common.UnavailableError("All endpoints are unavailable")
 	}
 
 	return results, nil
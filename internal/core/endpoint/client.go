@@ -26,7 +26,14 @@ type Client interface {
 type ClientFactoryConfig struct {
 	Transport     *http.Transport
 	JSONRPCSchema *rpc.JSONRPCSchema
-	ClientsSize   int
+	// classifies the errors of the endpoints recorded in the profiles
+	Normalizer  *rpc.ErrorNormalizer
+	ClientsSize int
+	// keepalive and reconnection of the WebSocket endpoints
+	PingInterval time.Duration
+	IdleTimeout  time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
 }
 
 type ClientFactory struct {
@@ -59,6 +66,11 @@ func (ef *ClientFactory) GetClient(endpoint *Endpoint) Client {
 			client = NewWebSocketClient(endpoint, &websocketClientConfig{
 				Transport:     ef.config.Transport,
 				JSONRPCSchema: ef.config.JSONRPCSchema,
+				Normalizer:    ef.config.Normalizer,
+				PingInterval:  ef.config.PingInterval,
+				IdleTimeout:   ef.config.IdleTimeout,
+				MinBackoff:    ef.config.MinBackoff,
+				MaxBackoff:    ef.config.MaxBackoff,
 			})
 			if client != nil {
 				break
@@ -68,6 +80,7 @@ func (ef *ClientFactory) GetClient(endpoint *Endpoint) Client {
 		client = NewHTTPClient(endpoint, &httpClientConfig{
 			Transport:     ef.config.Transport,
 			JSONRPCSchema: ef.config.JSONRPCSchema,
+			Normalizer:    ef.config.Normalizer,
 		})
 	}
 
@@ -105,7 +118,8 @@ func updateMetrics(endpoint *Endpoint, profile *common.ResponseProfile) {
 	if profile.Duration > 0 {
 		ops = append(ops, WithAttr(Duration, profile.Duration*1.0))
 	}
-	if profile.Code == "" && profile.Status >= 200 && profile.Status < 300 {
+	// the JSON-RPC errors of the calls, e.g. reverts, are recorded without an error, they are not failures of the endpoint
+	if profile.Error == "" && profile.Status >= 200 && profile.Status < 300 {
 		ops = append(ops, WithAttr(Health, true))
 	} else {
 		ops = append(ops, WithAttr(Health, false))
@@ -116,6 +130,9 @@ func updateMetrics(endpoint *Endpoint, profile *common.ResponseProfile) {
 
 func validateResults(logger zerolog.Logger, jrpcSchema *rpc.JSONRPCSchema, profile *common.ResponseProfile, data []rpc.SealedJSONRPC, results []rpc.JSONRPCResulter) error {
 	for i := range results {
+		if results[i].Type() == rpc.JSONRPC_ERROR {
+			continue
+		}
 		if err := jrpcSchema.ValidateResponse(data[i].Method, results[i].Raw(), true); err != nil {
 			v1, _ := json.Marshal(data[i])
 			v2, _ := json.Marshal(results[i].Raw())
@@ -130,10 +147,14 @@ func validateResults(logger zerolog.Logger, jrpcSchema *rpc.JSONRPCSchema, profi
 	return nil
 }
 
-func recordingErrorResult(profile *common.ResponseProfile, result rpc.JSONRPCResulter) {
+// recordingErrorResult records the error of the result, the code is the canonical type of the error if it is classified
+func recordingErrorResult(profile *common.ResponseProfile, result rpc.JSONRPCResulter, normalizer *rpc.ErrorNormalizer, endpoint *Endpoint) {
 	if v, ok := result.Error().(map[string]any); ok {
 		profile.Code = fmt.Sprint(v["code"])
 		profile.Message = fmt.Sprint(v["message"])
+		if kind, ok := normalizer.Classify(v, strconv.FormatUint(endpoint.ChainID(), 10), endpoint.ChainCode()); ok {
+			profile.Code = kind
+		}
 	} else {
 		profile.Code = "unknown_error"
 		profile.Message = fmt.Sprint(v)
@@ -0,0 +1,64 @@
+package endpoint
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+)
+
+func TestUpdateMetricsHealth(t *testing.T) {
+	u, _ := url.Parse("http://localhost:8545")
+
+	cases := []struct {
+		name    string
+		profile common.ResponseProfile
+		expect  bool
+	}{
+		{"result", common.ResponseProfile{Status: 200}, true},
+		{"JSON-RPC error of the call", common.ResponseProfile{Status: 200, Code: "3", Message: "execution reverted"}, true},
+		{"connection error", common.ResponseProfile{Code: "connection_error", Error: "EOF"}, false},
+		{"schema validation", common.ResponseProfile{Status: 200, Code: "schema_validation_failed", Error: "invalid"}, false},
+		{"http error", common.ResponseProfile{Status: 502, Code: "http_error"}, false},
+	}
+
+	for _, c := range cases {
+		e := New(u)
+		updateMetrics(e, &c.profile)
+		if e.Health() != c.expect {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expect, e.Health())
+		}
+	}
+}
+
+func TestHTTPClientErrorCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"jsonrpc":"2.0","id":"1","result":"0x1"},{"jsonrpc":"2.0","id":"2","error":{"code":3,"message":"execution reverted","data":"0x08c379a0"}}]`))
+	}))
+	defer server.Close()
+
+	normalizer, _ := rpc.NewErrorNormalizer(nil, nil)
+	u, _ := url.Parse(server.URL)
+	e := New(u)
+	client := NewHTTPClient(e, &httpClientConfig{Transport: &http.Transport{}, Normalizer: normalizer})
+
+	profile := common.ResponseProfile{}
+	data := []rpc.SealedJSONRPC{
+		{Version: rpc.JSONRPC_VERSION_2, ID: "1", Method: "eth_blockNumber"},
+		{Version: rpc.JSONRPC_VERSION_2, ID: "2", Method: "eth_call"},
+	}
+	if _, err := client.Call(context.Background(), data, &profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Code != rpc.ErrorReverted || profile.Message != "execution reverted" {
+		t.Errorf("expected %v, got %v %v", rpc.ErrorReverted, profile.Code, profile.Message)
+	}
+	if !e.Health() {
+		t.Errorf("expected %v, got %v", true, e.Health())
+	}
+}
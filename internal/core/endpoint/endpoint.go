@@ -67,6 +67,7 @@ const (
 	Url            EndpointAttribute = "url"
 	Headers        EndpointAttribute = "headers"
 	Weight         EndpointAttribute = "weight"
+	LogsRange      EndpointAttribute = "logs_range" // learned block range limit of eth_getLogs
 )
 
 func (e *Endpoint) Read(name EndpointAttribute) any {
@@ -168,6 +169,9 @@ func (e *Endpoint) Headers() map[string]string {
 func (e *Endpoint) Weight() int {
 	return _int(e.Read(Weight))
 }
+func (e *Endpoint) LogsRange() uint64 {
+	return _uint64(e.Read(LogsRange))
+}
 func (e *Endpoint) String() string {
 	return fmt.Sprintf("[%d %s]", e.ChainID(), e.Url())
 }
@@ -19,6 +19,7 @@ import (
 type httpClientConfig struct {
 	Transport     *http.Transport
 	JSONRPCSchema *rpc.JSONRPCSchema
+	Normalizer    *rpc.ErrorNormalizer
 }
 
 type httpClient struct {
@@ -144,8 +145,14 @@ func (e *httpClient) Call(ctx context.Context, data []rpc.SealedJSONRPC, profile
 		return nil, common.InternalServerError("Unmarshalling response failed", err)
 	}
 
+	// the first error is recorded, a single error may answer the whole batch
+	for _, r := range results {
+		if r.Type() == rpc.JSONRPC_ERROR {
+			recordingErrorResult(profile, r, e.config.Normalizer, e.endpoint)
+			break
+		}
+	}
 	if !isBatchResult && len(results) > 0 && results[0].Type() == rpc.JSONRPC_ERROR {
-		recordingErrorResult(profile, results[0])
 		return results, nil
 	}
 
@@ -0,0 +1,175 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+)
+
+// Subscriber is implemented by the clients which support eth_subscribe, the WebSocket clients
+type Subscriber interface {
+	// Subscribe starts a subscription of the eth_subscribe params, e.g. newHeads
+	Subscribe(ctx context.Context, params ...any) (*Subscription, error)
+}
+
+// Subscription is a long-lived subscription of an endpoint, which is subscribed again after a reconnection,
+// C receives the results of the notifications until it is unsubscribed or ended, Err tells why it is ended
+type Subscription struct {
+	C <-chan any
+
+	c      chan any
+	params []any
+	client *websocketClient
+	// the upstream id, it changes after a reconnection
+	id     atomic.Value
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+// ErrClientClosed ends the subscriptions of a closed client
+var ErrClientClosed = errors.New("client closed")
+
+// subscriptionBuffer is the number of notifications buffered, the notifications of a slow consumer are dropped
+const subscriptionBuffer = 256
+
+var _ Subscriber = (*websocketClient)(nil)
+
+func (s *Subscription) ID() string {
+	id, _ := s.id.Load().(string)
+	return id
+}
+
+// Err returns the error which ended the subscription after C is closed, nil if it is unsubscribed
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// end closes C as the subscription cannot be continued, e.g. it is not subscribed again after a reconnection
+func (s *Subscription) end(err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed, s.err = true, err
+	close(s.c)
+	s.mu.Unlock()
+
+	s.client.subs.Delete(s.ID())
+}
+
+// Unsubscribe ends the subscription and closes C
+func (s *Subscription) Unsubscribe() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.c)
+	s.mu.Unlock()
+
+	id := s.ID()
+	s.client.subs.Delete(id)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.client.subscribe(ctx, "eth_unsubscribe", []any{id}, nil)
+}
+
+// send delivers the result without waiting, reports false if it is dropped
+func (s *Subscription) send(result any) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return true
+	}
+	select {
+	case s.c <- result:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *websocketClient) Subscribe(ctx context.Context, params ...any) (*Subscription, error) {
+	c := make(chan any, subscriptionBuffer)
+	sub := &Subscription{C: c, c: c, params: params, client: e}
+	sub.id.Store("")
+	if err := e.subscribe(ctx, "eth_subscribe", params, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// subscribe calls eth_subscribe or eth_unsubscribe, the subscription is registered by the reading of the answer
+func (e *websocketClient) subscribe(ctx context.Context, method string, params []any, sub *Subscription) error {
+	data := []rpc.SealedJSONRPC{{
+		Version: rpc.JSONRPC_VERSION_2,
+		ID:      "1",
+		Method:  method,
+		Params:  params,
+	}}
+
+	results, err := e.call(ctx, data, sub)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return errors.New("no answer of " + method)
+	}
+	if err := results[0].Error(); err != nil {
+		return fmt.Errorf("%s: %v", method, err)
+	}
+	if sub != nil && sub.ID() == "" {
+		return fmt.Errorf("%s: invalid subscription id %v", method, results[0].Result())
+	}
+	return nil
+}
+
+// resubscribe subscribes the subscriptions again on the new connection, their previous ids are dropped
+func (e *websocketClient) resubscribe() {
+	subs := []*Subscription{}
+	e.subs.Range(func(key, value any) bool {
+		e.subs.Delete(key)
+		subs = append(subs, value.(*Subscription))
+		return true
+	})
+
+	for _, sub := range subs {
+		sub.mu.Lock()
+		closed := sub.closed
+		sub.mu.Unlock()
+		if closed {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := e.subscribe(ctx, "eth_subscribe", sub.params, sub); err != nil {
+			e.logger.Error().Err(err).Msgf("Failed to subscribe %v again", sub.params)
+			sub.end(fmt.Errorf("subscribing again: %w", err))
+		}
+		cancel()
+	}
+}
+
+// notify delivers the eth_subscription notification to its subscription
+func (e *websocketClient) notify(notification rpc.JSONRPCResulter) {
+	params, _ := notification.Raw()["params"].(map[string]any)
+	id, _ := params["subscription"].(string)
+	v, ok := e.subs.Load(id)
+	if !ok {
+		return
+	}
+
+	if !v.(*Subscription).send(params["result"]) {
+		e.logger.Warn().Msgf("Dropped a notification of the slow subscription %s", id)
+	}
+}
@@ -0,0 +1,154 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketSubscription(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := connections.Add(1)
+		id := "0xs" + string(rune('0'+n))
+
+		for {
+			var req []map[string]any
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			if req[0]["method"] != "eth_subscribe" {
+				conn.WriteJSON([]map[string]any{{"jsonrpc": "2.0", "id": req[0]["id"], "result": true}})
+				continue
+			}
+			conn.WriteJSON([]map[string]any{{"jsonrpc": "2.0", "id": req[0]["id"], "result": id}})
+			conn.WriteJSON(map[string]any{"jsonrpc": "2.0", "method": "eth_subscription", "params": map[string]any{"subscription": id, "result": id}})
+			// the first connection is closed by the server after the notification
+			if n == 1 {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			}
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	client := NewWebSocketClient(New(u), &websocketClientConfig{})
+	if client == nil {
+		t.Fatal("expected a client")
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub, err := client.(Subscriber).Subscribe(ctx, "newHeads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the notification of the first connection, and of the subscription again on the second one
+	for _, expected := range []string{"0xs1", "0xs2"} {
+		select {
+		case v := <-sub.C:
+			if v != expected {
+				t.Errorf("expected %v, got %v", expected, v)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected %v, got none", expected)
+		}
+	}
+	if id := sub.ID(); id != "0xs2" {
+		t.Errorf("expected %v, got %v", "0xs2", id)
+	}
+
+	sub.Unsubscribe()
+	if _, ok := <-sub.C; ok {
+		t.Errorf("expected %v, got %v", false, ok)
+	}
+}
+
+func TestWebSocketSubscriptionEnd(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := connections.Add(1)
+
+		for {
+			var req []map[string]any
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			// the subscriptions are refused after the first connection
+			if n > 1 && req[0]["method"] == "eth_subscribe" {
+				conn.WriteJSON([]map[string]any{{"jsonrpc": "2.0", "id": req[0]["id"], "error": map[string]any{"code": -32601, "message": "notifications not supported"}}})
+				continue
+			}
+			params, _ := req[0]["params"].([]any)
+			conn.WriteJSON([]map[string]any{{"jsonrpc": "2.0", "id": req[0]["id"], "result": fmt.Sprint("0x", params[0])}})
+			if n == 1 && req[0]["method"] == "eth_subscribe" && params[0] == "newHeads" {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			}
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	client := NewWebSocketClient(New(u), &websocketClientConfig{})
+	if client == nil {
+		t.Fatal("expected a client")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pending, err := client.(Subscriber).Subscribe(ctx, "newPendingTransactions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	heads, err := client.(Subscriber).Subscribe(ctx, "newHeads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the subscriptions refused on the new connection are ended
+	for _, sub := range []*Subscription{pending, heads} {
+		select {
+		case _, ok := <-sub.C:
+			if ok {
+				t.Errorf("expected %v, got %v", false, ok)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected %v, got none", "the end of the subscription")
+		}
+		if sub.Err() == nil {
+			t.Errorf("expected %v, got %v", "an error", sub.Err())
+		}
+	}
+
+	// the subscriptions of a closed client are ended
+	client.Close()
+	c := make(chan any)
+	sub := &Subscription{C: c, c: c, client: client.(*websocketClient)}
+	sub.id.Store("0xs9")
+	client.(*websocketClient).subs.Store("0xs9", sub)
+	client.Close()
+	if _, ok := <-sub.C; ok || !errors.Is(sub.Err(), ErrClientClosed) {
+		t.Errorf("expected %v, got %v %v", ErrClientClosed, ok, sub.Err())
+	}
+}
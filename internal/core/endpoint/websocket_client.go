@@ -4,18 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GoPlugin/web3rpcproxy/internal/common"
 	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
-	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
-	"github.com/duke-git/lancet/v2/slice"
+	"github.com/GoPlugin/web3rpcproxy/utils"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 )
@@ -23,17 +23,110 @@ import (
 type websocketClientConfig struct {
 	Transport     *http.Transport
 	JSONRPCSchema *rpc.JSONRPCSchema
+	Normalizer    *rpc.ErrorNormalizer
+	// the connection is pinged at the interval, and reconnected when nothing is read within the idle timeout
+	PingInterval time.Duration
+	IdleTimeout  time.Duration
+	// delays of the reconnection attempts, doubled after each failure up to the max
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
 }
 
+// ErrWebSocketDisconnected fails the requests of a lost connection, they are retried by the next endpoints
+var ErrWebSocketDisconnected = errors.New("websocket connection is lost")
+
 type websocketClient struct {
 	logger   zerolog.Logger
 	endpoint *Endpoint
-	conn     *websocket.Conn
-	sessions sync.Map
-	ctx      context.Context
-	cancel   context.CancelFunc
-	mu       sync.Mutex
-	config   *websocketClientConfig
+	// the current connection, nil while reconnecting
+	conn       *websocket.Conn
+	connCancel context.CancelFunc
+	// the items of the calls are sent with proxy-unique numeric ids, their answers are delivered by the id
+	seq     atomic.Uint64
+	waiters sync.Map
+	// canceled by Close, which ends the reconnection
+	ctx    context.Context
+	cancel context.CancelFunc
+	// guards the connection and its writes
+	mu     sync.Mutex
+	config *websocketClientConfig
+
+	// subscriptions by their upstream id
+	subs sync.Map
+}
+
+// wsItem is an item of a call as it is sent, with the proxy id in place of the id of the client
+type wsItem struct {
+	Params  []any  `json:"params"`
+	ID      uint64 `json:"id"`
+	Version string `json:"jsonrpc,omitempty"`
+	Method  string `json:"method"`
+}
+
+// wsWaiter collects the answers of the items of a call, the items have the ids first to first+len(data)-1
+type wsWaiter struct {
+	data    []rpc.SealedJSONRPC
+	first   uint64
+	results []rpc.JSONRPCResulter
+	left    int
+	// registered by the answer of eth_subscribe, before the notifications following it are read
+	sub *Subscription
+
+	mu     sync.Mutex
+	done   chan struct{}
+	failed bool
+}
+
+func newWSWaiter(data []rpc.SealedJSONRPC, first uint64, sub *Subscription) *wsWaiter {
+	return &wsWaiter{
+		data:    data,
+		first:   first,
+		results: make([]rpc.JSONRPCResulter, len(data)),
+		left:    len(data),
+		sub:     sub,
+		done:    make(chan struct{}),
+	}
+}
+
+// deliver places the answer of the item with the id of the client restored, reports whether it is the last one
+func (w *wsWaiter) deliver(id uint64, raw map[string]any) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	i := int(id - w.first)
+	if w.left <= 0 || i < 0 || i >= len(w.data) || w.results[i] != nil {
+		return false
+	}
+	raw["id"] = w.data[i].ID
+	w.results[i] = rpc.NewJSONRPCResult(raw)
+	if w.left--; w.left == 0 {
+		close(w.done)
+		return true
+	}
+	return false
+}
+
+// fail ends the waiting of the answers left
+func (w *wsWaiter) fail() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.left > 0 {
+		w.left, w.failed = 0, true
+		close(w.done)
+	}
+}
+
+// _WSItemID returns the proxy id of an answer
+func _WSItemID(raw map[string]any) (uint64, bool) {
+	switch id := raw["id"].(type) {
+	case float64:
+		return uint64(id), id >= 1 && id == float64(uint64(id))
+	case string:
+		v, err := strconv.ParseUint(id, 10, 64)
+		return v, err == nil
+	}
+	return 0, false
 }
 
 func NewWebSocketClient(endpoint *Endpoint, config *websocketClientConfig) Client {
@@ -48,11 +141,13 @@ func NewWebSocketClient(endpoint *Endpoint, config *websocketClientConfig) Clien
 		logger:   logger,
 		config:   config,
 	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.state(false)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(e.ctx, 5*time.Second)
 	defer cancel()
-	e.conn = e.connect(ctx)
-	if e.conn == nil {
+	if err := e.connect(ctx); err != nil {
+		e.cancel()
 		e = nil
 		return nil
 	}
@@ -60,61 +155,101 @@ func NewWebSocketClient(endpoint *Endpoint, config *websocketClientConfig) Clien
 	return e
 }
 
-func getJSONResultKey(data []rpc.JSONRPCResulter) string {
-	ids := slice.Map(data, func(i int, result rpc.JSONRPCResulter) string {
-		return result.ID()
-	})
-	slice.Sort(ids)
-	return helpers.Short(slice.Join(ids, ""))
-}
-
-func background(ctx context.Context, logger zerolog.Logger, conn *websocket.Conn, sessions *sync.Map) {
+// background reads the messages of the connection until it is lost
+func (e *websocketClient) background(ctx context.Context, conn *websocket.Conn) {
+	logger := e.logger
 	defer func() {
 		if err := recover(); err != nil {
 			logger.Error().Interface("error", err).Msg("Failed to revceive message")
 		}
+		e.disconnect(conn)
 	}()
 
 	for {
-		select {
-		case <-ctx.Done():
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn().Msgf("Error reading message: %v", err)
+			}
 			return
-		default:
-			messageType, message, err := conn.ReadMessage()
+		}
+		e.extend(conn)
+
+		if messageType == websocket.TextMessage {
+			results, isBatchResult, err := rpc.UnmarshalJSONRPCResults(message)
 			if err != nil {
-				logger.Warn().Msgf("Error reading message: %v", err)
-				if websocket.IsCloseError(err, websocket.CloseAbnormalClosure, websocket.CloseInternalServerErr) || err == websocket.ErrCloseSent || err == io.ErrUnexpectedEOF {
-					return
-				}
+				logger.Warn().Msgf("Failed to unmarshal message: %s", message)
+				continue
+			}
+
+			if !isBatchResult && len(results) == 1 && results[0].Raw()["method"] == "eth_subscription" {
+				e.notify(results[0])
+				continue
+			}
+
+			for _, result := range results {
+				e.deliver(result.Raw())
 			}
+		}
+	}
+}
+
+// deliver hands the answer to the waiter of its id, the answers without a known id cannot be correlated and are dropped
+func (e *websocketClient) deliver(raw map[string]any) {
+	id, ok := _WSItemID(raw)
+	if !ok {
+		e.logger.Warn().Msgf("Dropped an answer without a request id: %v", raw)
+		return
+	}
+	v, ok := e.waiters.Load(id)
+	if !ok {
+		// the call has timed out already
+		return
+	}
+
+	w := v.(*wsWaiter)
+	// registered before the answer is delivered, the notifications may follow right after it
+	if w.sub != nil && raw["error"] == nil {
+		if subId, ok := raw["result"].(string); ok {
+			w.sub.id.Store(subId)
+			e.subs.Store(subId, w.sub)
+		}
+	}
+	w.deliver(id, raw)
+}
+
+// keepalive pings the connection until it is lost, the pongs extend the idle timeout
+func (e *websocketClient) keepalive(ctx context.Context, conn *websocket.Conn) {
+	if e.config.PingInterval <= 0 {
+		return
+	}
 
-			if messageType == websocket.TextMessage {
-				results, isBatchResult, err := rpc.UnmarshalJSONRPCResults(message)
-				if err != nil {
-					logger.Warn().Msgf("Failed to unmarshal message: %s", message)
-					continue
-				}
-
-				if !isBatchResult && len(results) == 1 && results[0].Type() == rpc.JSONRPC_ERROR {
-					sessions.Range(func(key, value interface{}) bool {
-						if c := value.(chan []rpc.JSONRPCResulter); c != nil {
-							c <- results
-							return false
-						}
-						return true
-					})
-				}
-
-				key := getJSONResultKey(results)
-				if c, ok := sessions.Load(key); ok {
-					c.(chan []rpc.JSONRPCResulter) <- results
-				}
+	ticker := time.NewTicker(e.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(e.config.PingInterval)); err != nil {
+				e.logger.Warn().Msgf("Error pinging: %v", err)
+				e.disconnect(conn)
+				return
 			}
 		}
 	}
 }
 
-func (e *websocketClient) connect(ctx context.Context) *websocket.Conn {
+// extend moves the read deadline of the connection by the idle timeout
+func (e *websocketClient) extend(conn *websocket.Conn) error {
+	if e.config.IdleTimeout <= 0 {
+		return nil
+	}
+	return conn.SetReadDeadline(time.Now().Add(e.config.IdleTimeout))
+}
+
+// connect dials the endpoint, and serves the new connection in background
+func (e *websocketClient) connect(ctx context.Context) error {
 	headers := make(http.Header)
 	headers.Set("Content-Type", "application/json")
 	if _headers := e.endpoint.Headers(); _headers != nil {
@@ -130,122 +265,189 @@ func (e *websocketClient) connect(ctx context.Context) *websocket.Conn {
 		dialer.TLSClientConfig = e.config.Transport.TLSClientConfig.Clone()
 	}
 
-	_connect := func(ctx context.Context) *websocket.Conn {
-		var (
-			duration int64 = 0
-			health   bool  = false
+	now := time.Now()
+	conn, _, err := dialer.DialContext(ctx, e.endpoint.Url().String(), headers)
+	if err != nil {
+		e.logger.Error().Msgf("Error creating connection: %v", err)
+		e.endpoint.Update(
+			WithAttr(Health, false),
+			WithAttr(LastUpdateTime, time.Now()),
 		)
+		return err
+	}
+	e.endpoint.Update(
+		WithAttr(Health, true),
+		WithAttr(LastUpdateTime, time.Now()),
+		WithAttr(Duration, float64(time.Since(now).Milliseconds())),
+	)
+
+	e.extend(conn)
+	conn.SetPongHandler(func(string) error {
+		return e.extend(conn)
+	})
 
-		defer func() {
-			ops := []Attributer{
-				WithAttr(Health, health),
-				WithAttr(LastUpdateTime, time.Now()),
-			}
-			if duration > 0 {
-				ops = append(ops, WithAttr(Duration, float64(duration)))
-			}
-			e.endpoint.Update(ops...)
-		}()
-
-		now := time.Now()
-		conn, _, err := dialer.DialContext(ctx, e.endpoint.Url().String(), headers)
-		if err != nil {
-			e.logger.Error().Msgf("Error creating connection: %v", err)
-			return nil
-		}
+	_ctx, _cancel := context.WithCancel(e.ctx)
+	e.mu.Lock()
+	e.conn, e.connCancel = conn, _cancel
+	e.mu.Unlock()
+	e.state(true)
 
-		duration = time.Since(now).Milliseconds()
-		health = true
+	go e.background(_ctx, conn)
+	go e.keepalive(_ctx, conn)
 
-		_ctx, _cancel := context.WithCancel(context.Background())
-		e.ctx = _ctx
-		e.cancel = _cancel
-		go background(e.ctx, e.logger, conn, &e.sessions)
+	// closed meanwhile
+	if e.ctx.Err() != nil {
+		e.disconnect(conn)
+		return e.ctx.Err()
+	}
+	return nil
+}
 
-		return conn
+// disconnect drops the lost connection, fails the requests waiting for its answers, and reconnects in background
+func (e *websocketClient) disconnect(conn *websocket.Conn) {
+	e.mu.Lock()
+	if e.conn != conn {
+		e.mu.Unlock()
+		return
 	}
+	e.conn = nil
+	e.connCancel()
+	e.mu.Unlock()
 
-	conn := _connect(ctx)
+	conn.Close()
+	e.state(false)
+	e.endpoint.Update(
+		WithAttr(Health, false),
+		WithAttr(LastUpdateTime, time.Now()),
+	)
+
+	e.waiters.Range(func(key, v any) bool {
+		e.waiters.Delete(key)
+		v.(*wsWaiter).fail()
+		return true
+	})
 
-	if conn == nil {
-		return nil
+	if e.ctx.Err() == nil {
+		go e.reconnect()
 	}
+}
 
-	conn.SetCloseHandler(func(code int, text string) error {
-		e.logger.Warn().Msgf("Closing connection code %d and text %s", code, text)
-
-		e.endpoint.Update(
-			WithAttr(Health, false),
-			WithAttr(LastUpdateTime, time.Now()),
-		)
+// reconnect dials the endpoint with exponential backoff until it succeeds or the client is closed,
+// the subscriptions are subscribed again on the new connection
+func (e *websocketClient) reconnect() {
+	chain, url := e.endpoint.ChainCode(), e.endpoint.Url().String()
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-time.After(_Backoff(e.config.MinBackoff, e.config.MaxBackoff, attempt)):
+		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		oldConn, oldCancel := e.conn, e.cancel
-		e.conn = _connect(ctx)
+		ctx, cancel := context.WithTimeout(e.ctx, 5*time.Second)
+		err := e.connect(ctx)
 		cancel()
+		if err != nil {
+			utils.TotalWebSocketReconnects.WithLabelValues(chain, url, "failed").Inc()
+			continue
+		}
 
-		message := websocket.FormatCloseMessage(code, "")
-		oldConn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
-		time.AfterFunc(time.Second, func() {
-			oldConn.Close()
-			oldCancel()
-		})
-		return nil
-	})
+		utils.TotalWebSocketReconnects.WithLabelValues(chain, url, "success").Inc()
+		e.logger.Info().Msgf("Reconnected after %d attempts", attempt+1)
+		e.resubscribe()
+		return
+	}
+}
+
+// state reports whether the client is connected by the metric
+func (e *websocketClient) state(connected bool) {
+	v := 0.0
+	if connected {
+		v = 1
+	}
+	utils.WebSocketConnections.WithLabelValues(e.endpoint.ChainCode(), e.endpoint.Url().String()).Set(v)
+}
 
-	return conn
+// _Backoff returns the delay of the reconnection attempt, with a jitter so the clients do not dial all at once
+func _Backoff(minDelay, maxDelay time.Duration, attempt int) time.Duration {
+	if minDelay <= 0 {
+		minDelay = 500 * time.Millisecond
+	}
+	if maxDelay < minDelay {
+		maxDelay = max(30*time.Second, minDelay)
+	}
+
+	d := minDelay << min(attempt, 16)
+	if d <= 0 || d > maxDelay {
+		d = maxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
 func (e *websocketClient) Close() error {
+	e.cancel()
+	e.subs.Range(func(key, value any) bool {
+		value.(*Subscription).end(ErrClientClosed)
+		return true
+	})
+
+	e.mu.Lock()
+	conn := e.conn
+	e.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+
 	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
-	e.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
 	time.AfterFunc(time.Second, func() {
-		e.conn.Close()
-		e.cancel()
+		e.disconnect(conn)
 	})
 	return nil
 }
 
-func isBrokenPipeError(err error) bool {
-	var netErr *net.OpError
-	if errors.As(err, &netErr) {
-		if netErr.Op == "write" && netErr.Err.Error() == "write: broken pipe" {
-			return true
-		}
+func (e *websocketClient) request(ctx context.Context, data []rpc.SealedJSONRPC, sub *Subscription) ([]rpc.JSONRPCResulter, common.HTTPErrors) {
+	first := e.seq.Add(uint64(len(data))) - uint64(len(data)) + 1
+	items := make([]wsItem, len(data))
+	for i := range data {
+		items[i] = wsItem{ID: first + uint64(i), Version: data[i].Version, Method: data[i].Method, Params: data[i].Params}
+	}
+	b, _err := json.Marshal(items)
+	if _err != nil {
+		return nil, common.InternalServerError("Marshalling request failed", _err)
 	}
-	return false
-}
 
-func (e *websocketClient) request(ctx context.Context, key string, b []byte) ([]rpc.JSONRPCResulter, common.HTTPErrors) {
-	c := make(chan []rpc.JSONRPCResulter)
-	e.sessions.Store(key, c)
+	w := newWSWaiter(data, first, sub)
+	for i := range items {
+		e.waiters.Store(items[i].ID, w)
+	}
 	defer func() {
-		if c, ok := e.sessions.Load(key); ok {
-			e.sessions.Delete(key)
-			close(c.(chan []rpc.JSONRPCResulter))
+		for i := range items {
+			e.waiters.Delete(items[i].ID)
 		}
 		_EndpointGauge(e.endpoint).Dec()
 	}()
 
 	_EndpointGauge(e.endpoint).Inc()
 	e.mu.Lock()
-	err := e.conn.WriteMessage(websocket.TextMessage, b)
+	conn := e.conn
+	var err error
+	if conn != nil {
+		if e.config.IdleTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(e.config.IdleTimeout))
+		}
+		err = conn.WriteMessage(websocket.TextMessage, b)
+	}
 	e.mu.Unlock()
 
+	// fails fast while reconnecting
+	if conn == nil {
+		return nil, common.UpstreamServerError("Error connection to endpoint", ErrWebSocketDisconnected)
+	}
+
 	if err != nil {
 		e.logger.Warn().Msgf("Creating request %s %s", e.endpoint.Url(), b)
 		e.logger.Error().Msgf("Error creating request: %v", err)
-
-		if isBrokenPipeError(err) {
-			_ctx, cancel := context.WithTimeoutCause(context.Background(), time.Second, nil)
-			e.mu.Lock()
-			conn := e.connect(_ctx)
-			if conn != nil {
-				e.conn = conn
-			}
-			e.mu.Unlock()
-			cancel()
-		}
+		e.disconnect(conn)
 
 		if _err, ok := err.(*net.OpError); ok {
 			return nil, common.UpstreamServerError("Error creating request", _err.Err)
@@ -255,28 +457,24 @@ func (e *websocketClient) request(ctx context.Context, key string, b []byte) ([]
 	}
 
 	select {
-	case results, ok := <-c:
-		if !ok {
-			return nil, common.UpstreamServerError("Error connection to endpoint", nil)
+	case <-w.done:
+		if w.failed {
+			return nil, common.UpstreamServerError("Error connection to endpoint", ErrWebSocketDisconnected)
 		}
-		return results, nil
+		return w.results, nil
 	case <-ctx.Done():
 		return nil, common.TimeoutError("context deadline exceeded")
 	}
 }
 
-func getJSONRPCKey(data []rpc.SealedJSONRPC) string {
-	ids := slice.Map(data, func(i int, jsonrpc rpc.SealedJSONRPC) string {
-		return fmt.Sprint(jsonrpc.ID)
-	})
-	slice.Sort(ids)
-	return helpers.Short(slice.Join(ids, ""))
+func (e *websocketClient) Call(ctx context.Context, data []rpc.SealedJSONRPC, profiles ...*common.ResponseProfile) (results []rpc.JSONRPCResulter, err error) {
+	return e.call(ctx, data, nil, profiles...)
 }
 
-func (e *websocketClient) Call(ctx context.Context, data []rpc.SealedJSONRPC, profiles ...*common.ResponseProfile) (results []rpc.JSONRPCResulter, err error) {
-	b, err := json.Marshal(data)
-	if err != nil {
-		return nil, common.InternalServerError("Marshalling request failed", err)
+// call sends the items of the data, and returns their answers in the order of the data
+func (e *websocketClient) call(ctx context.Context, data []rpc.SealedJSONRPC, sub *Subscription, profiles ...*common.ResponseProfile) (results []rpc.JSONRPCResulter, err error) {
+	if len(data) == 0 {
+		return nil, common.BadRequestError("Empty request")
 	}
 
 	var profile = &common.ResponseProfile{}
@@ -284,8 +482,8 @@ func (e *websocketClient) Call(ctx context.Context, data []rpc.SealedJSONRPC, pr
 		profile = profiles[0]
 	}
 
-	now, key := time.Now(), getJSONRPCKey(data)
-	results, err = e.request(ctx, key, b)
+	now := time.Now()
+	results, err = e.request(ctx, data, sub)
 	profile.Duration = time.Since(now).Milliseconds()
 
 	defer updateMetrics(e.endpoint, profile)
@@ -307,19 +505,15 @@ func (e *websocketClient) Call(ctx context.Context, data []rpc.SealedJSONRPC, pr
 		profile.Traffic = len(body)
 	}
 
-	if len(results) > 0 {
-		if r := results[len(results)-1]; r.Type() == rpc.JSONRPC_ERROR {
-			recordingErrorResult(profile, r)
-			return results, nil
+	// the answers are in the order of the data, the first error is recorded
+	for _, r := range results {
+		if r.Type() == rpc.JSONRPC_ERROR {
+			recordingErrorResult(profile, r, e.config.Normalizer, e.endpoint)
+			break
 		}
 	}
 
-	// maybe is single result
-	if len(results) != len(data) {
-		return results, nil
-	}
-
-	// maybe includes normal results, should be validate by schema
+	// the normal results are validated by schema
 	if e.config.JSONRPCSchema != nil {
 		if err := validateResults(e.logger, e.config.JSONRPCSchema, profile, data, results); err != nil {
 			return nil, common.UpstreamServerError("Validating response failed", err)
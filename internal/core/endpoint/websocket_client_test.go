@@ -0,0 +1,167 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoPlugin/web3rpcproxy/internal/common"
+	"github.com/GoPlugin/web3rpcproxy/internal/core/rpc"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketReconnect(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := connections.Add(1)
+
+		for {
+			var req []map[string]any
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			// the first connection is lost before the answer
+			if n == 1 {
+				return
+			}
+			conn.WriteJSON([]map[string]any{{"jsonrpc": "2.0", "id": req[0]["id"], "result": "0x1"}})
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	client := NewWebSocketClient(New(u), &websocketClientConfig{MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	if client == nil {
+		t.Fatal("expected a client")
+	}
+	defer client.Close()
+
+	data := []rpc.SealedJSONRPC{{Version: rpc.JSONRPC_VERSION_2, ID: "1", Method: "eth_blockNumber"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the pending call fails without waiting for the timeout, by an error retried by the next endpoints
+	now := time.Now()
+	_, err := client.Call(ctx, data)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if e, ok := err.(common.HTTPErrors); !ok || e.QueryStatus() != common.Fail {
+		t.Errorf("expected %v, got %v", common.Fail, err)
+	}
+	if d := time.Since(now); d > time.Second {
+		t.Errorf("expected less than %v, got %v", time.Second, d)
+	}
+
+	var results []rpc.JSONRPCResulter
+	for time.Now().Before(now.Add(3 * time.Second)) {
+		if results, err = client.Call(ctx, data); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Result() != "0x1" {
+		t.Errorf("expected %v, got %v", "0x1", results)
+	}
+	if n := connections.Load(); n != 2 {
+		t.Errorf("expected %v, got %v", 2, n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		expected *= time.Millisecond
+		d := _Backoff(100*time.Millisecond, time.Second, attempt)
+		if d < expected/2 || d > expected {
+			t.Errorf("expected %v, got %v", expected, d)
+		}
+	}
+	if d := _Backoff(0, 0, 100); d > 30*time.Second {
+		t.Errorf("expected %v, got %v", 30*time.Second, d)
+	}
+}
+
+func TestWebSocketCorrelation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var mu sync.Mutex
+		for {
+			var req []map[string]any
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			// answered concurrently, out of order, and after an error which cannot be correlated
+			go func() {
+				time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+				answers := []map[string]any{}
+				for i := len(req) - 1; i >= 0; i-- {
+					answers = append(answers, map[string]any{"jsonrpc": "2.0", "id": req[i]["id"], "result": req[i]["params"].([]any)[0]})
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				conn.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": nil, "error": map[string]any{"code": -32600, "message": "invalid"}})
+				conn.WriteJSON(answers)
+			}()
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	client := NewWebSocketClient(New(u), &websocketClientConfig{})
+	if client == nil {
+		t.Fatal("expected a client")
+	}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// the same ids in all the calls
+			data := []rpc.SealedJSONRPC{
+				{Version: rpc.JSONRPC_VERSION_2, ID: "1", Method: "eth_getBalance", Params: []any{fmt.Sprintf("0x%da", n)}},
+				{Version: rpc.JSONRPC_VERSION_2, ID: "2", Method: "eth_getBalance", Params: []any{fmt.Sprintf("0x%db", n)}},
+			}
+			results, err := client.Call(ctx, data)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(results) != len(data) {
+				t.Errorf("expected %v, got %v", len(data), len(results))
+				return
+			}
+			for i := range data {
+				if results[i].ID() != data[i].ID || results[i].Result() != data[i].Params[0] {
+					t.Errorf("expected %v %v, got %v %v", data[i].ID, data[i].Params[0], results[i].ID(), results[i].Result())
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+}
@@ -22,6 +22,7 @@ type Reqctxs interface {
 	Logger() *zerolog.Logger
 	ReqID() string
 	ChainID() common.ChainId
+	ChainCode() string
 	Body() *[]byte
 	Options() Options
 	Config() *config.Conf
@@ -170,6 +171,11 @@ func (c *reqctx) ChainID() common.ChainId {
 	return c.chain.ID
 }
 
+func (c *reqctx) ChainCode() string {
+	c.ChainID()
+	return c.chain.Code
+}
+
 func (c *reqctx) Body() *[]byte {
 	body := c.requestCtx.PostBody()
 	return &body
@@ -279,15 +285,65 @@ func (o *Option) AgreeMultiCall() bool {
 	return false
 }
 func (o *Option) AllowChainIDs() []string {
+	if v := o.preference("allow_chain_ids"); v != nil {
+		return slice.Map(_strings(v), func(_ int, chain string) string {
+			return strings.ToLower(strings.TrimSpace(chain))
+		})
+	}
 	return nil
 }
 func (o *Option) AllowMethods() []string {
+	if v := o.preference("allow_methods"); v != nil {
+		return slice.Map(_strings(v), func(_ int, method string) string {
+			return strings.TrimSpace(method)
+		})
+	}
 	return nil
 }
 func (o *Option) AllowContractAddresses() []string {
+	if v := o.preference("allow_contract_addresses"); v != nil {
+		return slice.Map(_strings(v), func(_ int, address string) string {
+			return strings.ToLower(strings.TrimSpace(address))
+		})
+	}
 	return nil
 }
 
+func (o *Option) preference(path string) any {
+	app := o.reqctx.App()
+	if app == nil {
+		app = o.app
+	}
+	if app == nil || app.Preferences == nil {
+		return nil
+	}
+	return app.Preference(path)
+}
+
+func _strings(v any) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []any:
+		return slice.Map(v, func(_ int, item any) string { return _string(item) })
+	case string:
+		if v == "" {
+			return []string{}
+		}
+		return strings.Split(v, ",")
+	default:
+		return []string{_string(v)}
+	}
+}
+
+func _string(v any) string {
+	// json numbers are decoded as float64, e.g. chain ids
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
 func (o *Option) Caches() bool {
 	if o.reqctx.QueryArgs().Has("cache") {
 		if cache, err := strconv.ParseBool(string(o.reqctx.QueryArgs().Peek("cache"))); err == nil {
@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// canonical types of the errors of the endpoints, the node clients and the providers answer them by different codes and messages
+const (
+	ErrorReverted       = "execution_reverted"
+	ErrorNonceTooLow    = "nonce_too_low"
+	ErrorUnderpriced    = "underpriced"
+	ErrorRateLimited    = "rate_limited"
+	ErrorHeaderNotFound = "header_not_found"
+	ErrorRangeTooLarge  = "range_too_large"
+)
+
+// ErrorRule classifies the errors of the endpoints by their codes or messages as a canonical type,
+// RPCCode and Message are the code and the message of the rewritten errors answered to the clients
+type ErrorRule struct {
+	Type    string `yaml:"type" koanf:"type"`
+	Codes   []int  `yaml:"codes" koanf:"codes"`
+	Match   string `yaml:"match" koanf:"match"`
+	RPCCode int    `yaml:"rpc_code" koanf:"rpc_code"`
+	Message string `yaml:"message" koanf:"message"`
+}
+
+// DefaultErrorRules are checked after the configured rules, in order, the first matching rule wins
+var DefaultErrorRules = []ErrorRule{
+	{Type: ErrorReverted, Codes: []int{3}, Match: `(?i)revert`, RPCCode: 3, Message: "execution reverted"},
+	{Type: ErrorNonceTooLow, Match: `(?i)(nonce too low|nonce is too low|invalid nonce|nonce has already been used)`, RPCCode: -32000, Message: "nonce too low"},
+	{Type: ErrorUnderpriced, Match: `(?i)(underpriced|fee too low|gas price too low|less than block base fee|tip too low)`, RPCCode: -32000, Message: "transaction underpriced"},
+	// a range error may be answered by -32005 as well, so it is checked before the rate limits
+	{Type: ErrorRangeTooLarge, Match: `(?i)(block range|range (is )?too|blocks? (are|is) not supported|range over|ranges over|requested too many blocks|response size|more than \d+ results)`, RPCCode: -32005, Message: "block range too large"},
+	{Type: ErrorRateLimited, Codes: []int{-32005, 429}, Match: `(?i)(rate limit|too many requests|request limit|exceeded .*(capacity|quota|limit)|credits)`, RPCCode: -32005, Message: "rate limited"},
+	{Type: ErrorHeaderNotFound, Match: `(?i)(header not found|unknown block|block not found|could not find block)`, RPCCode: -32000, Message: "header not found"},
+}
+
+type errorRule struct {
+	ErrorRule
+	match *regexp.Regexp
+}
+
+// ErrorNormalizer classifies the errors of the endpoints, the rules of a chain are checked before the global ones
+type ErrorNormalizer struct {
+	rules  []errorRule
+	chains map[string][]errorRule
+}
+
+// NewErrorNormalizer creates a normalizer of the rules followed by the default rules, chains are keyed by chain id or chain code
+func NewErrorNormalizer(rules []ErrorRule, chains map[string][]ErrorRule) (*ErrorNormalizer, error) {
+	n := &ErrorNormalizer{
+		chains: map[string][]errorRule{},
+	}
+
+	var err error
+	if n.rules, err = _CompileErrorRules(append(slices.Clone(rules), DefaultErrorRules...)); err != nil {
+		return nil, err
+	}
+	for chain := range chains {
+		if n.chains[chain], err = _CompileErrorRules(chains[chain]); err != nil {
+			return nil, fmt.Errorf("chain %s: %w", chain, err)
+		}
+	}
+	return n, nil
+}
+
+func _CompileErrorRules(rules []ErrorRule) ([]errorRule, error) {
+	_rules := make([]errorRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Type == "" {
+			return nil, fmt.Errorf("error rule without type")
+		}
+		_rule := errorRule{ErrorRule: rule}
+		if rule.Match != "" {
+			match, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("error rule %s: %w", rule.Type, err)
+			}
+			_rule.match = match
+		}
+		_rules = append(_rules, _rule)
+	}
+	return _rules, nil
+}
+
+// Classify returns the canonical type of the error of an endpoint, the chain is looked up by any of the given keys
+func (n *ErrorNormalizer) Classify(err any, chains ...string) (string, bool) {
+	rule, ok := n.rule(err, chains...)
+	if !ok {
+		return "", false
+	}
+	return rule.Type, true
+}
+
+// Rewrite returns the error of an endpoint in the shape of its canonical type, the original data is kept as it is,
+// e.g. the revert payloads decoded by the clients, an error without data keeps its original message in the data,
+// the type and the original code and message are under their own keys, the errors which are not classified are returned as they are
+func (n *ErrorNormalizer) Rewrite(err any, chains ...string) any {
+	rule, ok := n.rule(err, chains...)
+	if !ok || rule.RPCCode == 0 {
+		return err
+	}
+
+	v := err.(map[string]any)
+	message := rule.Message
+	if message == "" {
+		message = rule.Type
+	}
+	data, ok := v["data"]
+	if !ok || data == nil {
+		data = v["message"]
+	}
+	return map[string]any{
+		"code":    rule.RPCCode,
+		"message": message,
+		"data":    data,
+		"type":    rule.Type,
+		"cause": map[string]any{
+			"code":    v["code"],
+			"message": v["message"],
+		},
+	}
+}
+
+func (n *ErrorNormalizer) rule(err any, chains ...string) (errorRule, bool) {
+	v, ok := err.(map[string]any)
+	if n == nil || !ok {
+		return errorRule{}, false
+	}
+	code, _ := _ErrorCode(v["code"])
+	message, _ := v["message"].(string)
+
+	rules := n.rules
+	for i := range chains {
+		if _rules, ok := n.chains[chains[i]]; ok {
+			rules = append(slices.Clone(_rules), rules...)
+			break
+		}
+	}
+	for _, rule := range rules {
+		if slices.Contains(rule.Codes, code) || (rule.match != nil && rule.match.MatchString(message)) {
+			return rule, true
+		}
+	}
+	return errorRule{}, false
+}
+
+func _ErrorCode(v any) (int, bool) {
+	switch code := v.(type) {
+	case float64:
+		return int(code), true
+	case int:
+		return code, true
+	case interface{ Int64() (int64, error) }:
+		n, err := code.Int64()
+		return int(n), err == nil
+	}
+	return 0, false
+}
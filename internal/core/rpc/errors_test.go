@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestErrorNormalizer(t *testing.T) {
+	normalizer, err := NewErrorNormalizer([]ErrorRule{
+		{Type: ErrorRateLimited, Codes: []int{-32090}},
+	}, map[string][]ErrorRule{
+		"sepolia": {{Type: ErrorHeaderNotFound, Match: `(?i)state unavailable`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		err    map[string]any
+		chains []string
+		expect string
+	}{
+		{map[string]any{"code": 3.0, "message": "execution reverted: not owner", "data": "0x08c379a0"}, nil, ErrorReverted},
+		{map[string]any{"code": -32000.0, "message": "nonce too low: next nonce 5, tx nonce 4"}, nil, ErrorNonceTooLow},
+		{map[string]any{"code": -32000.0, "message": "replacement transaction underpriced"}, nil, ErrorUnderpriced},
+		{map[string]any{"code": -32000.0, "message": "max fee per gas less than block base fee"}, nil, ErrorUnderpriced},
+		{map[string]any{"code": -32005.0, "message": "query returned more than 10000 results"}, nil, ErrorRangeTooLarge},
+		{map[string]any{"code": -32005.0, "message": "daily request count exceeded, request rate limited"}, nil, ErrorRateLimited},
+		{map[string]any{"code": json.Number("429"), "message": "Too Many Requests"}, nil, ErrorRateLimited},
+		{map[string]any{"code": -32090.0, "message": "throttled"}, nil, ErrorRateLimited},
+		{map[string]any{"code": -32000.0, "message": "header not found"}, nil, ErrorHeaderNotFound},
+		{map[string]any{"code": -32000.0, "message": "state unavailable"}, []string{"11155111", "sepolia"}, ErrorHeaderNotFound},
+		{map[string]any{"code": -32000.0, "message": "state unavailable"}, []string{"1", "eth"}, ""},
+		{map[string]any{"code": -32601.0, "message": "the method does not exist"}, nil, ""},
+	}
+
+	for _, c := range cases {
+		if got, _ := normalizer.Classify(c.err, c.chains...); got != c.expect {
+			t.Errorf("%v: expected %v, got %v", c.err["message"], c.expect, got)
+		}
+	}
+
+	rewritten, ok := normalizer.Rewrite(map[string]any{"code": -32000.0, "message": "nonce too low: next nonce 5, tx nonce 4"}).(map[string]any)
+	if !ok || rewritten["code"] != -32000 || rewritten["message"] != "nonce too low" || rewritten["type"] != ErrorNonceTooLow {
+		t.Errorf("expected %v, got %v", "the rewritten error", rewritten)
+	}
+	if data := rewritten["data"]; data != "nonce too low: next nonce 5, tx nonce 4" {
+		t.Errorf("expected %v, got %v", "the original message in the data", data)
+	}
+
+	// the revert payload is decoded by the clients from the data
+	reverted, _ := normalizer.Rewrite(map[string]any{"code": -32015.0, "message": "VM execution error: revert", "data": "0x08c379a0"}).(map[string]any)
+	if reverted["code"] != 3 || reverted["data"] != "0x08c379a0" {
+		t.Errorf("expected %v, got %v", "0x08c379a0", reverted)
+	}
+	if cause, _ := reverted["cause"].(map[string]any); cause["code"] != -32015.0 || cause["message"] != "VM execution error: revert" {
+		t.Errorf("expected %v, got %v", "the original code and message", reverted["cause"])
+	}
+
+	unknown := map[string]any{"code": -32601.0, "message": "the method does not exist"}
+	if got := normalizer.Rewrite(unknown); got.(map[string]any)["code"] != -32601.0 {
+		t.Errorf("expected %v, got %v", unknown, got)
+	}
+
+	if _, err := NewErrorNormalizer([]ErrorRule{{Type: ErrorReverted, Match: `(`}}, nil); err == nil {
+		t.Errorf("expected %v, got %v", "an error", err)
+	}
+}
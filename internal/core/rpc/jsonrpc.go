@@ -2,6 +2,8 @@ package rpc
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
 
 	"github.com/duke-git/lancet/v2/slice"
@@ -38,22 +40,75 @@ type JSONRPCer interface {
 	MakeResult(value any, err any) SealedJSONRPCResult
 }
 
+var ErrInvalidRequest = errors.New("invalid request")
+
+// UnmarshalJSONRPCs unmarshals a call or a batch of calls, the items which are not objects are kept as invalid calls,
+// the numeric ids are kept as json.Number to be answered exactly as they are
 func UnmarshalJSONRPCs(b []byte) (jsonrpcs []JSONRPCer, batch bool, err error) {
-	var raws []map[string]any
+	var raws []json.RawMessage
 	if err := json.Unmarshal(b, &raws); err != nil {
-		var raw map[string]any
+		var raw json.RawMessage
 		if err := json.Unmarshal(b, &raw); err != nil {
 			return nil, false, err
 		}
 
-		return []JSONRPCer{NewJSONRPC(raw)}, false, nil
+		return []JSONRPCer{unmarshalJSONRPC(raw)}, false, nil
 	}
 
-	return slice.Map(raws, func(i int, raw map[string]any) JSONRPCer {
-		return NewJSONRPC(raw)
+	return slice.Map(raws, func(i int, raw json.RawMessage) JSONRPCer {
+		return unmarshalJSONRPC(raw)
 	}), true, nil
 }
 
+func unmarshalJSONRPC(b json.RawMessage) JSONRPCer {
+	var raw map[string]any
+	if err := json.Unmarshal(b, &raw); err != nil || raw == nil {
+		return NewJSONRPC(nil)
+	}
+
+	if _, ok := raw["id"].(float64); ok {
+		var id struct {
+			ID json.Number `json:"id"`
+		}
+		if err := json.Unmarshal(b, &id); err == nil {
+			raw["id"] = id.ID
+		}
+	}
+	return NewJSONRPC(raw)
+}
+
+// ValidateJSONRPC checks the call is a JSON-RPC 2.0 request or notification
+func ValidateJSONRPC(req JSONRPCer) error {
+	raw := req.Raw()
+	if raw == nil {
+		return fmt.Errorf("%w: not an object", ErrInvalidRequest)
+	}
+	if raw["jsonrpc"] != JSONRPC_VERSION_2 {
+		return fmt.Errorf("%w: jsonrpc must be \"2.0\"", ErrInvalidRequest)
+	}
+	if method, ok := raw["method"].(string); !ok || method == "" {
+		return fmt.Errorf("%w: method must be a string", ErrInvalidRequest)
+	}
+	switch raw["params"].(type) {
+	case nil, []any, map[string]any:
+	default:
+		return fmt.Errorf("%w: params must be an array or an object", ErrInvalidRequest)
+	}
+	if !ValidID(raw["id"]) {
+		return fmt.Errorf("%w: id must be a string, a number or null", ErrInvalidRequest)
+	}
+	return nil
+}
+
+// ValidID reports whether the id is a string, a number or null
+func ValidID(id any) bool {
+	switch id.(type) {
+	case nil, string, json.Number, float64:
+		return true
+	}
+	return false
+}
+
 type SealedJSONRPC struct {
 	Params  []any  `json:"params"`
 	ID      string `json:"id"`
@@ -92,12 +147,18 @@ func (req jsonrpc) RawParams() any {
 }
 
 func (req jsonrpc) ID() string {
-	if id, ok := req.raw["id"].(float64); ok {
-		_id := strconv.FormatInt(int64(id), 16)
-		return _id
-	} else if req.raw["id"] != nil {
-		_id := req.raw["id"].(string)
-		return _id
+	return _ID(req.raw["id"])
+}
+
+// _ID returns the id as a string, the numbers in their decimal form
+func _ID(id any) string {
+	switch v := id.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
 	}
 	return ""
 }
@@ -127,8 +188,9 @@ func (req jsonrpc) Params() []any {
 	return []any{}
 }
 
+// Type returns JSONRPC_NOTIFY for a request without an id member, a null id is a request
 func (req jsonrpc) Type() JSONRPC_Type {
-	if req.Version() == JSONRPC_VERSION_2 && req.raw["id"] == nil {
+	if _, ok := req.raw["id"]; !ok && req.Version() == JSONRPC_VERSION_2 {
 		return JSONRPC_NOTIFY
 	}
 	return JSONRPC_REQUEST
@@ -148,10 +210,15 @@ func (req jsonrpc) Seal() SealedJSONRPC {
 	return jsonrpc
 }
 
+// MakeResult answers the request with its id as it is, the id of an invalid type is answered as null
 func (req jsonrpc) MakeResult(value any, err any) SealedJSONRPCResult {
+	id := req.raw["id"]
+	if !ValidID(id) {
+		id = nil
+	}
 	return SealedJSONRPCResult{
-		ID:      req.raw["id"],
-		Version: req.raw["jsonrpc"].(string),
+		ID:      id,
+		Version: JSONRPC_VERSION_2,
 		Result:  value,
 		Error:   err,
 	}
@@ -238,14 +305,7 @@ func NewJSONRPCResult(raw map[string]any) JSONRPCResulter {
 }
 
 func (res jsonrpc_result) ID() string {
-	if id, ok := res.raw["id"].(float64); ok {
-		_id := strconv.FormatInt(int64(id), 16)
-		return _id
-	} else if res.raw["id"] != nil {
-		_id := res.raw["id"].(string)
-		return _id
-	}
-	return ""
+	return _ID(res.raw["id"])
 }
 func (res jsonrpc_result) Version() JSONRPC_Version {
 	if version, ok := res.raw["jsonrpc"].(string); ok {
@@ -17,6 +17,9 @@ type JSONRPCSchema struct {
 	_requestSchemas  map[string]map[string]any
 	responseSchemas  map[string]*gojsonschema.Schema
 	_responseSchemas map[string]map[string]any
+	normalizers      map[string]*paramsNormalizer
+	// the requests and responses are validated, otherwise the schema only normalizes the params
+	validation bool
 }
 
 // OpenRPC schema structures
@@ -47,12 +50,14 @@ type Result struct {
 	Name   string          `json:"name"`
 }
 
-func NewJSONRPCSchema(b []byte) *JSONRPCSchema {
+func NewJSONRPCSchema(b []byte, validation bool) *JSONRPCSchema {
 	jrpcSchema := &JSONRPCSchema{
+		validation:       validation,
 		requestSchemas:   make(map[string]*gojsonschema.Schema),
 		_requestSchemas:  make(map[string]map[string]any),
 		responseSchemas:  make(map[string]*gojsonschema.Schema),
 		_responseSchemas: make(map[string]map[string]any),
+		normalizers:      make(map[string]*paramsNormalizer),
 	}
 
 	if len(b) == 0 {
@@ -116,6 +121,16 @@ func NewJSONRPCSchema(b []byte) *JSONRPCSchema {
 			},
 		}
 
+		normalizer := &paramsNormalizer{}
+		for _, param := range openrpcSchema.Methods[i].Params {
+			var schema map[string]any
+			json.Unmarshal(param.Schema, &schema)
+			v, _ := defaultParam(schema)
+			normalizer.params = append(normalizer.params, compileNormalizer(schema))
+			normalizer.defaults = append(normalizer.defaults, v)
+		}
+		jrpcSchema.normalizers[openrpcSchema.Methods[i].Name] = normalizer
+
 		jrpcSchema._requestSchemas[openrpcSchema.Methods[i].Name] = requestSchema
 		if _schema, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(requestSchema)); err == nil {
 			jrpcSchema.requestSchemas[openrpcSchema.Methods[i].Name] = _schema
@@ -130,7 +145,7 @@ func NewJSONRPCSchema(b []byte) *JSONRPCSchema {
 }
 
 func (s *JSONRPCSchema) ValidateRequest(method string, raw map[string]any) error {
-	if s == nil {
+	if s == nil || !s.validation {
 		return nil
 	}
 	if s.requestSchemas[method] == nil {
@@ -153,7 +168,7 @@ func (s *JSONRPCSchema) ValidateRequest(method string, raw map[string]any) error
 }
 
 func (s *JSONRPCSchema) ValidateResponse(method string, raw map[string]any, options ...bool) error {
-	if s == nil {
+	if s == nil || !s.validation {
 		return nil
 	}
 	if s.requestSchemas[method] == nil {
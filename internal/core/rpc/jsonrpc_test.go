@@ -0,0 +1,56 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestUnmarshalJSONRPCs(t *testing.T) {
+	jsonrpcs, batch, err := UnmarshalJSONRPCs([]byte(`[
+		{"jsonrpc":"2.0","id":12345678901234567890,"method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":"0x1","method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":null,"method":"eth_chainId"},
+		{"jsonrpc":"2.0","method":"eth_chainId"},
+		1,
+		{"jsonrpc":"1.0","id":1,"method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":{},"method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":2,"method":"eth_chainId","params":"0x1"}
+	]`))
+	if err != nil || !batch || len(jsonrpcs) != 8 {
+		t.Fatalf("expected %v, got %v %v %v", 8, len(jsonrpcs), batch, err)
+	}
+
+	// the ids are answered exactly as they are
+	b, _ := json.Marshal([]SealedJSONRPCResult{jsonrpcs[0].MakeResult("0x1", nil), jsonrpcs[1].MakeResult("0x1", nil), jsonrpcs[2].MakeResult("0x1", nil)})
+	if expected := `[{"id":12345678901234567890,"result":"0x1","jsonrpc":"2.0"},{"id":"0x1","result":"0x1","jsonrpc":"2.0"},{"id":null,"result":"0x1","jsonrpc":"2.0"}]`; string(b) != expected {
+		t.Errorf("expected %v, got %v", expected, string(b))
+	}
+	if id := jsonrpcs[0].ID(); id != "12345678901234567890" {
+		t.Errorf("expected %v, got %v", "12345678901234567890", id)
+	}
+
+	// a null id is a request, a missing id is a notification
+	for i, expected := range []JSONRPC_Type{JSONRPC_REQUEST, JSONRPC_REQUEST, JSONRPC_REQUEST, JSONRPC_NOTIFY} {
+		if typ := jsonrpcs[i].Type(); typ != expected {
+			t.Errorf("expected %v, got %v", expected, typ)
+		}
+	}
+
+	for i, valid := range []bool{true, true, true, true, false, false, false, false} {
+		err := ValidateJSONRPC(jsonrpcs[i])
+		if (err == nil) != valid || (err != nil && !errors.Is(err, ErrInvalidRequest)) {
+			t.Errorf("expected %v, got %v", valid, err)
+		}
+	}
+	if id := jsonrpcs[6].MakeResult(nil, nil).ID; id != nil {
+		t.Errorf("expected %v, got %v", nil, id)
+	}
+
+	if jsonrpcs, batch, err := UnmarshalJSONRPCs([]byte(`[]`)); err != nil || !batch || len(jsonrpcs) != 0 {
+		t.Errorf("expected %v, got %v %v %v", 0, len(jsonrpcs), batch, err)
+	}
+	if _, _, err := UnmarshalJSONRPCs([]byte(`[{"jsonrpc":"2.0"`)); err == nil {
+		t.Errorf("expected an error, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package rpc
+
+import "strings"
+
+// Match reports whether s matches the pattern, where '*' matches any sequence of characters, e.g. eth_get*, debug_*
+func Match(pattern, s string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == s
+	}
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+
+	return strings.HasSuffix(s, parts[last])
+}
+
+// MatchAny reports whether any of the values matches one of the patterns
+func MatchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if Match(pattern, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
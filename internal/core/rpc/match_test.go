@@ -0,0 +1,36 @@
+package rpc
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		value   string
+		expect  bool
+	}{
+		{"eth_call", "eth_call", true},
+		{"eth_call", "eth_callMany", false},
+		{"eth_get*", "eth_getBalance", true},
+		{"eth_get*", "eth_call", false},
+		{"debug_*", "debug_traceTransaction", true},
+		{"*", "anything", true},
+		{"*_subscribe", "eth_subscribe", true},
+		{"eth_*By*", "eth_getBlockByNumber", true},
+		{"eth_*By*", "eth_getBalance", false},
+		{"eth*Hash", "eth_getBlockByHash", true},
+		{"a*a", "a", false},
+	}
+
+	for _, c := range cases {
+		if got := Match(c.pattern, c.value); got != c.expect {
+			t.Errorf("%s ~ %s: expected %v, got %v", c.pattern, c.value, c.expect, got)
+		}
+	}
+
+	if !MatchAny([]string{"56", "ethereum"}, "1", "ethereum") {
+		t.Errorf("expected %v, got %v", true, false)
+	}
+	if MatchAny(nil, "1") {
+		t.Errorf("expected %v, got %v", false, true)
+	}
+}
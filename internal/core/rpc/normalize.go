@@ -0,0 +1,217 @@
+package rpc
+
+import (
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// normalizer returns the canonical form of a param value, the value is not modified
+type normalizer func(v any) any
+
+var (
+	hexRegexp      = regexp.MustCompile(`^0[xX][0-9a-fA-F]*$`)
+	quantityRegexp = regexp.MustCompile(`^0[xX][0-9a-fA-F]+$`)
+)
+
+func identity(v any) any {
+	return v
+}
+
+// lowercase normalizes the hex encoded addresses, hashes and data
+func lowercase(v any) any {
+	if s, ok := v.(string); ok && hexRegexp.MatchString(s) {
+		return strings.ToLower(s)
+	}
+	return v
+}
+
+// quantity normalizes the hex encoded integers without leading zeros
+func quantity(v any) any {
+	if s, ok := v.(string); ok && quantityRegexp.MatchString(s) {
+		if n, ok := new(big.Int).SetString(s[2:], 16); ok {
+			return "0x" + n.Text(16)
+		}
+	}
+	return v
+}
+
+// variant is an alternative of the oneOf or anyOf of a schema
+type variant struct {
+	typ       string
+	pattern   *regexp.Regexp
+	enum      []any
+	normalize normalizer
+}
+
+// matches reports whether the value is strictly of the variant
+func (v variant) matches(value any) bool {
+	switch value := value.(type) {
+	case string:
+		if v.typ != "" && v.typ != "string" {
+			return false
+		}
+		if len(v.enum) > 0 {
+			for i := range v.enum {
+				if v.enum[i] == value {
+					return true
+				}
+			}
+			return false
+		}
+		return v.pattern == nil || v.pattern.MatchString(value)
+	case map[string]any:
+		return v.typ == "object"
+	case []any:
+		return v.typ == "array"
+	case bool:
+		return v.typ == "boolean"
+	case nil:
+		return v.typ == "null"
+	}
+	return false
+}
+
+// compileNormalizer derives the normalizer of the values of the schema, the quantities lose their leading zeros,
+// the addresses, hashes and data are lowercased, the objects and arrays are normalized by their properties and items
+func compileNormalizer(schema map[string]any) normalizer {
+	if schema == nil {
+		return identity
+	}
+
+	for _, k := range []string{"oneOf", "anyOf"} {
+		alternatives, ok := schema[k].([]any)
+		if !ok {
+			continue
+		}
+		variants := make([]variant, 0, len(alternatives))
+		for i := range alternatives {
+			s, _ := alternatives[i].(map[string]any)
+			if s == nil {
+				continue
+			}
+			v := variant{normalize: compileNormalizer(s)}
+			v.typ, _ = s["type"].(string)
+			v.enum, _ = s["enum"].([]any)
+			if pattern, ok := s["pattern"].(string); ok {
+				v.pattern, _ = regexp.Compile("(?i)" + pattern)
+			}
+			variants = append(variants, v)
+		}
+		return func(value any) any {
+			// the strict matches win, e.g. block hashes are not quantities
+			for i := range variants {
+				if variants[i].matches(value) {
+					return variants[i].normalize(value)
+				}
+			}
+			for i := range variants {
+				if variants[i].typ == "string" && len(variants[i].enum) == 0 {
+					if _, ok := value.(string); ok {
+						return variants[i].normalize(value)
+					}
+				}
+			}
+			return value
+		}
+	}
+
+	switch schema["type"] {
+	case "string":
+		pattern, _ := schema["pattern"].(string)
+		title, _ := schema["title"].(string)
+		switch {
+		case strings.Contains(pattern, "[1-9a-f]+[0-9a-f]"):
+			return quantity
+		case strings.HasPrefix(pattern, "^0x"), strings.Contains(strings.ToLower(title), "address"):
+			return lowercase
+		}
+	case "object":
+		properties, _ := schema["properties"].(map[string]any)
+		normalizers := make(map[string]normalizer, len(properties))
+		for k, v := range properties {
+			s, _ := v.(map[string]any)
+			normalizers[k] = compileNormalizer(s)
+		}
+		return func(value any) any {
+			m, ok := value.(map[string]any)
+			if !ok {
+				return value
+			}
+			_m := make(map[string]any, len(m))
+			for k, v := range m {
+				if normalize, ok := normalizers[k]; ok {
+					v = normalize(v)
+				}
+				_m[k] = v
+			}
+			return _m
+		}
+	case "array":
+		items, _ := schema["items"].(map[string]any)
+		normalize := compileNormalizer(items)
+		return func(value any) any {
+			a, ok := value.([]any)
+			if !ok {
+				return value
+			}
+			_a := make([]any, len(a))
+			for i := range a {
+				_a[i] = normalize(a[i])
+			}
+			return _a
+		}
+	}
+
+	return identity
+}
+
+// defaultParam returns the value the nodes use for the omitted param, latest for the block params
+func defaultParam(schema map[string]any) (any, bool) {
+	for _, k := range []string{"oneOf", "anyOf"} {
+		alternatives, _ := schema[k].([]any)
+		for i := range alternatives {
+			s, _ := alternatives[i].(map[string]any)
+			enum, _ := s["enum"].([]any)
+			for j := range enum {
+				if enum[j] == "latest" {
+					return "latest", true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+type paramsNormalizer struct {
+	params   []normalizer
+	defaults []any
+}
+
+// NormalizeParams returns the canonical params of the method, for the cache keys of the equivalent calls to be equal,
+// the omitted or null trailing params are filled by their defaults, the params are not modified
+func (s *JSONRPCSchema) NormalizeParams(method string, params []any) []any {
+	if s == nil || s.normalizers[method] == nil {
+		return params
+	}
+	n := s.normalizers[method]
+
+	_params := make([]any, 0, max(len(params), len(n.params)))
+	for i := range params {
+		if i < len(n.params) {
+			_params = append(_params, n.params[i](params[i]))
+		} else {
+			_params = append(_params, params[i])
+		}
+	}
+
+	// trailing nulls are omitted params
+	for len(_params) > 0 && _params[len(_params)-1] == nil {
+		_params = _params[:len(_params)-1]
+	}
+	for i := len(_params); i < len(n.defaults) && n.defaults[i] != nil; i++ {
+		_params = append(_params, n.defaults[i])
+	}
+
+	return _params
+}
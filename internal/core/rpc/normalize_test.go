@@ -0,0 +1,55 @@
+package rpc
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestNormalizeParams(t *testing.T) {
+	b, err := os.ReadFile("../../../config/ethereum-openrpc.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewJSONRPCSchema(b, false)
+
+	cases := []struct {
+		method   string
+		params   []any
+		expected string
+	}{
+		{
+			"eth_getBalance",
+			[]any{"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"},
+			`["0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed","latest"]`,
+		},
+		{
+			"eth_getBalance",
+			[]any{"0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0x00a"},
+			`["0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed","0xa"]`,
+		},
+		{
+			"eth_call",
+			[]any{map[string]any{"to": "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", "input": "0xABCD"}, nil},
+			`[{"input":"0xabcd","to":"0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"},"latest"]`,
+		},
+		{
+			// block hashes keep their leading zeros
+			"eth_getBalance",
+			[]any{"0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0x00AB000000000000000000000000000000000000000000000000000000000000"},
+			`["0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed","0x00ab000000000000000000000000000000000000000000000000000000000000"]`,
+		},
+		{
+			"eth_getBlockByNumber",
+			[]any{"0x01", false},
+			`["0x1",false]`,
+		},
+	}
+
+	for _, c := range cases {
+		b, _ := json.Marshal(s.NormalizeParams(c.method, c.params))
+		if string(b) != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, b)
+		}
+	}
+}
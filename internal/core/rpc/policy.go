@@ -0,0 +1,56 @@
+package rpc
+
+// DefaultDenyMethods are the methods which manage the node or use its keystore,
+// they must never be proxied to a node unless allowed explicitly
+var DefaultDenyMethods = []string{
+	"admin_*",
+	"personal_*",
+	"miner_*",
+	"clique_*",
+	"engine_*",
+	"debug_setHead",
+	"eth_sign",
+	"eth_signTransaction",
+	"eth_signTypedData*",
+	"eth_sendTransaction",
+}
+
+// Policy is a list of method patterns to deny and the exceptions to allow
+type Policy struct {
+	Deny  []string `yaml:"deny" koanf:"deny"`
+	Allow []string `yaml:"allow" koanf:"allow"`
+}
+
+// Firewall decides whether a method may be proxied, the policy of a chain overrides the global one
+type Firewall struct {
+	policy Policy
+	chains map[string]Policy
+}
+
+// NewFirewall creates a firewall, chains are keyed by chain id or chain code
+func NewFirewall(policy Policy, chains map[string]Policy) *Firewall {
+	if chains == nil {
+		chains = map[string]Policy{}
+	}
+	return &Firewall{
+		policy: policy,
+		chains: chains,
+	}
+}
+
+// Allowed reports whether the method may be proxied to the chain, which is looked up by any of the given keys
+func (f *Firewall) Allowed(method string, chains ...string) bool {
+	for i := range chains {
+		if policy, ok := f.chains[chains[i]]; ok {
+			if MatchAny(policy.Allow, method) {
+				return true
+			}
+			if MatchAny(policy.Deny, method) {
+				return false
+			}
+			break
+		}
+	}
+
+	return !MatchAny(f.policy.Deny, method) || MatchAny(f.policy.Allow, method)
+}
@@ -0,0 +1,34 @@
+package rpc
+
+import "testing"
+
+func TestFirewall(t *testing.T) {
+	firewall := NewFirewall(Policy{Deny: DefaultDenyMethods, Allow: []string{"personal_listAccounts"}}, map[string]Policy{
+		"1":       {Deny: []string{"debug_*"}},
+		"sepolia": {Allow: []string{"debug_setHead"}},
+	})
+
+	cases := []struct {
+		method string
+		chains []string
+		expect bool
+	}{
+		{"eth_call", nil, true},
+		{"admin_peers", nil, false},
+		{"personal_unlockAccount", nil, false},
+		{"personal_listAccounts", nil, true},
+		{"eth_sendTransaction", nil, false},
+		{"eth_sendRawTransaction", nil, true},
+		{"debug_traceTransaction", []string{"56", "bsc"}, true},
+		{"debug_traceTransaction", []string{"1", "eth"}, false},
+		{"debug_setHead", []string{"1", "eth"}, false},
+		{"debug_setHead", []string{"11155111", "sepolia"}, true},
+		{"admin_peers", []string{"11155111", "sepolia"}, false},
+	}
+
+	for _, c := range cases {
+		if got := firewall.Allowed(c.method, c.chains...); got != c.expect {
+			t.Errorf("%s %v: expected %v, got %v", c.method, c.chains, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package tx
+
+import (
+	"errors"
+	"math/big"
+)
+
+var (
+	ErrRLPTooShort     = errors.New("rlp: value size exceeds available input length")
+	ErrRLPNonCanonical = errors.New("rlp: non-canonical size information")
+	ErrRLPTrailing     = errors.New("rlp: input contains more than one value")
+	ErrRLPExpectedList = errors.New("rlp: expected list")
+	ErrRLPExpectedStr  = errors.New("rlp: expected string")
+)
+
+// item is a decoded rlp value, raw keeps the original encoding of the value
+type item struct {
+	list  bool
+	value []byte
+	items []item
+	raw   []byte
+}
+
+func decodeRLP(b []byte) (item, error) {
+	it, rest, err := decodeItem(b)
+	if err != nil {
+		return item{}, err
+	}
+	if len(rest) > 0 {
+		return item{}, ErrRLPTrailing
+	}
+	return it, nil
+}
+
+func decodeItem(b []byte) (item, []byte, error) {
+	if len(b) == 0 {
+		return item{}, nil, ErrRLPTooShort
+	}
+
+	var (
+		prefix = b[0]
+		offset int
+		size   int
+	)
+
+	switch {
+	case prefix < 0x80:
+		return item{value: b[:1], raw: b[:1]}, b[1:], nil
+	case prefix < 0xb8:
+		offset, size = 1, int(prefix-0x80)
+		if size == 1 && len(b) > 1 && b[1] < 0x80 {
+			return item{}, nil, ErrRLPNonCanonical
+		}
+	case prefix < 0xc0:
+		n := int(prefix - 0xb7)
+		s, err := readSize(b[1:], n)
+		if err != nil {
+			return item{}, nil, err
+		}
+		if s < 56 {
+			return item{}, nil, ErrRLPNonCanonical
+		}
+		offset, size = 1+n, s
+	case prefix < 0xf8:
+		offset, size = 1, int(prefix-0xc0)
+	default:
+		n := int(prefix - 0xf7)
+		s, err := readSize(b[1:], n)
+		if err != nil {
+			return item{}, nil, err
+		}
+		if s < 56 {
+			return item{}, nil, ErrRLPNonCanonical
+		}
+		offset, size = 1+n, s
+	}
+
+	if size < 0 || len(b) < offset+size {
+		return item{}, nil, ErrRLPTooShort
+	}
+
+	it := item{raw: b[:offset+size]}
+	payload := b[offset : offset+size]
+	if prefix < 0xc0 {
+		it.value = payload
+		return it, b[offset+size:], nil
+	}
+
+	it.list = true
+	for len(payload) > 0 {
+		child, rest, err := decodeItem(payload)
+		if err != nil {
+			return item{}, nil, err
+		}
+		it.items = append(it.items, child)
+		payload = rest
+	}
+	return it, b[offset+size:], nil
+}
+
+func readSize(b []byte, n int) (int, error) {
+	if n > 8 || len(b) < n {
+		return 0, ErrRLPTooShort
+	}
+	if n > 0 && b[0] == 0 {
+		return 0, ErrRLPNonCanonical
+	}
+	size := 0
+	for i := 0; i < n; i++ {
+		size = size<<8 | int(b[i])
+	}
+	return size, nil
+}
+
+func (it item) bytes() ([]byte, error) {
+	if it.list {
+		return nil, ErrRLPExpectedStr
+	}
+	return it.value, nil
+}
+
+func (it item) uint64() (uint64, error) {
+	b, err := it.bytes()
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > 8 || (len(b) > 0 && b[0] == 0) {
+		return 0, ErrRLPNonCanonical
+	}
+	var v uint64
+	for i := range b {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+func (it item) bigInt() (*big.Int, error) {
+	b, err := it.bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 && b[0] == 0 {
+		return nil, ErrRLPNonCanonical
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func encodeHeader(offset byte, size int) []byte {
+	if size < 56 {
+		return []byte{offset + byte(size)}
+	}
+	var n []byte
+	for s := size; s > 0; s >>= 8 {
+		n = append([]byte{byte(s)}, n...)
+	}
+	return append([]byte{offset + 55 + byte(len(n))}, n...)
+}
+
+func encodeBytes(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return []byte{b[0]}
+	}
+	return append(encodeHeader(0x80, len(b)), b...)
+}
+
+func encodeBigInt(v *big.Int) []byte {
+	return encodeBytes(v.Bytes())
+}
+
+// encodeList wraps the already encoded values into a rlp list
+func encodeList(values ...[]byte) []byte {
+	size := 0
+	for i := range values {
+		size += len(values[i])
+	}
+	b := make([]byte, 0, size+9)
+	b = append(b, encodeHeader(0xc0, size)...)
+	for i := range values {
+		b = append(b, values[i]...)
+	}
+	return b
+}
@@ -0,0 +1,238 @@
+package tx
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+type Type = uint8
+
+// EIP-2718 transaction types
+const (
+	LegacyTxType     Type = 0x00
+	AccessListTxType Type = 0x01
+	DynamicFeeTxType Type = 0x02
+	BlobTxType       Type = 0x03
+	SetCodeTxType    Type = 0x04
+)
+
+var (
+	ErrEmpty            = errors.New("empty transaction")
+	ErrUnsupportedType  = errors.New("transaction type not supported")
+	ErrInvalidFields    = errors.New("invalid transaction fields")
+	ErrInvalidSignature = errors.New("invalid transaction signature")
+)
+
+// fields layout of each transaction type, the signature (v, r, s) is always at the end
+type layout struct {
+	size  int
+	nonce int
+	to    int
+}
+
+var layouts = map[Type]layout{
+	LegacyTxType:     {size: 9, nonce: 0, to: 3},
+	AccessListTxType: {size: 11, nonce: 1, to: 4},
+	DynamicFeeTxType: {size: 12, nonce: 1, to: 5},
+	BlobTxType:       {size: 14, nonce: 1, to: 5},
+	SetCodeTxType:    {size: 13, nonce: 1, to: 5},
+}
+
+// Transaction is the decoded summary of a signed raw transaction
+type Transaction struct {
+	Type Type
+	// ChainID is nil when a legacy transaction is not replay-protected (pre EIP-155)
+	ChainID *big.Int
+	Nonce   uint64
+	// To is empty for contract creation
+	To   string
+	From string
+	Hash string
+}
+
+// Protected reports whether the signature commits to a chain id
+func (t *Transaction) Protected() bool {
+	return t.ChainID != nil
+}
+
+// MatchChainID reports whether the transaction can be executed on the given chain
+func (t *Transaction) MatchChainID(chainId uint64) bool {
+	return !t.Protected() || (t.ChainID.IsUint64() && t.ChainID.Uint64() == chainId)
+}
+
+// DecodeHex decodes a 0x-prefixed raw transaction as accepted by eth_sendRawTransaction
+func DecodeHex(s string) (*Transaction, error) {
+	b, err := helpers.DecodeHex(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFields, err)
+	}
+	return Decode(b)
+}
+
+// Decode decodes a legacy rlp or typed (EIP-2718) transaction envelope and recovers the sender
+func Decode(raw []byte) (*Transaction, error) {
+	if len(raw) == 0 {
+		return nil, ErrEmpty
+	}
+
+	// legacy transactions are rlp lists, which always start with a byte >= 0xc0
+	if raw[0] >= 0xc0 {
+		it, err := decodeRLP(raw)
+		if err != nil {
+			return nil, err
+		}
+		return decodeLegacy(raw, it)
+	}
+
+	txType := raw[0]
+	if txType > 0x7f {
+		return nil, ErrUnsupportedType
+	}
+	if _, ok := layouts[txType]; !ok {
+		return nil, fmt.Errorf("%w: 0x%02x", ErrUnsupportedType, txType)
+	}
+
+	it, err := decodeRLP(raw[1:])
+	if err != nil {
+		return nil, err
+	}
+	if !it.list {
+		return nil, ErrRLPExpectedList
+	}
+
+	// blob transactions are submitted in the network form [tx_payload_body, blobs, commitments, proofs]
+	if txType == BlobTxType && len(it.items) > 0 && it.items[0].list {
+		it = it.items[0]
+	}
+
+	return decodeTyped(txType, it)
+}
+
+func decodeLegacy(raw []byte, it item) (*Transaction, error) {
+	l := layouts[LegacyTxType]
+	if !it.list || len(it.items) != l.size {
+		return nil, ErrInvalidFields
+	}
+
+	t, err := decodeCommon(LegacyTxType, it, l)
+	if err != nil {
+		return nil, err
+	}
+	t.Hash = helpers.Keccak256Hex(raw)
+
+	v, err := it.items[6].bigInt()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		recid  uint64
+		fields = rawItems(it.items[:6])
+	)
+	switch {
+	case v.IsUint64() && (v.Uint64() == 27 || v.Uint64() == 28):
+		recid = v.Uint64() - 27
+	case v.Cmp(big.NewInt(35)) >= 0:
+		// v = chainId * 2 + 35 + recid
+		chainId := new(big.Int).Sub(v, big.NewInt(35))
+		recid = uint64(chainId.Bit(0))
+		chainId.Rsh(chainId, 1)
+		t.ChainID = chainId
+		fields = append(fields, encodeBigInt(chainId), encodeBytes(nil), encodeBytes(nil))
+	default:
+		return nil, ErrInvalidSignature
+	}
+
+	t.From, err = recoverSender(helpers.Keccak256(encodeList(fields...)), recid, it.items[7], it.items[8])
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func decodeTyped(txType Type, it item) (*Transaction, error) {
+	l := layouts[txType]
+	if len(it.items) != l.size {
+		return nil, ErrInvalidFields
+	}
+
+	t, err := decodeCommon(txType, it, l)
+	if err != nil {
+		return nil, err
+	}
+	t.Hash = helpers.Keccak256Hex([]byte{txType}, it.raw)
+
+	if t.ChainID, err = it.items[0].bigInt(); err != nil {
+		return nil, err
+	}
+
+	parity, err := it.items[l.size-3].uint64()
+	if err != nil || parity > 1 {
+		return nil, ErrInvalidSignature
+	}
+
+	payload := encodeList(rawItems(it.items[:l.size-3])...)
+	t.From, err = recoverSender(helpers.Keccak256([]byte{txType}, payload), parity, it.items[l.size-2], it.items[l.size-1])
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func decodeCommon(txType Type, it item, l layout) (*Transaction, error) {
+	nonce, err := it.items[l.nonce].uint64()
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := it.items[l.to].bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(to) != 0 && len(to) != 20 {
+		return nil, ErrInvalidFields
+	}
+
+	t := &Transaction{Type: txType, Nonce: nonce}
+	if len(to) > 0 {
+		t.To = "0x" + hex.EncodeToString(to)
+	}
+	return t, nil
+}
+
+func rawItems(items []item) [][]byte {
+	values := make([][]byte, len(items))
+	for i := range items {
+		values[i] = items[i].raw
+	}
+	return values
+}
+
+func recoverSender(hash []byte, recid uint64, r, s item) (string, error) {
+	_r, err := r.bytes()
+	if err != nil || len(_r) > 32 {
+		return "", ErrInvalidSignature
+	}
+	_s, err := s.bytes()
+	if err != nil || len(_s) > 32 {
+		return "", ErrInvalidSignature
+	}
+
+	// compact signature: [27 + recid] || r || s
+	sig := make([]byte, 65)
+	sig[0] = byte(27 + recid)
+	copy(sig[33-len(_r):33], _r)
+	copy(sig[65-len(_s):], _s)
+
+	pub, _, err := ecdsa.RecoverCompact(sig, hash)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	return "0x" + hex.EncodeToString(helpers.Keccak256(pub.SerializeUncompressed()[1:])[12:]), nil
+}
@@ -0,0 +1,125 @@
+package tx
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/GoPlugin/web3rpcproxy/utils/helpers"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// the example transaction of EIP-155
+const eip155Tx = "0xf86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83"
+
+func TestDecodeLegacy(t *testing.T) {
+	tx, err := DecodeHex(eip155Tx)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if tx.Type != LegacyTxType {
+		t.Errorf("expected %d, got %d", LegacyTxType, tx.Type)
+	}
+	if !tx.MatchChainID(1) || tx.MatchChainID(56) {
+		t.Errorf("expected chain id 1, got %v", tx.ChainID)
+	}
+	if tx.Nonce != 9 {
+		t.Errorf("expected %d, got %d", 9, tx.Nonce)
+	}
+	if tx.To != "0x3535353535353535353535353535353535353535" {
+		t.Errorf("expected %s, got %s", "0x3535353535353535353535353535353535353535", tx.To)
+	}
+	if tx.From != "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f" {
+		t.Errorf("expected %s, got %s", "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f", tx.From)
+	}
+	if tx.Hash != "0x33469b22e9f636356c4160a87eb19df52b7412e8eac32a4a55ffe88ea8350788" {
+		t.Errorf("expected %s, got %s", "0x33469b22e9f636356c4160a87eb19df52b7412e8eac32a4a55ffe88ea8350788", tx.Hash)
+	}
+}
+
+func signDynamicFeeTx(t *testing.T, key *secp256k1.PrivateKey, chainId int64, nonce uint64, to []byte) []byte {
+	fields := [][]byte{
+		encodeBigInt(big.NewInt(chainId)),
+		encodeBigInt(new(big.Int).SetUint64(nonce)),
+		encodeBigInt(big.NewInt(1e9)),
+		encodeBigInt(big.NewInt(2e10)),
+		encodeBigInt(big.NewInt(21000)),
+		encodeBytes(to),
+		encodeBigInt(big.NewInt(1)),
+		encodeBytes(nil),
+		encodeList(),
+	}
+
+	hash := helpers.Keccak256([]byte{DynamicFeeTxType}, encodeList(fields...))
+	sig := ecdsa.SignCompact(key, hash, false)
+
+	fields = append(fields, encodeBigInt(big.NewInt(int64(sig[0]-27))), encodeBytes(sig[1:33]), encodeBytes(sig[33:]))
+	return append([]byte{DynamicFeeTxType}, encodeList(fields...)...)
+}
+
+func TestDecodeDynamicFee(t *testing.T) {
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := "0x" + hex.EncodeToString(helpers.Keccak256(key.PubKey().SerializeUncompressed()[1:])[12:])
+
+	to, _ := hex.DecodeString("1234567890abcdef1234567890abcdef12345678")
+	raw := signDynamicFeeTx(t, key, 11155111, 42, to)
+
+	tx, err := Decode(raw)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if tx.Type != DynamicFeeTxType {
+		t.Errorf("expected %d, got %d", DynamicFeeTxType, tx.Type)
+	}
+	if !tx.MatchChainID(11155111) || tx.MatchChainID(1) {
+		t.Errorf("expected chain id 11155111, got %v", tx.ChainID)
+	}
+	if tx.Nonce != 42 {
+		t.Errorf("expected %d, got %d", 42, tx.Nonce)
+	}
+	if tx.To != "0x1234567890abcdef1234567890abcdef12345678" {
+		t.Errorf("expected %s, got %s", "0x1234567890abcdef1234567890abcdef12345678", tx.To)
+	}
+	if tx.From != from {
+		t.Errorf("expected %s, got %s", from, tx.From)
+	}
+	if hash := helpers.Keccak256Hex(raw); tx.Hash != hash {
+		t.Errorf("expected %s, got %s", hash, tx.Hash)
+	}
+
+	// contract creation
+	tx, err = Decode(signDynamicFeeTx(t, key, 1, 0, nil))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if tx.To != "" {
+		t.Errorf("expected empty, got %s", tx.To)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	cases := map[string]string{
+		"empty":     "0x",
+		"truncated": eip155Tx[:len(eip155Tx)-2],
+		"type":      "0x7f01",
+		"fields":    "0x02c0",
+		"trailing":  eip155Tx + "00",
+	}
+
+	for name, raw := range cases {
+		if _, err := DecodeHex(raw); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+
+	if _, err := DecodeHex("0x7f01"); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("expected %v, got %v", ErrUnsupportedType, err)
+	}
+}
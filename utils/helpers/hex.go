@@ -0,0 +1,38 @@
+package helpers
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// DecodeHex decode a hex string with or without the 0x prefix.
+func DecodeHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+	return hex.DecodeString(s)
+}
+
+// DecodeQuantity decode a 0x-prefixed hex quantity, e.g. a block number.
+func DecodeQuantity(v any) (uint64, bool) {
+	switch v := v.(type) {
+	case string:
+		if !strings.HasPrefix(v, "0x") && !strings.HasPrefix(v, "0X") {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(v[2:], 16, 64)
+		return n, err == nil
+	case uint64:
+		return v, true
+	case float64:
+		return uint64(v), v >= 0
+	}
+	return 0, false
+}
+
+// EncodeQuantity encode a number into a 0x-prefixed hex quantity.
+func EncodeQuantity(n uint64) string {
+	return "0x" + strconv.FormatUint(n, 16)
+}
@@ -0,0 +1,21 @@
+package helpers
+
+import (
+	"encoding/hex"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Keccak256 hash the given bytes using the legacy Keccak-256 used by Ethereum.
+func Keccak256(data ...[]byte) []byte {
+	hasher := sha3.NewLegacyKeccak256()
+	for i := range data {
+		hasher.Write(data[i])
+	}
+	return hasher.Sum(nil)
+}
+
+// Keccak256Hex hash the given bytes and return the 0x-prefixed hex string.
+func Keccak256Hex(data ...[]byte) string {
+	return "0x" + hex.EncodeToString(Keccak256(data...))
+}
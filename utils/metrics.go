@@ -58,6 +58,54 @@ var TotalAmqpMessages = prometheus.NewCounterVec(
 	[]string{"chain", "app"},
 )
 
+var TotalDuplicateTransactions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prefix + "total_duplicate_transactions",
+		Help: "Total number of duplicate raw transactions submissions",
+	},
+	[]string{"chain", "app"},
+)
+
+var TotalBlockedMethods = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prefix + "total_blocked_methods",
+		Help: "Total number of calls blocked by the method firewall",
+	},
+	[]string{"chain", "app", "method"},
+)
+
+var TotalCoalescedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prefix + "total_coalesced_requests",
+		Help: "Total number of calls answered by an identical call in flight",
+	},
+	[]string{"chain", "app", "method"},
+)
+
+var TotalPrefetches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prefix + "total_prefetches",
+		Help: "Total number of calls prefetched for the new heads, by status cached, failed or skipped",
+	},
+	[]string{"chain", "method", "status"},
+)
+
+var TotalReorgs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prefix + "total_reorgs",
+		Help: "Total number of chain reorganizations detected",
+	},
+	[]string{"chain"},
+)
+
+var TotalReorgInvalidations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prefix + "total_reorg_invalidations",
+		Help: "Total number of cache entries invalidated by chain reorganizations",
+	},
+	[]string{"chain"},
+)
+
 var EndpointDurationSummaryName = prefix + "endpoint_url_durations"
 var EndpointDurationSummary = prometheus.NewSummaryVec(
 	prometheus.SummaryOpts{
@@ -92,3 +140,19 @@ var EndpointGauge = prometheus.NewGaugeVec(
 		"duration",
 	},
 )
+
+var WebSocketConnections = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: prefix + "websocket_connections",
+		Help: "Connection state of the WebSocket endpoints, 1 while connected and 0 while reconnecting",
+	},
+	[]string{"chain", "url"},
+)
+
+var TotalWebSocketReconnects = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: prefix + "total_websocket_reconnects",
+		Help: "Total number of reconnection attempts of the WebSocket endpoints",
+	},
+	[]string{"chain", "url", "status"},
+)